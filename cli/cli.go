@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Exit codes returned by Run
+const (
+	ExitOK          = 0
+	ExitFailure     = 1
+	ExitUsage       = 2
+	ExitMismatch    = 3
+	ExitInterrupted = 130
+)
+
+const program = "torrent-client"
+
+type command struct {
+	name    string
+	args    string
+	summary string
+
+	// setup registers the command's flags and returns the function that
+	// runs it once they are parsed
+	setup func(fs *flag.FlagSet) runFunc
+}
+
+type runFunc func(ctx context.Context, e *env, args []string) error
+
+var commands = []*command{
+	downloadCommand,
+	infoCommand,
+	createCommand,
+	verifyCommand,
+	magnetCommand,
+	seedCommand,
+	trackerCommand,
+}
+
+// env is what a command may touch besides its arguments
+type env struct {
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// usageError reports bad arguments; Run prints it with the command's usage
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// exitError ends a command with a specific exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// Run executes the command named by args[0] and returns the process exit
+// code. Cancelling ctx interrupts long-running commands.
+func Run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	e := &env{stdout: stdout, stderr: stderr}
+
+	if len(args) == 0 {
+		printUsage(stderr)
+		return ExitUsage
+	}
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(args) > 1 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				fs := newFlagSet(cmd, stdout)
+				cmd.setup(fs)
+				fs.Usage()
+				return ExitOK
+			}
+		}
+		printUsage(stdout)
+		return ExitOK
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(stderr, "%s: unknown command %q\n\n", program, name)
+		printUsage(stderr)
+		return ExitUsage
+	}
+
+	fs := newFlagSet(cmd, stderr)
+	run := cmd.setup(fs)
+
+	// The flag package has already explained any error
+	positional, err := parseFlags(fs, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return ExitOK
+	}
+	if err != nil {
+		return ExitUsage
+	}
+
+	err = run(ctx, e, positional)
+
+	var usageErr *usageError
+	var exitErr *exitError
+
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(stderr, "%s %s: %v\n", program, cmd.name, err)
+		fs.Usage()
+		return ExitUsage
+	case errors.Is(err, context.Canceled):
+		fmt.Fprintf(stderr, "%s %s: interrupted\n", program, cmd.name)
+		return ExitInterrupted
+	case errors.As(err, &exitErr):
+		fmt.Fprintf(stderr, "%s %s: %v\n", program, cmd.name, err)
+		return exitErr.code
+	}
+
+	fmt.Fprintf(stderr, "%s %s: %v\n", program, cmd.name, err)
+	return ExitFailure
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [arguments]\n\ncommands:\n", program)
+
+	sorted := append([]*command(nil), commands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	for _, cmd := range sorted {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+
+	fmt.Fprintf(w, "\nRun '%s help <command>' for the flags of a command.\n", program)
+}
+
+func newFlagSet(c *command, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n\n%s\n", program, c.name, c.args, c.summary)
+
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(fs.Output(), "\nflags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
@@ -0,0 +1,293 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+	"github.com/prabal199251/Torrent-Client/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func run(t *testing.T, ctx context.Context, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := Run(ctx, args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunUsage(t *testing.T) {
+	tests := map[string]struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		"no arguments": {
+			args:   nil,
+			code:   ExitUsage,
+			stderr: "usage: torrent-client <command>",
+		},
+		"help": {
+			args:   []string{"help"},
+			code:   ExitOK,
+			stdout: "download   download a torrent",
+		},
+		"help for a command": {
+			args:   []string{"help", "download"},
+			code:   ExitOK,
+			stdout: "-max-peers",
+		},
+		"-h flag": {
+			args:   []string{"create", "-h"},
+			code:   ExitOK,
+			stderr: "usage: torrent-client create [flags] <file>",
+		},
+		"unknown command": {
+			args:   []string{"frobnicate"},
+			code:   ExitUsage,
+			stderr: `unknown command "frobnicate"`,
+		},
+		"unknown flag": {
+			args:   []string{"download", "-bogus", "a.torrent"},
+			code:   ExitUsage,
+			stderr: "flag provided but not defined: -bogus",
+		},
+		"missing argument": {
+			args:   []string{"verify", "a.torrent"},
+			code:   ExitUsage,
+			stderr: "expected a torrent file and the data to check",
+		},
+		"bad flag value": {
+			args:   []string{"download", "-download-rate", "fast", "a.torrent"},
+			code:   ExitUsage,
+			stderr: `invalid size "fast"`,
+		},
+		"missing file": {
+			args:   []string{"info", filepath.Join(t.TempDir(), "missing.torrent")},
+			code:   ExitFailure,
+			stderr: "no such file or directory",
+		},
+	}
+
+	for name, test := range tests {
+		code, stdout, stderr := run(t, context.Background(), test.args...)
+		assert.Equal(t, test.code, code, name)
+		assert.Contains(t, stdout, test.stdout, name)
+		assert.Contains(t, stderr, test.stderr, name)
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	path, err := outputPath("out", "file.iso")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("out", "file.iso"), path)
+
+	for _, name := range []string{"", ".", "..", "../escape", "dir/file"} {
+		_, err := outputPath("out", name)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	const arch = "../torrentFile/testdata/archlinux-2019.12.01-x86_64.iso.torrent"
+
+	code, stdout, _ := run(t, context.Background(), "info", arch)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "Infohash:     dee86a7fa6f286a9d74c362014616a0ff5e4843d\n              33UGU75G6KDKTV2MGYQBIYLKB726JBB5\n")
+	assert.Contains(t, stdout, "Pieces:       1278 x 512.0 KiB\n")
+	assert.Contains(t, stdout, "  tier 1  http://tracker.archlinux.org:6969/announce\n")
+	assert.Contains(t, stdout, "Files:\n  archlinux-2019.12.01-x86_64.iso  639.0 MiB\n")
+
+	code, stdout, _ = run(t, context.Background(), "info", "-json", arch)
+	assert.Equal(t, ExitOK, code)
+
+	var m struct {
+		Name     string
+		InfoHash struct{ Hex, Base32 string }
+		Pieces   int
+		Files    []struct{ Path []string }
+	}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &m))
+	assert.Equal(t, "archlinux-2019.12.01-x86_64.iso", m.Name)
+	assert.Equal(t, "dee86a7fa6f286a9d74c362014616a0ff5e4843d", m.InfoHash.Hex)
+	assert.Equal(t, 1278, m.Pieces)
+	assert.Len(t, m.Files, 1)
+}
+
+func TestPrintFileTree(t *testing.T) {
+	var out bytes.Buffer
+	printFileTree(&out, []torrentfile.File{
+		{Path: []string{"photos", "2023", "a.jpg"}, Length: 2048},
+		{Path: []string{"photos", "2023", "b.jpg"}, Length: 100},
+		{Path: []string{"photos", "2024", "c.jpg"}, Length: 1 << 20},
+		{Path: []string{"photos", "readme.txt"}, Length: 10},
+	})
+
+	expected := `  photos/
+    2023/
+      a.jpg  2.0 KiB
+      b.jpg  100 B
+    2024/
+      c.jpg  1.0 MiB
+    readme.txt  10 B
+`
+	assert.Equal(t, expected, out.String())
+}
+
+func TestFormatRanges(t *testing.T) {
+	tests := map[string]struct {
+		input  []int
+		output string
+	}{
+		"single": {input: []int{4}, output: "4"},
+		"run":    {input: []int{3, 4, 5}, output: "3-5"},
+		"mixed":  {input: []int{1, 3, 4, 5, 7, 9, 10}, output: "1, 3-5, 7, 9-10"},
+		"empty":  {input: nil, output: ""},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, formatRanges(test.input), name)
+	}
+}
+
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestTrackerAllowlist(t *testing.T) {
+	tests := map[string]struct {
+		contents string
+		allowed  int
+	}{
+		"empty":         {contents: "", allowed: 0},
+		"only comments": {contents: "# nothing here yet\n\n", allowed: 0},
+		"one infohash":  {contents: "# ours\n" + strings.Repeat("ab", 20) + "\n", allowed: 1},
+	}
+
+	for name, test := range tests {
+		path := filepath.Join(t.TempDir(), "allow.txt")
+		require.Nil(t, os.WriteFile(path, []byte(test.contents), 0644), name)
+
+		store, allowed, err := newTrackerStore(time.Hour, path)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.allowed, allowed, name)
+
+		// An unlisted torrent is refused even when nothing is listed
+		_, err = store.Announce(tracker.AnnounceRequest{InfoHash: [20]byte{1}, PeerID: [20]byte{1}, Port: 6881})
+		assert.NotNil(t, err, name)
+	}
+
+	var ours [20]byte
+	for i := range ours {
+		ours[i] = 0xab
+	}
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	require.Nil(t, os.WriteFile(path, []byte(strings.Repeat("ab", 20)+"\n"), 0644))
+
+	store, _, err := newTrackerStore(time.Hour, path)
+	require.Nil(t, err)
+	_, err = store.Announce(tracker.AnnounceRequest{InfoHash: ours, PeerID: [20]byte{1}, Port: 6881})
+	assert.Nil(t, err)
+}
+
+// TestEndToEnd creates a torrent, seeds it through a local tracker and
+// downloads it again, all through Run
+func TestEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+
+	store := tracker.NewStore(time.Hour)
+	srv := httptest.NewServer(tracker.NewServer(store, time.Minute).Handler())
+	defer srv.Close()
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	source := filepath.Join(dir, "data.bin")
+	require.Nil(t, os.WriteFile(source, data, 0644))
+
+	torrentPath := filepath.Join(dir, "data.torrent")
+	code, stdout, stderr := run(t, context.Background(), "create", "-announce", srv.URL+"/announce", "-piece-length", "16KiB", "-o", torrentPath, source)
+	require.Equal(t, ExitOK, code, stderr)
+	assert.Contains(t, stdout, "7 pieces")
+
+	code, stdout, _ = run(t, context.Background(), "info", torrentPath)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "data.bin")
+
+	code, stdout, _ = run(t, context.Background(), "magnet", torrentPath)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "magnet:?xt=urn:btih:")
+
+	code, stdout, _ = run(t, context.Background(), "verify", torrentPath, source)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "7 of 7 pieces OK")
+
+	tf, err := torrentfile.Open(torrentPath)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	seeded := make(chan int)
+	go func() {
+		code, _, _ := run(t, ctx, "seed", "-port", freePort(t), torrentPath, source)
+		seeded <- code
+	}()
+
+	require.Eventually(t, func() bool {
+		return store.Scrape([][20]byte{tf.InfoHash})[tf.InfoHash].Complete == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	out := filepath.Join(dir, "out")
+	require.Nil(t, os.Mkdir(out, 0755))
+
+	code, stdout, stderr = run(t, context.Background(), "download", "-port", freePort(t), "-o", out, torrentPath)
+	require.Equal(t, ExitOK, code, stderr)
+	assert.Contains(t, stdout, "Saved")
+
+	cancel()
+	assert.Equal(t, ExitOK, <-seeded)
+
+	downloaded, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	require.Nil(t, err)
+	assert.Equal(t, data, downloaded)
+
+	downloaded[20000] ^= 0xff
+	require.Nil(t, os.WriteFile(filepath.Join(out, "data.bin"), downloaded, 0644))
+
+	code, stdout, _ = run(t, context.Background(), "verify", torrentPath, filepath.Join(out, "data.bin"))
+	assert.Equal(t, ExitMismatch, code)
+	assert.Equal(t, "corrupt     data.bin  (1 bad piece)\nBad pieces: 1\n6 of 7 pieces OK (85.7%)\n", stdout)
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	source := filepath.Join(dir, "data.bin")
+	require.Nil(t, os.WriteFile(source, make([]byte, 1000), 0644))
+
+	torrentPath := filepath.Join(dir, "data.torrent")
+	code, _, _ := run(t, context.Background(), "create", "-announce", "http://127.0.0.1:1/announce", "-o", torrentPath, source)
+	require.Equal(t, ExitOK, code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	code, _, stderr := run(t, ctx, "download", "-o", dir, torrentPath)
+	assert.Equal(t, ExitInterrupted, code)
+	assert.Contains(t, stderr, "interrupted")
+}
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+)
+
+var createCommand = &command{
+	name:    "create",
+	args:    "<file>",
+	summary: "create a torrent file",
+	setup: func(fs *flag.FlagSet) runFunc {
+		announce := fs.String("announce", "", "tracker announce URL")
+		var pieceLength byteSize
+		fs.Var(&pieceLength, "piece-length", "piece length, e.g. 256KiB; chosen from the file size if 0")
+		output := fs.String("o", "", "where to write the torrent (default <file>.torrent in the current directory)")
+
+		return func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 1 {
+				return usagef("expected one file")
+			}
+
+			tf, err := torrentfile.Create(args[0], *announce, int(pieceLength))
+			if err != nil {
+				return err
+			}
+
+			path := *output
+			if path == "" {
+				path = filepath.Base(args[0]) + ".torrent"
+			}
+
+			file, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+
+			err = tf.Write(file)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(e.stdout, "Created %s (%d pieces, infohash %s)\n", path, len(tf.PieceHashes), hex.EncodeToString(tf.InfoHash[:]))
+			return nil
+		}
+	},
+}
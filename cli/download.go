@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+	"github.com/prabal199251/Torrent-Client/ui"
+)
+
+var downloadCommand = &command{
+	name:    "download",
+	args:    "<file.torrent>",
+	summary: "download a torrent",
+	setup: func(fs *flag.FlagSet) runFunc {
+		var peer peerFlags
+		peer.register(fs)
+		output := fs.String("o", ".", "directory to save the download in")
+
+		return func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 1 {
+				return usagef("expected one torrent file")
+			}
+
+			defer peer.logLevel.apply(e.stderr)()
+
+			opts, closeOpts, err := peer.options()
+			if err != nil {
+				return err
+			}
+			defer closeOpts()
+
+			tf, err := torrentfile.Open(args[0])
+			if err != nil {
+				return err
+			}
+
+			path, err := outputPath(*output, tf.Name)
+			if err != nil {
+				return err
+			}
+
+			d, err := tf.StartDownload(ctx, path, opts)
+			if err != nil {
+				return err
+			}
+
+			// Logging replaces the progress display
+			if peer.logLevel != logInfo {
+				newDisplay(e, tf.Name).Run(ctx, d.Handle)
+			}
+
+			err = d.Wait()
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(e.stdout, "Saved %s\n", path)
+			return nil
+		}
+	},
+}
+
+// outputPath places a torrent's file in dir, refusing names that would
+// escape it
+func outputPath(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("torrent has unsafe name %q", name)
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+func newDisplay(e *env, name string) *ui.Display {
+	if f, ok := e.stdout.(*os.File); ok {
+		return ui.New(f, name)
+	}
+	return ui.NewWriter(e.stdout, name, false, 80)
+}
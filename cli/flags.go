@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/ipfilter"
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+)
+
+// parseFlags parses args, allowing flags after positional arguments, and
+// then fills in flags not given on the command line from the -config
+// file, if the command has one. It returns the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		consumed := args[:len(args)-fs.NArg()]
+		args = fs.Args()
+
+		if len(consumed) > 0 && consumed[len(consumed)-1] == "--" {
+			positional = append(positional, args...)
+			break
+		}
+		if len(args) == 0 {
+			break
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	config := fs.Lookup("config")
+	if config == nil || config.Value.String() == "" {
+		return positional, nil
+	}
+
+	err := applyConfig(fs, config.Value.String())
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	return positional, nil
+}
+
+// applyConfig reads "name = value" lines naming flags of fs. Flags set on
+// the command line take precedence.
+func applyConfig(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", path, n)
+		}
+
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+		if set[name] {
+			continue
+		}
+
+		err := fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// byteSize is a number of bytes written like 500KiB, 2MB or 1.5M, with an
+// optional /s for rates. Decimal units are powers of 1000, binary units
+// and bare letters powers of 1024.
+type byteSize int64
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1e9,
+	"gib": 1 << 30,
+}
+
+func (r *byteSize) Set(s string) error {
+	v := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+
+	i := strings.IndexFunc(v, func(c rune) bool { return (c < '0' || c > '9') && c != '.' })
+	if i < 0 {
+		i = len(v)
+	}
+
+	n, err := strconv.ParseFloat(v[:i], 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+
+	unit, ok := sizeUnits[strings.TrimSpace(v[i:])]
+	if !ok {
+		return fmt.Errorf("invalid size %q: unknown unit", s)
+	}
+
+	*r = byteSize(n * unit)
+	return nil
+}
+
+func (r *byteSize) String() string {
+	return strconv.FormatInt(int64(*r), 10)
+}
+
+type logLevel string
+
+const (
+	logError logLevel = "error"
+	logInfo  logLevel = "info"
+)
+
+func (l *logLevel) Set(s string) error {
+	switch logLevel(s) {
+	case logError, logInfo:
+		*l = logLevel(s)
+		return nil
+	}
+	return fmt.Errorf("unknown log level %q, want error or info", s)
+}
+
+func (l *logLevel) String() string {
+	return string(*l)
+}
+
+// apply routes log output for the level and returns a function restoring
+// the previous output
+func (l logLevel) apply(stderr io.Writer) func() {
+	previous := log.Writer()
+
+	if l == logInfo {
+		log.SetOutput(stderr)
+	} else {
+		log.SetOutput(io.Discard)
+	}
+
+	return func() { log.SetOutput(previous) }
+}
+
+// peerFlags are shared by the commands that talk to peers
+type peerFlags struct {
+	port         uint
+	maxPeers     int
+	downloadRate byteSize
+	uploadRate   byteSize
+	ipfilter     string
+	logLevel     logLevel
+	config       string
+}
+
+func (p *peerFlags) register(fs *flag.FlagSet) {
+	p.logLevel = logError
+
+	fs.UintVar(&p.port, "port", uint(torrentfile.Port), "port to accept peer connections on")
+	fs.IntVar(&p.maxPeers, "max-peers", 50, "maximum number of connected peers, 0 for no limit")
+	fs.Var(&p.downloadRate, "download-rate", "download rate limit, e.g. 2MB or 500KiB; 0 for no limit")
+	fs.Var(&p.uploadRate, "upload-rate", "upload rate limit, e.g. 2MB or 500KiB; 0 for no limit")
+	fs.StringVar(&p.ipfilter, "ipfilter", "", "blocklist in eMule, PeerGuardian P2P or CIDR format")
+	fs.Var(&p.logLevel, "log-level", "error, or info to log every peer and piece")
+	fs.StringVar(&p.config, "config", "", "file of name = value lines setting any of these flags")
+}
+
+// options builds the download options, loading the IP filter. close
+// releases it.
+func (p *peerFlags) options() (opts torrentfile.Options, close func(), err error) {
+	close = func() {}
+
+	if p.port == 0 || p.port > 65535 {
+		return opts, close, usagef("invalid port %d", p.port)
+	}
+	if p.maxPeers < 0 {
+		return opts, close, usagef("invalid peer limit %d", p.maxPeers)
+	}
+	opts.Port = uint16(p.port)
+	opts.MaxPeers = p.maxPeers
+	opts.DownloadRate = int64(p.downloadRate)
+	opts.UploadRate = int64(p.uploadRate)
+
+	if p.ipfilter != "" {
+		filter, err := ipfilter.Load(p.ipfilter)
+		if err != nil {
+			return opts, close, err
+		}
+
+		filter.Watch(time.Minute)
+		log.Printf("Loaded IP filter with %d ranges\n", filter.Len())
+
+		opts.Filter = filter
+		close = func() { filter.Close() }
+	}
+
+	return opts, close, nil
+}
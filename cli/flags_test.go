@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFlagSet() (*flag.FlagSet, *peerFlags, *string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var peer peerFlags
+	peer.register(fs)
+	output := fs.String("o", ".", "")
+	return fs, &peer, output
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := map[string]struct {
+		args       []string
+		positional []string
+		port       uint
+		output     string
+	}{
+		"flags first": {
+			args:       []string{"-port", "7000", "-o", "dir", "a.torrent"},
+			positional: []string{"a.torrent"},
+			port:       7000,
+			output:     "dir",
+		},
+		"flags after arguments": {
+			args:       []string{"a.torrent", "-port=7000", "b", "-o", "dir"},
+			positional: []string{"a.torrent", "b"},
+			port:       7000,
+			output:     "dir",
+		},
+		"double dash": {
+			args:       []string{"-o", "dir", "--", "-port", "a.torrent"},
+			positional: []string{"-port", "a.torrent"},
+			port:       6881,
+			output:     "dir",
+		},
+		"defaults": {
+			args:   []string{},
+			port:   6881,
+			output: ".",
+		},
+	}
+
+	for name, test := range tests {
+		fs, peer, output := testFlagSet()
+
+		positional, err := parseFlags(fs, test.args)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.positional, positional, name)
+		assert.Equal(t, test.port, peer.port, name)
+		assert.Equal(t, test.output, *output, name)
+	}
+}
+
+func TestParseFlagsConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "client.conf")
+	require.Nil(t, os.WriteFile(config, []byte("# defaults\nport = 7000\nmax-peers=10\n\nlog-level = info\n"), 0644))
+
+	fs, peer, _ := testFlagSet()
+	positional, err := parseFlags(fs, []string{"a.torrent", "-config", config, "-port", "8000"})
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{"a.torrent"}, positional)
+	assert.Equal(t, uint(8000), peer.port)
+	assert.Equal(t, 10, peer.maxPeers)
+	assert.Equal(t, logInfo, peer.logLevel)
+
+	require.Nil(t, os.WriteFile(config, []byte("speed = 11\n"), 0644))
+	fs, _, _ = testFlagSet()
+	_, err = parseFlags(fs, []string{"-config", config})
+	assert.NotNil(t, err)
+
+	fs, _, _ = testFlagSet()
+	_, err = parseFlags(fs, []string{"-config", filepath.Join(t.TempDir(), "missing.conf")})
+	assert.NotNil(t, err)
+}
+
+func TestByteSize(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output byteSize
+		fails  bool
+	}{
+		"bytes":        {input: "512", output: 512},
+		"binary":       {input: "500KiB", output: 500 << 10},
+		"decimal":      {input: "2MB", output: 2000000},
+		"bare letter":  {input: "1.5M", output: 3 << 19},
+		"rate":         {input: "1g/s", output: 1 << 30},
+		"zero":         {input: "0", output: 0},
+		"unknown unit": {input: "5XB", fails: true},
+		"negative":     {input: "-1K", fails: true},
+		"not a number": {input: "fast", fails: true},
+		"empty":        {input: "", fails: true},
+	}
+
+	for name, test := range tests {
+		var size byteSize
+		err := size.Set(test.input)
+
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, size, name)
+	}
+}
+
+func TestPeerFlagsOptions(t *testing.T) {
+	fs, peer, _ := testFlagSet()
+
+	_, err := parseFlags(fs, []string{"-port", "7000", "-download-rate", "2MB", "-upload-rate", "500KiB/s"})
+	require.Nil(t, err)
+
+	opts, close, err := peer.options()
+	require.Nil(t, err)
+	defer close()
+
+	assert.Equal(t, uint16(7000), opts.Port)
+	assert.Equal(t, int64(2000000), opts.DownloadRate)
+	assert.Equal(t, int64(500<<10), opts.UploadRate)
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+	"github.com/prabal199251/Torrent-Client/ui"
+)
+
+var infoCommand = &command{
+	name:    "info",
+	args:    "<file.torrent>",
+	summary: "show everything in a torrent file",
+	setup: func(fs *flag.FlagSet) runFunc {
+		asJSON := fs.Bool("json", false, "print the metadata as JSON")
+
+		return func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 1 {
+				return usagef("expected one torrent file")
+			}
+
+			m, err := torrentfile.ReadMetainfo(args[0])
+			if err != nil {
+				return err
+			}
+
+			if *asJSON {
+				enc := json.NewEncoder(e.stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(m)
+			}
+
+			printMetainfo(e.stdout, m)
+			return nil
+		}
+	},
+}
+
+func printMetainfo(w io.Writer, m *torrentfile.Metainfo) {
+	field := func(name, format string, args ...interface{}) {
+		if name != "" {
+			name += ":"
+		}
+		fmt.Fprintf(w, "%-14s"+format+"\n", append([]interface{}{name}, args...)...)
+	}
+
+	field("Name", "%s", m.Name)
+
+	if m.InfoHash != nil {
+		field("Infohash", "%s", m.InfoHash.Hex())
+		field("", "%s", m.InfoHash.Base32())
+	}
+	if m.InfoHashV2 != nil {
+		field("Infohash v2", "%s", m.InfoHashV2.Hex())
+		field("", "%s", m.InfoHashV2.Base32())
+	}
+
+	field("Size", "%s (%d bytes)", ui.FormatBytes(m.Length), m.Length)
+	field("Pieces", "%d x %s", m.Pieces, ui.FormatBytes(int64(m.PieceLength)))
+	field("Private", "%s", yesNo(m.Private))
+
+	if m.CreationDate != nil {
+		field("Created", "%s", m.CreationDate.Format("2006-01-02 15:04:05 MST"))
+	}
+	if m.CreatedBy != "" {
+		field("Created by", "%s", m.CreatedBy)
+	}
+	if m.Comment != "" {
+		field("Comment", "%s", m.Comment)
+	}
+	if m.Source != "" {
+		field("Source", "%s", m.Source)
+	}
+
+	if len(m.Trackers) > 0 {
+		fmt.Fprintln(w, "\nTrackers:")
+		for i, tier := range m.Trackers {
+			for _, url := range tier {
+				fmt.Fprintf(w, "  tier %d  %s\n", i+1, url)
+			}
+		}
+	}
+
+	if len(m.WebSeeds) > 0 {
+		fmt.Fprintln(w, "\nWeb seeds:")
+		for _, url := range m.WebSeeds {
+			fmt.Fprintf(w, "  %s\n", url)
+		}
+	}
+
+	if len(m.Nodes) > 0 {
+		fmt.Fprintln(w, "\nDHT nodes:")
+		for _, node := range m.Nodes {
+			fmt.Fprintf(w, "  %s\n", node)
+		}
+	}
+
+	fmt.Fprintf(w, "\nFiles:\n")
+	printFileTree(w, m.Files)
+}
+
+// printFileTree indents each file under the directories it is in, printing
+// a directory whenever the path leaves the previous file's directories
+func printFileTree(w io.Writer, files []torrentfile.File) {
+	var dirs []string
+
+	for _, f := range files {
+		if len(f.Path) == 0 {
+			continue
+		}
+
+		parents := f.Path[:len(f.Path)-1]
+
+		common := 0
+		for common < len(dirs) && common < len(parents) && dirs[common] == parents[common] {
+			common++
+		}
+
+		for i := common; i < len(parents); i++ {
+			fmt.Fprintf(w, "  %s%s/\n", strings.Repeat("  ", i), parents[i])
+		}
+		dirs = parents
+
+		indent := strings.Repeat("  ", len(parents))
+		fmt.Fprintf(w, "  %s%s  %s\n", indent, f.Path[len(f.Path)-1], ui.FormatBytes(f.Length))
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+)
+
+var magnetCommand = &command{
+	name:    "magnet",
+	args:    "<file.torrent>",
+	summary: "print a magnet link for a torrent",
+	setup: func(fs *flag.FlagSet) runFunc {
+		return func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 1 {
+				return usagef("expected one torrent file")
+			}
+
+			tf, err := torrentfile.Open(args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(e.stdout, tf.Magnet())
+			return nil
+		}
+	},
+}
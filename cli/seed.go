@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+)
+
+var seedCommand = &command{
+	name:    "seed",
+	args:    "<file.torrent> <path>",
+	summary: "upload a complete download to other peers until interrupted",
+	setup: func(fs *flag.FlagSet) runFunc {
+		var peer peerFlags
+		peer.register(fs)
+
+		return func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 2 {
+				return usagef("expected a torrent file and the data to seed")
+			}
+
+			defer peer.logLevel.apply(e.stderr)()
+
+			opts, closeOpts, err := peer.options()
+			if err != nil {
+				return err
+			}
+			defer closeOpts()
+
+			tf, err := torrentfile.Open(args[0])
+			if err != nil {
+				return err
+			}
+
+			// Seeding only ever ends by being interrupted
+			err = tf.Seed(ctx, args[1], opts)
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		}
+	},
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/tracker"
+)
+
+var trackerCommand = &command{
+	name:    "tracker",
+	summary: "run a BitTorrent tracker until interrupted",
+	setup: func(fs *flag.FlagSet) runFunc {
+		addr := fs.String("addr", ":6969", "address to listen on")
+		interval := fs.Duration("interval", 30*time.Minute, "announce interval sent to peers")
+		udp := fs.Bool("udp", true, "also serve the UDP tracker protocol on the same port")
+		allow := fs.String("allow", "", "file with one hex infohash per line; if set, only these torrents are tracked")
+
+		return func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 0 {
+				return usagef("unexpected arguments")
+			}
+
+			store, allowed, err := newTrackerStore(2**interval, *allow)
+			if err != nil {
+				return err
+			}
+			if *allow != "" && allowed == 0 {
+				fmt.Fprintf(e.stderr, "Warning: %s lists no infohashes, so no torrent will be tracked\n", *allow)
+			}
+
+			errs := make(chan error, 2)
+
+			if *udp {
+				go func() {
+					errs <- tracker.NewUDPServer(store, *interval).ListenAndServe(*addr)
+				}()
+			}
+
+			go func() {
+				errs <- tracker.NewServer(store, *interval).ListenAndServe(*addr)
+			}()
+
+			fmt.Fprintf(e.stderr, "Tracker listening on %s\n", *addr)
+
+			// Like seeding, running a tracker only ends by being interrupted
+			select {
+			case err := <-errs:
+				return err
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	},
+}
+
+// newTrackerStore makes the tracker's store. If allowPath is set only the
+// infohashes it lists are tracked, even if there are none; allowed is how
+// many there are.
+func newTrackerStore(peerTTL time.Duration, allowPath string) (store *tracker.Store, allowed int, err error) {
+	store = tracker.NewStore(peerTTL)
+	if allowPath == "" {
+		return store, 0, nil
+	}
+
+	hashes, err := readInfoHashes(allowPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	store.Allow(hashes...)
+	return store, len(hashes), nil
+}
+
+func readInfoHashes(path string) ([][20]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var hashes [][20]byte
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var h [20]byte
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != len(h) {
+			return nil, fmt.Errorf("invalid infohash %q", line)
+		}
+		copy(h[:], b)
+		hashes = append(hashes, h)
+	}
+
+	return hashes, scanner.Err()
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+)
+
+var verifyCommand = &command{
+	name:    "verify",
+	args:    "<file.torrent> <path>",
+	summary: "check downloaded data against a torrent",
+	setup: func(fs *flag.FlagSet) runFunc {
+		all := fs.Bool("files", false, "list every file, not just those with problems")
+
+		return func(ctx context.Context, e *env, args []string) error {
+			if len(args) != 2 {
+				return usagef("expected a torrent file and the data to check")
+			}
+
+			tf, err := torrentfile.Open(args[0])
+			if err != nil {
+				return err
+			}
+
+			result, err := tf.Verify(args[1])
+			if err != nil {
+				return err
+			}
+
+			printVerifyResult(e.stdout, result, *all)
+
+			if !result.OK() {
+				return &exitError{code: ExitMismatch, err: fmt.Errorf("%s does not match %s", args[1], args[0])}
+			}
+			return nil
+		}
+	},
+}
+
+func printVerifyResult(w io.Writer, r *torrentfile.VerifyResult, all bool) {
+	for _, f := range r.Files {
+		if f.OK() && !all {
+			continue
+		}
+
+		line := fmt.Sprintf("%-10s  %s", f.Status(), path.Join(f.Path...))
+		switch {
+		case f.BadPieces == 1:
+			line += "  (1 bad piece)"
+		case f.BadPieces > 1:
+			line += fmt.Sprintf("  (%d bad pieces)", f.BadPieces)
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	if len(r.Bad) > 0 {
+		fmt.Fprintf(w, "Bad pieces: %s\n", formatRanges(r.Bad))
+	}
+
+	fmt.Fprintf(w, "%d of %d pieces OK (%.1f%%)\n", r.Pieces-len(r.Bad), r.Pieces, r.Percent())
+}
+
+// formatRanges writes sorted indexes compactly, as in 1, 3-7, 9
+func formatRanges(indexes []int) string {
+	var parts []string
+
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+
+		if i == j {
+			parts = append(parts, fmt.Sprint(indexes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indexes[i], indexes[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -12,10 +14,27 @@ import (
 	"github.com/prabal199251/Torrent-Client/peers"
 )
 
+// ErrInfoHashMismatch is returned when a peer answers the handshake for a
+// different torrent
+var ErrInfoHashMismatch = errors.New("peer is serving a different torrent")
+
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
+	// Fast is set when both sides support the Fast extension (BEP 6)
+	Fast bool
+	// AllowedFast holds the pieces the peer lets us request while choked
+	AllowedFast bitfield.Bitfield
+	// Extensions is set when the peer supports the extension protocol (BEP 10)
+	Extensions bool
+	// Reqq is the request queue depth the peer advertised, or 0 if unknown
+	Reqq int
+	// ClientName is the peer's self-reported client and version
+	ClientName string
+	// Limits bounds the size of messages accepted from the peer
+	Limits   *message.Limits
+	reader   *message.Reader
 	peer     peers.Peer
 	infoHash [20]byte
 	peerID   [20]byte
@@ -37,17 +56,17 @@ func completeHandshake(conn net.Conn, infoHash, peerId [20]byte) (*handshake.Han
 	}
 
 	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
-		return nil, fmt.Errorf("expected infohash %d, got %d", res.InfoHash, infoHash)
+		return nil, fmt.Errorf("%w: expected infohash %x, got %x", ErrInfoHashMismatch, infoHash, res.InfoHash)
 	}
 
 	return res, nil
 }
 
-func recvBitfiled(conn net.Conn) (bitfield.Bitfield, error) {
+func recvBitfiled(conn net.Conn, numPieces int, fast bool) (bitfield.Bitfield, error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
-	msg, err := message.Read(conn)
+	msg, err := message.ReadLimited(conn, message.NewLimits(numPieces))
 	if err != nil {
 		return nil, err
 	}
@@ -57,45 +76,124 @@ func recvBitfiled(conn net.Conn) (bitfield.Bitfield, error) {
 		return nil, err
 	}
 
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("expected bitfield but got ID %d", msg.ID)
-		return nil, err
+	switch {
+	case msg.ID == message.MsgBitfield:
+		return msg.PayLoad, nil
+
+	case msg.ID == message.MsgHaveAll && fast:
+		bf := make(bitfield.Bitfield, (numPieces+7)/8)
+		for i := 0; i < numPieces; i++ {
+			bf.SetPiece(i)
+		}
+		return bf, nil
+
+	case msg.ID == message.MsgHaveNone && fast:
+		return make(bitfield.Bitfield, (numPieces+7)/8), nil
 	}
 
-	return msg.PayLoad, nil
+	err = fmt.Errorf("expected bitfield but got ID %d", msg.ID)
+	return nil, err
 }
 
-func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// New connects to peer and completes the handshake. Cancelling ctx aborts
+// the dial and handshake; it has no effect once New has returned.
+func New(ctx context.Context, peer peers.Peer, peerID, infoHash [20]byte, numPieces int) (*Client, error) {
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String())
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
-	if err != nil {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	fail := func(err error) (*Client, error) {
 		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 
-	bf, err := recvBitfiled(conn)
+	res, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return fail(err)
+	}
+
+	fast := res.SupportsFast()
+
+	bf, err := recvBitfiled(conn, numPieces, fast)
+	if err != nil {
+		return fail(err)
+	}
+
+	c := &Client{
+		Conn:        conn,
+		Choked:      true,
+		Bitfield:    bf,
+		Fast:        fast,
+		AllowedFast: make(bitfield.Bitfield, (numPieces+7)/8),
+		Limits:      message.NewLimits(numPieces),
+		Extensions:  res.SupportsExtensions(),
+		peer:        peer,
+		infoHash:    infoHash,
+		peerID:      peerID,
 	}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+	if c.Extensions {
+		err = c.SendExtendedHandshake()
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if !stop() {
+		return fail(ctx.Err())
+	}
+
+	return c, nil
 }
 
+// Read returns the next message from the peer. The message is only valid
+// until the next call; a Piece message's block must be read with
+// ReadPieceInto.
 func (c *Client) Read() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
-	return msg, err
+	if c.reader == nil {
+		limits := c.Limits
+		if limits == nil {
+			limits = message.DefaultLimits
+		}
+		c.reader = message.NewReader(c.Conn, limits)
+	}
+
+	return c.reader.Read()
+}
+
+// ReadPieceInto reads the block of the Piece message last returned by Read
+// directly into buf.
+func (c *Client) ReadPieceInto(index int, buf []byte) (int, error) {
+	return c.reader.ReadPieceInto(index, buf)
+}
+
+// BlockLength is the length of the block of the Piece message last returned
+// by Read
+func (c *Client) BlockLength() int {
+	return c.reader.BlockLength()
+}
+
+// Resumable reports whether reading can continue after the last read error,
+// e.g. an expired read deadline that struck between messages
+func (c *Client) Resumable() bool {
+	return c.reader == nil || c.reader.Resumable()
+}
+
+func (c *Client) Close() error {
+	err := c.Conn.Close()
+	if c.reader != nil {
+		c.reader.Release()
+		c.reader = nil
+	}
+	return err
 }
 
 func (c *Client) SendRequest(index, begin, length int) error {
@@ -104,6 +202,12 @@ func (c *Client) SendRequest(index, begin, length int) error {
 	return err
 }
 
+func (c *Client) SendCancel(index, begin, length int) error {
+	msg := message.FormatCancel(index, begin, length)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
 	_, err := c.Conn.Write(msg.Serialize())
@@ -122,6 +226,28 @@ func (c *Client) SendUnchoke() error {
 	return err
 }
 
+// MaxRequestQueue is the request queue depth we advertise to peers
+const MaxRequestQueue = 250
+
+func (c *Client) SendExtendedHandshake() error {
+	msg := message.FormatExtendedHandshake(&message.ExtendedHandshake{Reqq: MaxRequestQueue})
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// HandleExtendedHandshake records what the peer told us in its extension
+// handshake
+func (c *Client) HandleExtendedHandshake(msg *message.Message) error {
+	h, err := message.ParseExtendedHandshake(msg)
+	if err != nil {
+		return err
+	}
+
+	c.Reqq = h.Reqq
+	c.ClientName = h.V
+	return nil
+}
+
 func (c *Client) SendHave(index int) error {
 	msg := message.FormatHave(index)
 	_, err := c.Conn.Write(msg.Serialize())
@@ -1,12 +1,15 @@
 package client
 
 import (
+	"context"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/prabal199251/Torrent-Client/bitfield"
 	"github.com/prabal199251/Torrent-Client/handshake"
 	"github.com/prabal199251/Torrent-Client/message"
+	"github.com/prabal199251/Torrent-Client/peers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -46,9 +49,36 @@ func TestClientServerConnection(t *testing.T) {
 	require.Equal(t, testMessage, buf)
 }
 
+func TestNewCancelled(t *testing.T) {
+	// A peer that accepts but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	addr := ln.Addr().(*net.TCPAddr)
+	start := time.Now()
+	c, err := New(ctx, peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, [20]byte{}, [20]byte{}, 1)
+
+	assert.Nil(t, c)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
 func TestRecvBitfield(t *testing.T) {
 	tests := map[string]struct {
 		msg    []byte
+		fast   bool
 		output bitfield.Bitfield
 		fails  bool
 	}{
@@ -58,6 +88,12 @@ func TestRecvBitfield(t *testing.T) {
 			fails:  false,
 		},
 
+		"bitfield longer than piece count": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x07, 5, 1, 2, 3, 4, 5, 6},
+			output: nil,
+			fails:  true,
+		},
+
 		"message is not a bitfield": {
 			msg:    []byte{0x00, 0x00, 0x00, 0x06, 99, 1, 2, 3, 4, 5},
 			output: nil,
@@ -68,13 +104,31 @@ func TestRecvBitfield(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"have all": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 14},
+			fast:   true,
+			output: bitfield.Bitfield{0xff, 0xff, 0xff, 0xff, 0xf0},
+			fails:  false,
+		},
+		"have none": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 15},
+			fast:   true,
+			output: bitfield.Bitfield{0x00, 0x00, 0x00, 0x00, 0x00},
+			fails:  false,
+		},
+		"have all without fast extension": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 14},
+			fast:   false,
+			output: nil,
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
 		clientConn, serverConn := createClientAndServer(t)
 		serverConn.Write(test.msg)
 
-		bf, err := recvBitfiled(clientConn)
+		bf, err := recvBitfiled(clientConn, 36, test.fast)
 
 		if test.fails {
 			assert.NotNil(t, err)
@@ -92,6 +146,7 @@ func TestCompleteHandshake(t *testing.T) {
 		serverHandshake []byte
 		output          *handshake.Handshake
 		fails           bool
+		err             error
 	}{
 		"successful handshake": {
 			clientInfohash:  [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
@@ -111,6 +166,7 @@ func TestCompleteHandshake(t *testing.T) {
 			serverHandshake: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0, 0, 0, 0xde, 0xe8, 0x6a, 0x7f, 0xa6, 0xf2, 0x86, 0xa9, 0xd7, 0x4c, 0x36, 0x20, 0x14, 0x61, 0x6a, 0x0f, 0xf5, 0xe4, 0x84, 0x3d, 45, 83, 89, 48, 48, 49, 48, 45, 192, 125, 147, 203, 136, 32, 59, 180, 253, 168, 193, 19},
 			output:          nil,
 			fails:           true,
+			err:             ErrInfoHashMismatch,
 		},
 	}
 
@@ -122,6 +178,9 @@ func TestCompleteHandshake(t *testing.T) {
 
 		if test.fails {
 			assert.NotNil(t, err)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+			}
 		} else {
 			assert.Nil(t, err)
 			assert.Equal(t, h, test.output)
@@ -5,18 +5,39 @@ import (
 	"io"
 )
 
+// Fast extension support is signalled by bit 0x04 of the last reserved byte (BEP 6)
+const fastExtensionByte = 7
+const fastExtensionBit = 0x04
+
+// Extension protocol support is signalled by bit 0x10 of reserved byte 5 (BEP 10)
+const extensionProtocolByte = 5
+const extensionProtocolBit = 0x10
+
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
 func New(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[fastExtensionByte] |= fastExtensionBit
+	h.Reserved[extensionProtocolByte] |= extensionProtocolBit
+
+	return &h
+}
+
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[extensionProtocolByte]&extensionProtocolBit != 0
+}
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[fastExtensionByte]&fastExtensionBit != 0
 }
 
 func (h *Handshake) Serialize() []byte {
@@ -26,7 +47,7 @@ func (h *Handshake) Serialize() []byte {
 
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 
@@ -54,13 +75,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
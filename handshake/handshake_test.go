@@ -14,11 +14,14 @@ func TestNew(t *testing.T) {
 
 	expected := &Handshake{
 		Pstr:     "BitTorrent protocol",
+		Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04},
 		InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
 		PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 	}
 
 	assert.Equal(t, expected, h)
+	assert.True(t, h.SupportsFast())
+	assert.True(t, h.SupportsExtensions())
 }
 
 func TestSerialize(t *testing.T) {
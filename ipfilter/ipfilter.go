@@ -0,0 +1,355 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eMule ranges with an access level above this are allowed rather than
+// blocked
+const emuleMaxBlockedLevel = 127
+
+// Range is an inclusive range of addresses. IPv4 addresses are stored in
+// their IPv4-mapped IPv6 form so both families share one ordering.
+type Range struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+func (r Range) Contains(addr netip.Addr) bool {
+	return r.Start.Compare(addr) <= 0 && addr.Compare(r.End) <= 0
+}
+
+// Filter blocks addresses that fall in any of its ranges. A nil Filter
+// blocks nothing.
+type Filter struct {
+	mu     sync.RWMutex
+	ranges []Range
+
+	path    string
+	modTime time.Time
+	size    int64
+	done    chan struct{}
+}
+
+// New builds a filter from ranges, which may overlap. IPv4 bounds may be
+// given in either form.
+func New(ranges []Range) *Filter {
+	mapped := make([]Range, len(ranges))
+	for i, r := range ranges {
+		mapped[i] = Range{netip.AddrFrom16(r.Start.As16()), netip.AddrFrom16(r.End.As16())}
+	}
+
+	return &Filter{ranges: merge(mapped)}
+}
+
+// Load reads a blocklist in eMule ipfilter.dat, PeerGuardian P2P or CIDR
+// format. The formats may be mixed within one file.
+func Load(path string) (*Filter, error) {
+	f := &Filter{path: path}
+
+	_, err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Blocked reports whether ip falls in a blocked range
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = netip.AddrFrom16(addr.As16())
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return f.ranges[i].End.Compare(addr) >= 0
+	})
+
+	return i < len(f.ranges) && f.ranges[i].Contains(addr)
+}
+
+// Len is the number of distinct ranges after merging
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return len(f.ranges)
+}
+
+// Reload re-reads the filter's file if it changed since it was last read,
+// reporting whether it did. On error the previous ranges stay in effect.
+func (f *Filter) Reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.RLock()
+	unchanged := info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	ranges, err := Parse(file)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ranges = merge(ranges)
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+
+	return true, nil
+}
+
+// Watch checks the filter's file for changes every interval and reloads it,
+// until Close is called
+func (f *Filter) Watch(interval time.Duration) {
+	f.mu.Lock()
+	if f.done != nil {
+		f.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	f.done = done
+	f.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			changed, err := f.Reload()
+			if err != nil {
+				log.Printf("Could not reload IP filter: %v\n", err)
+			} else if changed {
+				log.Printf("Reloaded IP filter with %d ranges\n", f.Len())
+			}
+		}
+	}()
+}
+
+// Close stops watching the filter's file
+func (f *Filter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.done != nil {
+		close(f.done)
+		f.done = nil
+	}
+	return nil
+}
+
+// Parse reads blocklist lines in any of the supported formats:
+//
+//	001.002.003.004 - 001.002.003.255 , 000 , Description   (eMule)
+//	Description:1.2.3.4-1.2.3.255                           (PeerGuardian P2P)
+//	1.2.3.0/24                                              (CIDR)
+//
+// Blank lines and lines starting with # or // are skipped.
+func Parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		rng, blocked, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		if blocked {
+			ranges = append(ranges, rng)
+		}
+	}
+
+	return ranges, scanner.Err()
+}
+
+func parseLine(line string) (Range, bool, error) {
+	if prefix, err := netip.ParsePrefix(line); err == nil {
+		return prefixRange(prefix), true, nil
+	}
+
+	// P2P descriptions may contain commas too, so fall through on failure
+	if strings.Contains(line, ",") {
+		if rng, blocked, err := parseEmule(line); err == nil {
+			return rng, blocked, nil
+		}
+	}
+
+	if rng, err := parseRange(line); err == nil {
+		return rng, true, nil
+	}
+
+	// The description may itself contain colons, and IPv6 ranges always
+	// do, so try each one as the separator
+	for i := 0; i < len(line); i++ {
+		if line[i] != ':' {
+			continue
+		}
+		if rng, err := parseRange(line[i+1:]); err == nil {
+			return rng, true, nil
+		}
+	}
+
+	return Range{}, false, fmt.Errorf("unrecognised entry %q", line)
+}
+
+func parseEmule(line string) (Range, bool, error) {
+	fields := strings.SplitN(line, ",", 3)
+
+	rng, err := parseRange(fields[0])
+	if err != nil {
+		return Range{}, false, err
+	}
+
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return Range{}, false, fmt.Errorf("invalid access level %q", fields[1])
+	}
+
+	return rng, level <= emuleMaxBlockedLevel, nil
+}
+
+func parseRange(s string) (Range, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		addr, err := parseAddr(s)
+		return Range{addr, addr}, err
+	}
+
+	from, err := parseAddr(start)
+	if err != nil {
+		return Range{}, err
+	}
+
+	to, err := parseAddr(end)
+	if err != nil {
+		return Range{}, err
+	}
+
+	if to.Compare(from) < 0 {
+		return Range{}, fmt.Errorf("range %s-%s is reversed", start, end)
+	}
+
+	return Range{from, to}, nil
+}
+
+// parseAddr accepts the zero-padded IPv4 octets used by ipfilter.dat
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.Contains(s, ":") {
+		octets := strings.Split(s, ".")
+		if len(octets) != 4 {
+			return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+		}
+
+		var b [4]byte
+		for i, o := range octets {
+			v, err := strconv.ParseUint(o, 10, 8)
+			if err != nil {
+				return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+			}
+			b[i] = byte(v)
+		}
+
+		return netip.AddrFrom16(netip.AddrFrom4(b).As16()), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return netip.AddrFrom16(addr.As16()), nil
+}
+
+func prefixRange(prefix netip.Prefix) Range {
+	prefix = prefix.Masked()
+
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+
+	start := prefix.Addr().As16()
+	end := start
+	for i := bits; i < 128; i++ {
+		end[i/8] |= 1 << (7 - i%8)
+	}
+
+	return Range{netip.AddrFrom16(start), netip.AddrFrom16(end)}
+}
+
+// merge sorts ranges and joins overlapping or adjacent ones so a lookup
+// is a single binary search
+func merge(ranges []Range) []Range {
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start.Compare(sorted[j].Start) < 0
+	})
+
+	var merged []Range
+	for _, r := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.End.Next()
+			if r.Start.Compare(last.End) <= 0 || (next.IsValid() && r.Start == next) {
+				if r.End.Compare(last.End) > 0 {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
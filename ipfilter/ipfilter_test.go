@@ -0,0 +1,177 @@
+package ipfilter
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addr(s string) netip.Addr {
+	a, err := parseAddr(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output []Range
+		fails  bool
+	}{
+		"emule": {
+			input:  "001.002.003.000 - 001.002.003.255 , 000 , Some ISP\n",
+			output: []Range{{addr("1.2.3.0"), addr("1.2.3.255")}},
+		},
+		"emule allowed level": {
+			input:  "001.002.003.000 - 001.002.003.255 , 200 , Trusted\n",
+			output: nil,
+		},
+		"p2p": {
+			input:  "Some ISP:1.2.3.0-1.2.3.255\n",
+			output: []Range{{addr("1.2.3.0"), addr("1.2.3.255")}},
+		},
+		"p2p with colons and commas in description": {
+			input:  "Foo, Inc: lab 2:1.2.3.0-1.2.3.255\n",
+			output: []Range{{addr("1.2.3.0"), addr("1.2.3.255")}},
+		},
+		"p2p ipv6": {
+			input:  "Lab:2001:db8::-2001:db8::ffff\n",
+			output: []Range{{addr("2001:db8::"), addr("2001:db8::ffff")}},
+		},
+		"cidr": {
+			input: "10.0.0.0/8\n2001:db8::/32\n",
+			output: []Range{
+				{addr("10.0.0.0"), addr("10.255.255.255")},
+				{addr("2001:db8::"), addr("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff")},
+			},
+		},
+		"single address and comments": {
+			input:  "# comment\n// another\n\n192.168.1.1\n",
+			output: []Range{{addr("192.168.1.1"), addr("192.168.1.1")}},
+		},
+		"reversed range": {
+			input: "Bad:1.2.3.255-1.2.3.0\n",
+			fails: true,
+		},
+		"garbage": {
+			input: "not a filter\n",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		ranges, err := Parse(strings.NewReader(test.input))
+
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, ranges, name)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	ranges, err := Parse(strings.NewReader(strings.Join([]string{
+		"010.000.000.000 - 010.000.000.255 , 000 , A",
+		"B:10.0.1.0-10.0.1.255",
+		"10.0.0.128/25",
+		"2001:db8::/64",
+	}, "\n")))
+	require.Nil(t, err)
+
+	f := New(ranges)
+
+	// Overlapping and adjacent ranges are merged
+	assert.Equal(t, 2, f.Len())
+
+	tests := map[string]bool{
+		"10.0.0.0":             true,
+		"10.0.1.255":           true,
+		"10.0.2.0":             false,
+		"9.255.255.255":        false,
+		"2001:db8::1":          true,
+		"2001:db8:0:1::":       false,
+		"::ffff:10.0.0.7":      true,
+		"fe80::1":              false,
+		"255.255.255.255":      false,
+		"0.0.0.0":              false,
+		"2001:db8::ffff:ffff":  true,
+		"2001:db7:ffff::ffff":  false,
+		"2001:db8:0:0:ffff::0": true,
+	}
+
+	for ip, blocked := range tests {
+		assert.Equal(t, blocked, f.Blocked(net.ParseIP(ip)), ip)
+	}
+
+	assert.True(t, f.Blocked(net.IP{10, 0, 0, 7}))
+
+	var nilFilter *Filter
+	assert.False(t, nilFilter.Blocked(net.IP{10, 0, 0, 7}))
+}
+
+func TestNewMapsIPv4(t *testing.T) {
+	f := New([]Range{
+		{Start: netip.MustParseAddr("1.2.3.4"), End: netip.MustParseAddr("1.2.3.10")},
+		{Start: netip.MustParseAddr("::ffff:5.6.7.8"), End: netip.MustParseAddr("5.6.7.8")},
+	})
+
+	assert.True(t, f.Blocked(net.ParseIP("1.2.3.4")))
+	assert.True(t, f.Blocked(net.IP{1, 2, 3, 10}))
+	assert.False(t, f.Blocked(net.ParseIP("1.2.3.11")))
+	assert.True(t, f.Blocked(net.ParseIP("5.6.7.8")))
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipfilter.dat")
+	require.Nil(t, os.WriteFile(path, []byte("10.0.0.0/8\n"), 0644))
+
+	f, err := Load(path)
+	require.Nil(t, err)
+	assert.True(t, f.Blocked(net.IP{10, 1, 2, 3}))
+
+	changed, err := f.Reload()
+	require.Nil(t, err)
+	assert.False(t, changed)
+
+	// A broken file keeps the old ranges
+	require.Nil(t, os.WriteFile(path, []byte("nonsense\n"), 0644))
+	_, err = f.Reload()
+	assert.NotNil(t, err)
+	assert.True(t, f.Blocked(net.IP{10, 1, 2, 3}))
+
+	require.Nil(t, os.WriteFile(path, []byte("192.168.0.0/16\n"), 0644))
+	changed, err = f.Reload()
+	require.Nil(t, err)
+	assert.True(t, changed)
+	assert.False(t, f.Blocked(net.IP{10, 1, 2, 3}))
+	assert.True(t, f.Blocked(net.IP{192, 168, 1, 1}))
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipfilter.p2p")
+	require.Nil(t, os.WriteFile(path, []byte("A:10.0.0.1-10.0.0.1\n"), 0644))
+
+	f, err := Load(path)
+	require.Nil(t, err)
+
+	f.Watch(10 * time.Millisecond)
+	defer f.Close()
+
+	require.Nil(t, os.WriteFile(path, []byte("A:10.0.0.1-10.0.0.1\nB:10.0.0.2-10.0.0.2\n"), 0644))
+
+	assert.Eventually(t, func() bool {
+		return f.Blocked(net.IP{10, 0, 0, 2})
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,217 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/peers"
+)
+
+const Port = 6771
+
+// AnnounceInterval is how often a torrent should be re-announced (BEP 14)
+const AnnounceInterval = 5 * time.Minute
+
+var (
+	IPv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: Port}
+	IPv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: Port}
+)
+
+type Announce struct {
+	Port       uint16
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+func (a *Announce) Serialize(group *net.UDPAddr) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", group.String())
+	fmt.Fprintf(&buf, "Port: %d\r\n", a.Port)
+	for _, h := range a.InfoHashes {
+		fmt.Fprintf(&buf, "Infohash: %s\r\n", hex.EncodeToString(h[:]))
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&buf, "cookie: %s\r\n", a.Cookie)
+	}
+	fmt.Fprintf(&buf, "\r\n\r\n")
+
+	return buf.Bytes()
+}
+
+func Parse(packet []byte) (*Announce, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method != "BT-SEARCH" {
+		return nil, fmt.Errorf("unexpected method %q", req.Method)
+	}
+
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port %q", req.Header.Get("Port"))
+	}
+
+	a := Announce{
+		Port:   uint16(port),
+		Cookie: req.Header.Get("Cookie"),
+	}
+
+	for _, v := range req.Header.Values("Infohash") {
+		b, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("invalid infohash %q", v)
+		}
+
+		var h [20]byte
+		copy(h[:], b)
+		a.InfoHashes = append(a.InfoHashes, h)
+	}
+
+	if len(a.InfoHashes) == 0 {
+		return nil, fmt.Errorf("announce has no infohash")
+	}
+
+	return &a, nil
+}
+
+type Service struct {
+	conn   net.PacketConn
+	group  *net.UDPAddr
+	port   uint16
+	cookie string
+
+	mu       sync.Mutex
+	watchers map[[20]byte]chan peers.Peer
+}
+
+// New runs local service discovery over conn, announcing to group. port is
+// the port we accept peer connections on.
+func New(conn net.PacketConn, group *net.UDPAddr, port uint16) *Service {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	return &Service{
+		conn:     conn,
+		group:    group,
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		watchers: make(map[[20]byte]chan peers.Peer),
+	}
+}
+
+// Listen joins the IPv4 multicast group on all interfaces.
+func Listen(port uint16) (*Service, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, IPv4Group)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(conn, IPv4Group, port), nil
+}
+
+// Listen6 joins the IPv6 multicast group on all interfaces.
+func Listen6(port uint16) (*Service, error) {
+	conn, err := net.ListenMulticastUDP("udp6", nil, IPv6Group)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(conn, IPv6Group, port), nil
+}
+
+func (s *Service) Announce(infoHashes ...[20]byte) error {
+	a := Announce{Port: s.port, InfoHashes: infoHashes, Cookie: s.cookie}
+	_, err := s.conn.WriteTo(a.Serialize(s.group), s.group)
+	return err
+}
+
+// Watch returns a channel of peers announcing infoHash. The channel is
+// closed by Unwatch or Close.
+func (s *Service) Watch(infoHash [20]byte) <-chan peers.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.watchers[infoHash]
+	if !ok {
+		ch = make(chan peers.Peer, 16)
+		s.watchers[infoHash] = ch
+	}
+	return ch
+}
+
+func (s *Service) Unwatch(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.watchers[infoHash]
+	if ok {
+		close(ch)
+		delete(s.watchers, infoHash)
+	}
+}
+
+// Serve reads announces until the connection is closed.
+func (s *Service) Serve() error {
+	buf := make([]byte, 1500)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		a, err := Parse(buf[:n])
+		if err != nil || a.Cookie == s.cookie {
+			continue
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		s.dispatch(a, peers.Peer{IP: udpAddr.IP, Port: a.Port})
+	}
+}
+
+func (s *Service) dispatch(a *Announce, peer peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, h := range a.InfoHashes {
+		ch, ok := s.watchers[h]
+		if !ok {
+			continue
+		}
+
+		// Drop rather than block the reader if nobody is draining
+		select {
+		case ch <- peer:
+		default:
+		}
+	}
+}
+
+func (s *Service) Close() error {
+	s.mu.Lock()
+	for h, ch := range s.watchers {
+		close(ch)
+		delete(s.watchers, h)
+	}
+	s.mu.Unlock()
+
+	return s.conn.Close()
+}
@@ -0,0 +1,116 @@
+package lsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output *Announce
+		fails  bool
+	}{
+		"single infohash": {
+			input: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n" +
+				"Infohash: d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6\r\ncookie: abc\r\n\r\n\r\n",
+			output: &Announce{
+				Port:       6881,
+				InfoHashes: [][20]byte{{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}},
+				Cookie:     "abc",
+			},
+		},
+		"multiple infohashes": {
+			input: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n" +
+				"Infohash: 0000000000000000000000000000000000000001\r\nInfohash: 0000000000000000000000000000000000000002\r\n\r\n\r\n",
+			output: &Announce{
+				Port:       6881,
+				InfoHashes: [][20]byte{{19: 1}, {19: 2}},
+			},
+		},
+		"wrong method": {
+			input: "GET * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0000000000000000000000000000000000000001\r\n\r\n\r\n",
+			fails: true,
+		},
+		"missing port": {
+			input: "BT-SEARCH * HTTP/1.1\r\nInfohash: 0000000000000000000000000000000000000001\r\n\r\n\r\n",
+			fails: true,
+		},
+		"short infohash": {
+			input: "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0001\r\n\r\n\r\n",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		a, err := Parse([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, a, name)
+		}
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	a := &Announce{Port: 6881, InfoHashes: [][20]byte{{1}, {2}}, Cookie: "xyz"}
+
+	parsed, err := Parse(a.Serialize(IPv4Group))
+	require.Nil(t, err)
+	assert.Equal(t, a, parsed)
+}
+
+func TestServiceLoopback(t *testing.T) {
+	connA, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.Nil(t, err)
+	connB, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	a := New(connA, connB.LocalAddr().(*net.UDPAddr), 6881)
+	b := New(connB, connA.LocalAddr().(*net.UDPAddr), 6882)
+	defer a.Close()
+	defer b.Close()
+
+	go b.Serve()
+
+	wanted := [20]byte{1}
+	found := b.Watch(wanted)
+
+	require.Nil(t, a.Announce([20]byte{2}, wanted))
+
+	select {
+	case p := <-found:
+		assert.Equal(t, peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 6881}, p)
+	case <-time.After(time.Second):
+		t.Fatal("no peer discovered")
+	}
+
+	b.Unwatch(wanted)
+	_, ok := <-found
+	assert.False(t, ok)
+}
+
+func TestServiceIgnoresOwnAnnounce(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	s := New(conn, conn.LocalAddr().(*net.UDPAddr), 6881)
+	defer s.Close()
+
+	go s.Serve()
+
+	found := s.Watch([20]byte{1})
+	require.Nil(t, s.Announce([20]byte{1}))
+
+	select {
+	case <-found:
+		t.Fatal("discovered ourselves")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,23 +1,17 @@
 package main
 
 import (
-	"log"
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
-	torrentfile "github.com/prabal199251/Torrent-Client/torrentFile"
+	"github.com/prabal199251/Torrent-Client/cli"
 )
 
 func main() {
-	inPath := os.Args[1]
-	outPath := os.Args[2]
-
-	TorrentFile, err := torrentfile.Open(inPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = TorrentFile.DownloadToFile(outPath)
-	if err != nil {
-		log.Fatal(err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := cli.Run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
 }
@@ -0,0 +1,79 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ExtHandshakeID is the extended message ID of the extension handshake (BEP 10)
+const ExtHandshakeID = 0
+
+type ExtendedHandshake struct {
+	// M maps extension names to the message IDs the sender uses for them
+	M map[string]int
+	// V is the sender's client name and version
+	V string
+	// Reqq is the number of outstanding requests the sender will queue
+	Reqq int
+}
+
+type bencodeExtendedHandshake struct {
+	M    map[string]int `bencode:"m"`
+	V    string         `bencode:"v,omitempty"`
+	Reqq int            `bencode:"reqq,omitempty"`
+}
+
+func FormatExtendedHandshake(h *ExtendedHandshake) *Message {
+	m := h.M
+	if m == nil {
+		m = map[string]int{}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(ExtHandshakeID)
+	bencode.Marshal(&buf, bencodeExtendedHandshake{M: m, V: h.V, Reqq: h.Reqq})
+
+	return &Message{ID: MsgExtended, PayLoad: buf.Bytes()}
+}
+
+func ParseExtendedHandshake(msg *Message) (*ExtendedHandshake, error) {
+	if msg.ID != MsgExtended {
+		return nil, fmt.Errorf("expected Extended (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+
+	if len(msg.PayLoad) < 1 || msg.PayLoad[0] != ExtHandshakeID {
+		return nil, fmt.Errorf("not an extension handshake")
+	}
+
+	data, err := bencode.Decode(bytes.NewReader(msg.PayLoad[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("extension handshake is not a dictionary")
+	}
+
+	h := ExtendedHandshake{M: make(map[string]int)}
+
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if id, ok := id.(int64); ok {
+				h.M[name] = int(id)
+			}
+		}
+	}
+
+	if v, ok := dict["v"].(string); ok {
+		h.V = v
+	}
+
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		h.Reqq = int(reqq)
+	}
+
+	return &h, nil
+}
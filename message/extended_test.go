@@ -0,0 +1,61 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatExtendedHandshake(t *testing.T) {
+	msg := FormatExtendedHandshake(&ExtendedHandshake{Reqq: 250})
+	expected := &Message{
+		ID:      MsgExtended,
+		PayLoad: []byte("\x00d1:mde4:reqqi250ee"),
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseExtendedHandshake(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		output *ExtendedHandshake
+		fails  bool
+	}{
+		"full handshake": {
+			input: &Message{ID: MsgExtended, PayLoad: []byte("\x00d1:md6:ut_pexi1ee1:v13:qBittorrent 44:reqqi500ee")},
+			output: &ExtendedHandshake{
+				M:    map[string]int{"ut_pex": 1},
+				V:    "qBittorrent 4",
+				Reqq: 500,
+			},
+		},
+		"missing fields": {
+			input:  &Message{ID: MsgExtended, PayLoad: []byte("\x00de")},
+			output: &ExtendedHandshake{M: map[string]int{}},
+		},
+		"not a handshake": {
+			input: &Message{ID: MsgExtended, PayLoad: []byte("\x01de")},
+			fails: true,
+		},
+		"not a dictionary": {
+			input: &Message{ID: MsgExtended, PayLoad: []byte("\x00i1e")},
+			fails: true,
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgHave, PayLoad: []byte("\x00de")},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		h, err := ParseExtendedHandshake(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, h, name)
+	}
+}
@@ -0,0 +1,69 @@
+package message
+
+import "fmt"
+
+const DefaultMaxBlockSize = 16384
+const DefaultMaxExtendedSize = 1 << 20
+
+// Without a known piece count, allow bitfields for up to 2^21 pieces
+const defaultMaxBitfieldSize = 1 << 18
+
+// maxUnknownSize bounds messages whose ID we do not recognise
+const maxUnknownSize = 1 << 10
+
+// Limits bounds the length of incoming messages by type
+type Limits struct {
+	// MaxBlockSize is the largest block a Piece message may carry
+	MaxBlockSize int
+	// NumPieces sizes the Bitfield limit; 0 if not yet known
+	NumPieces int
+	// MaxExtendedSize is the largest extended message payload
+	MaxExtendedSize int
+}
+
+var DefaultLimits = &Limits{
+	MaxBlockSize:    DefaultMaxBlockSize,
+	MaxExtendedSize: DefaultMaxExtendedSize,
+}
+
+func NewLimits(numPieces int) *Limits {
+	return &Limits{
+		MaxBlockSize:    DefaultMaxBlockSize,
+		NumPieces:       numPieces,
+		MaxExtendedSize: DefaultMaxExtendedSize,
+	}
+}
+
+// ProtocolError reports a peer violating the wire protocol. The connection
+// should be dropped.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol violation: %s", e.Reason)
+}
+
+// maxLength returns the largest length prefix, including the ID byte,
+// allowed for a message with the given ID
+func (l *Limits) maxLength(id messageID) int {
+	switch id {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return 1
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return 1 + 4
+	case MsgRequest, MsgCancel, MsgReject:
+		return 1 + 12
+	case MsgBitfield:
+		if l.NumPieces > 0 {
+			return 1 + (l.NumPieces+7)/8
+		}
+		return 1 + defaultMaxBitfieldSize
+	case MsgPiece:
+		return 1 + 8 + l.MaxBlockSize
+	case MsgExtended:
+		return 1 + l.MaxExtendedSize
+	default:
+		return 1 + maxUnknownSize
+	}
+}
@@ -0,0 +1,70 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadLimited(t *testing.T) {
+	tests := map[string]struct {
+		input     []byte
+		limits    *Limits
+		output    *Message
+		violation bool
+	}{
+		"bitfield within piece count": {
+			input:  []byte{0, 0, 0, 3, 5, 0xff, 0xc0},
+			limits: NewLimits(10),
+			output: &Message{ID: MsgBitfield, PayLoad: []byte{0xff, 0xc0}},
+		},
+		"bitfield longer than piece count": {
+			input:     []byte{0, 0, 0, 4, 5, 0xff, 0xc0, 0x00},
+			limits:    NewLimits(10),
+			violation: true,
+		},
+		"piece larger than block size": {
+			input:     []byte{0, 0, 0x40, 0x0a, 7},
+			limits:    DefaultLimits,
+			violation: true,
+		},
+		"huge length is rejected before allocation": {
+			input:     []byte{0xff, 0xff, 0xff, 0xff, 7},
+			limits:    DefaultLimits,
+			violation: true,
+		},
+		"choke with payload": {
+			input:     []byte{0, 0, 0, 2, 0, 1},
+			limits:    DefaultLimits,
+			violation: true,
+		},
+		"have with wrong length": {
+			input:     []byte{0, 0, 0, 6, 4, 0, 0, 0, 0, 1},
+			limits:    DefaultLimits,
+			violation: true,
+		},
+		"extended within cap": {
+			input:  []byte{0, 0, 0, 3, 20, 0, 'd'},
+			limits: &Limits{MaxExtendedSize: 2},
+			output: &Message{ID: MsgExtended, PayLoad: []byte{0, 'd'}},
+		},
+		"extended above cap": {
+			input:     []byte{0, 0, 0, 4, 20, 0, 'd', 'e'},
+			limits:    &Limits{MaxExtendedSize: 2},
+			violation: true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := ReadLimited(bytes.NewReader(test.input), test.limits)
+
+		var protocolErr *ProtocolError
+		assert.Equal(t, test.violation, errors.As(err, &protocolErr), name)
+		if !test.violation {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
@@ -35,6 +35,24 @@ const (
 
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+
+	// MsgSuggest suggests a piece the receiver may want to request (BEP 6)
+	MsgSuggest messageID = 13
+
+	// MsgHaveAll replaces a bitfield when the sender has every piece (BEP 6)
+	MsgHaveAll messageID = 14
+
+	// MsgHaveNone replaces a bitfield when the sender has no pieces (BEP 6)
+	MsgHaveNone messageID = 15
+
+	// MsgReject tells the receiver a request will not be served (BEP 6)
+	MsgReject messageID = 16
+
+	// MsgAllowedFast lists a piece the receiver may request while choked (BEP 6)
+	MsgAllowedFast messageID = 17
+
+	// MsgExtended carries extension protocol messages (BEP 10)
+	MsgExtended messageID = 20
 )
 
 type Message struct {
@@ -53,11 +71,45 @@ func FormatRequest(index, begin, length int) *Message {
 }
 
 func FormatHave(index int) *Message {
+	return formatIndex(MsgHave, index)
+}
+
+func FormatSuggest(index int) *Message {
+	return formatIndex(MsgSuggest, index)
+}
+
+func FormatAllowedFast(index int) *Message {
+	return formatIndex(MsgAllowedFast, index)
+}
+
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+func FormatReject(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgReject
+	return msg
+}
+
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+
+	return &Message{ID: MsgPiece, PayLoad: payload}
+}
+
+func formatIndex(id messageID, index int) *Message {
 	payload := make([]byte, 4)
 
 	binary.BigEndian.PutUint32(payload, uint32(index))
 
-	return &Message{ID: MsgHave, PayLoad: payload}
+	return &Message{ID: id, PayLoad: payload}
 }
 
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
@@ -92,8 +144,20 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 }
 
 func ParseHave(msg *Message) (int, error) {
-	if msg.ID != MsgHave {
-		return 0, fmt.Errorf("expected HAVE (ID %d), got ID %d", MsgHave, msg.ID)
+	return parseIndex(MsgHave, msg)
+}
+
+func ParseSuggest(msg *Message) (int, error) {
+	return parseIndex(MsgSuggest, msg)
+}
+
+func ParseAllowedFast(msg *Message) (int, error) {
+	return parseIndex(MsgAllowedFast, msg)
+}
+
+func parseIndex(id messageID, msg *Message) (int, error) {
+	if msg.ID != id {
+		return 0, fmt.Errorf("expected %s (ID %d), got ID %d", (&Message{ID: id}).name(), id, msg.ID)
 	}
 
 	if len(msg.PayLoad) != 4 {
@@ -105,6 +169,30 @@ func ParseHave(msg *Message) (int, error) {
 	return index, nil
 }
 
+func ParseReject(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(MsgReject, msg)
+}
+
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(MsgRequest, msg)
+}
+
+func parseBlock(id messageID, msg *Message) (index, begin, length int, err error) {
+	if msg.ID != id {
+		return 0, 0, 0, fmt.Errorf("expected %s (ID %d), got ID %d", (&Message{ID: id}).name(), id, msg.ID)
+	}
+
+	if len(msg.PayLoad) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.PayLoad))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.PayLoad[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.PayLoad[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.PayLoad[8:12]))
+
+	return index, begin, length, nil
+}
+
 func (m *Message) Serialize() []byte {
 	if m == nil {
 		return make([]byte, 4)
@@ -121,7 +209,14 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
+// Read reads a message using DefaultLimits
 func Read(r io.Reader) (*Message, error) {
+	return ReadLimited(r, DefaultLimits)
+}
+
+// ReadLimited reads a message, rejecting any whose length exceeds what
+// limits allows for its type before allocating room for the payload.
+func ReadLimited(r io.Reader, limits *Limits) (*Message, error) {
 	lengthbuf := make([]byte, 4)
 
 	_, err := io.ReadFull(r, lengthbuf)
@@ -135,20 +230,33 @@ func Read(r io.Reader) (*Message, error) {
 		return nil, nil
 	}
 
-	messageBuf := make([]byte, length)
+	idBuf := make([]byte, 1)
+
+	_, err = io.ReadFull(r, idBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	id := messageID(idBuf[0])
+
+	maxLength := limits.maxLength(id)
+	if length > uint32(maxLength) {
+		return nil, &ProtocolError{Reason: fmt.Sprintf("%s message length %d exceeds limit %d", (&Message{ID: id}).name(), length, maxLength)}
+	}
+
+	payload := make([]byte, length-1)
 
-	_, err = io.ReadFull(r, messageBuf)
+	_, err = io.ReadFull(r, payload)
 	if err != nil {
 		return nil, err
 	}
 
 	m := Message{
-		ID:      messageID(messageBuf[0]),
-		PayLoad: messageBuf[1:],
+		ID:      id,
+		PayLoad: payload,
 	}
 
 	return &m, nil
-
 }
 
 func (m *Message) name() string {
@@ -175,6 +283,18 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown #%d", m.ID)
 	}
@@ -29,6 +29,47 @@ func TestFormatHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatReject(t *testing.T) {
+	msg := FormatReject(4, 567, 4321)
+	expected := &Message{
+		ID: MsgReject,
+		PayLoad: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0x00, 0x00, 0x10, 0xe1, // Length
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(4, 567, []byte{1, 2, 3})
+	expected := &Message{
+		ID: MsgPiece,
+		PayLoad: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			1, 2, 3, // Block
+		},
+	}
+	assert.Equal(t, expected, msg)
+
+	buf := make([]byte, 570)
+	n, err := ParsePiece(4, buf, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []byte{1, 2, 3}, buf[567:])
+}
+
+func TestFormatAllowedFast(t *testing.T) {
+	msg := FormatAllowedFast(4)
+	expected := &Message{
+		ID:      MsgAllowedFast,
+		PayLoad: []byte{0x00, 0x00, 0x00, 0x04},
+	}
+	assert.Equal(t, expected, msg)
+}
+
 func TestParsePiece(t *testing.T) {
 	tests := map[string]struct {
 		inputIndex int
@@ -188,6 +229,36 @@ func TestParseHave(t *testing.T) {
 	}
 }
 
+func TestParseReject(t *testing.T) {
+	index, begin, length, err := ParseReject(FormatReject(4, 567, 4321))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 567, 4321}, []int{index, begin, length})
+
+	_, _, _, err = ParseReject(FormatRequest(4, 567, 4321))
+	assert.NotNil(t, err)
+
+	_, _, _, err = ParseReject(&Message{ID: MsgReject, PayLoad: []byte{0, 0, 0, 4}})
+	assert.NotNil(t, err)
+}
+
+func TestParseRequest(t *testing.T) {
+	index, begin, length, err := ParseRequest(FormatRequest(4, 567, 4321))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 567, 4321}, []int{index, begin, length})
+
+	_, _, _, err = ParseRequest(FormatCancel(4, 567, 4321))
+	assert.NotNil(t, err)
+}
+
+func TestParseAllowedFast(t *testing.T) {
+	index, err := ParseAllowedFast(FormatAllowedFast(7))
+	assert.Nil(t, err)
+	assert.Equal(t, 7, index)
+
+	_, err = ParseAllowedFast(FormatHave(7))
+	assert.NotNil(t, err)
+}
+
 func TestSerialize(t *testing.T) {
 	tests := map[string]struct {
 		input  *Message
@@ -269,6 +340,11 @@ func TestString(t *testing.T) {
 		{&Message{MsgRequest, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{MsgPiece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{MsgCancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{MsgSuggest, []byte{1, 2, 3}}, "Suggest [3]"},
+		{&Message{MsgHaveAll, []byte{}}, "HaveAll [0]"},
+		{&Message{MsgHaveNone, []byte{}}, "HaveNone [0]"},
+		{&Message{MsgReject, []byte{1, 2, 3}}, "Reject [3]"},
+		{&Message{MsgAllowedFast, []byte{1, 2, 3}}, "AllowedFast [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown #99 [3]"},
 	}
 
@@ -277,3 +353,60 @@ func TestString(t *testing.T) {
 		assert.Equal(t, test.output, s)
 	}
 }
+
+func FuzzRead(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 5, 4, 1, 2, 3, 4})
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0, 0, 0, 11, 7, 0, 0, 0, 1, 0, 0, 0, 0, 0xaa, 0xbb})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 7})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Read(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		if m != nil && len(m.PayLoad)+1 > DefaultLimits.maxLength(m.ID) {
+			t.Fatalf("%s exceeds its limit", m)
+		}
+
+		if m != nil && len(m.Serialize()) > len(data) {
+			t.Fatalf("re-serialized %s is longer than its input", m)
+		}
+	})
+}
+
+func FuzzParsePiece(f *testing.F) {
+	f.Add(4, 10, []byte{0, 0, 0, 4, 0, 0, 0, 2, 0xaa, 0xbb})
+	f.Add(0, 0, []byte{})
+	f.Add(1, 4, []byte{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0xaa})
+
+	f.Fuzz(func(t *testing.T, index, bufLen int, payload []byte) {
+		if bufLen < 0 || bufLen > 1<<16 {
+			return
+		}
+
+		buf := make([]byte, bufLen)
+		n, err := ParsePiece(index, buf, &Message{ID: MsgPiece, PayLoad: payload})
+		if err != nil {
+			return
+		}
+
+		if n < 0 || n > bufLen || n != len(payload)-8 {
+			t.Fatalf("invalid block length %d for buffer %d", n, bufLen)
+		}
+	})
+}
+
+func TestFormatCancel(t *testing.T) {
+	msg := FormatCancel(4, 567, 4321)
+	expected := &Message{
+		ID: MsgCancel,
+		PayLoad: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0x00, 0x00, 0x10, 0xe1, // Length
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
@@ -0,0 +1,195 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const readerBufferSize = 64 << 10
+
+var bufioPool = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, readerBufferSize) },
+}
+
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+// Reader is a buffered, per-connection message reader that reuses its
+// buffers between messages. Piece blocks are not buffered at all: they are
+// read straight into the caller's piece buffer with ReadPieceInto.
+type Reader struct {
+	br      *bufio.Reader
+	limits  *Limits
+	msg     Message
+	prefix  [5]byte
+	header  [8]byte
+	payload *[]byte
+	pending int
+	broken  bool
+}
+
+func NewReader(r io.Reader, limits *Limits) *Reader {
+	br := bufioPool.Get().(*bufio.Reader)
+	br.Reset(r)
+
+	return &Reader{
+		br:      br,
+		limits:  limits,
+		payload: payloadPool.Get().(*[]byte),
+	}
+}
+
+// Read returns the next message, or nil for a keep-alive. The message and
+// its payload are only valid until the next call. For Piece messages the
+// payload holds just the index and begin offset; the block itself is read
+// with ReadPieceInto, or skipped by the next call to Read.
+func (r *Reader) Read() (*Message, error) {
+	err := r.discardBlock()
+	if err != nil {
+		r.broken = true
+		return nil, err
+	}
+
+	prefix := r.prefix[:]
+
+	n, err := io.ReadFull(r.br, prefix[:4])
+	if err != nil {
+		r.broken = n > 0
+		return nil, err
+	}
+
+	// Any error from here on leaves us in the middle of a message
+	r.broken = true
+
+	length := binary.BigEndian.Uint32(prefix[:4])
+
+	if length == 0 {
+		r.broken = false
+		return nil, nil
+	}
+
+	_, err = io.ReadFull(r.br, prefix[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	id := messageID(prefix[4])
+
+	maxLength := r.limits.maxLength(id)
+	if length > uint32(maxLength) {
+		return nil, &ProtocolError{Reason: fmt.Sprintf("%s message length %d exceeds limit %d", (&Message{ID: id}).name(), length, maxLength)}
+	}
+
+	r.msg.ID = id
+
+	if id == MsgPiece {
+		if length < 9 {
+			return nil, &ProtocolError{Reason: fmt.Sprintf("Piece message length %d too short", length)}
+		}
+
+		_, err = io.ReadFull(r.br, r.header[:])
+		if err != nil {
+			return nil, err
+		}
+
+		r.msg.PayLoad = r.header[:]
+		r.pending = int(length) - 9
+		r.broken = false
+		return &r.msg, nil
+	}
+
+	n = int(length) - 1
+	if cap(*r.payload) < n {
+		*r.payload = make([]byte, n)
+	}
+
+	r.msg.PayLoad = (*r.payload)[:n]
+
+	_, err = io.ReadFull(r.br, r.msg.PayLoad)
+	if err != nil {
+		return nil, err
+	}
+
+	r.broken = false
+	return &r.msg, nil
+}
+
+// Resumable reports whether the stream is still at a message boundary
+// after a failed read, as when a read deadline expires while waiting for the
+// next message. Reading can then continue once the deadline is extended.
+func (r *Reader) Resumable() bool {
+	return !r.broken
+}
+
+// BlockLength is the length of the unread block of the last Piece message
+func (r *Reader) BlockLength() int {
+	return r.pending
+}
+
+// ReadPieceInto reads the block of the last Piece message into buf at its
+// begin offset, with the same checks as ParsePiece.
+func (r *Reader) ReadPieceInto(index int, buf []byte) (int, error) {
+	if r.msg.ID != MsgPiece || len(r.msg.PayLoad) != 8 {
+		return 0, fmt.Errorf("expected Piece (ID %d), got ID %d", MsgPiece, r.msg.ID)
+	}
+
+	parsedIndex := int(binary.BigEndian.Uint32(r.header[0:4]))
+
+	if parsedIndex != index {
+		return 0, fmt.Errorf("expected index %d, got %d", index, parsedIndex)
+	}
+
+	begin := int(binary.BigEndian.Uint32(r.header[4:8]))
+
+	if begin >= len(buf) {
+		return 0, fmt.Errorf("begin offset too high. %d >= %d", begin, len(buf))
+	}
+
+	if begin+r.pending > len(buf) {
+		return 0, fmt.Errorf("data too long [%d] for offset %d with length %d", r.pending, begin, len(buf))
+	}
+
+	n := r.pending
+	r.pending = 0
+
+	_, err := io.ReadFull(r.br, buf[begin:begin+n])
+	if err != nil {
+		r.broken = true
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (r *Reader) discardBlock() error {
+	if r.pending == 0 {
+		return nil
+	}
+
+	_, err := r.br.Discard(r.pending)
+	r.pending = 0
+	return err
+}
+
+// Release returns the reader's buffers to the pool. The reader must not be
+// used afterwards.
+func (r *Reader) Release() {
+	if r.br == nil {
+		return
+	}
+
+	r.br.Reset(nil)
+	bufioPool.Put(r.br)
+	r.br = nil
+
+	*r.payload = (*r.payload)[:0]
+	payloadPool.Put(r.payload)
+	r.payload = nil
+}
@@ -0,0 +1,212 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	stream := []byte{
+		0, 0, 0, 5, 4, 0, 0, 0, 7, // Have 7
+		0, 0, 0, 0, // KeepAlive
+		0, 0, 0, 15, 7, 0, 0, 0, 4, 0, 0, 0, 2, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, // Piece 4 at 2
+		0, 0, 0, 11, 7, 0, 0, 0, 5, 0, 0, 0, 0, 0x01, 0x02, // Piece 5, skipped
+		0, 0, 0, 1, 1, // Unchoke
+	}
+
+	r := NewReader(bytes.NewReader(stream), DefaultLimits)
+	defer r.Release()
+
+	msg, err := r.Read()
+	require.Nil(t, err)
+	assert.Equal(t, &Message{ID: MsgHave, PayLoad: []byte{0, 0, 0, 7}}, msg)
+
+	msg, err = r.Read()
+	require.Nil(t, err)
+	assert.Nil(t, msg)
+
+	msg, err = r.Read()
+	require.Nil(t, err)
+	assert.Equal(t, MsgPiece, msg.ID)
+	assert.Equal(t, 6, r.BlockLength())
+
+	buf := make([]byte, 10)
+	n, err := r.ReadPieceInto(4, buf)
+	require.Nil(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, []byte{0x00, 0x00, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x00}, buf)
+
+	msg, err = r.Read()
+	require.Nil(t, err)
+	assert.Equal(t, MsgPiece, msg.ID)
+
+	msg, err = r.Read()
+	require.Nil(t, err)
+	assert.Equal(t, &Message{ID: MsgUnchoke, PayLoad: []byte{}}, msg)
+
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderPieceErrors(t *testing.T) {
+	tests := map[string]struct {
+		input []byte
+		index int
+	}{
+		"wrong index": {
+			input: []byte{0, 0, 0, 11, 7, 0, 0, 0, 6, 0, 0, 0, 2, 0xaa, 0xbb},
+			index: 4,
+		},
+		"offset too high": {
+			input: []byte{0, 0, 0, 11, 7, 0, 0, 0, 4, 0, 0, 0, 12, 0xaa, 0xbb},
+			index: 4,
+		},
+		"data too long": {
+			input: []byte{0, 0, 0, 13, 7, 0, 0, 0, 4, 0, 0, 0, 8, 0xaa, 0xbb, 0xcc, 0xdd},
+			index: 4,
+		},
+	}
+
+	for name, test := range tests {
+		stream := append(test.input, 0, 0, 0, 1, 0)
+		r := NewReader(bytes.NewReader(stream), DefaultLimits)
+
+		_, err := r.Read()
+		require.Nil(t, err, name)
+
+		buf := make([]byte, 10)
+		_, err = r.ReadPieceInto(test.index, buf)
+		assert.NotNil(t, err, name)
+		assert.Equal(t, make([]byte, 10), buf, name)
+
+		// The rejected block is skipped and the stream stays in sync
+		msg, err := r.Read()
+		require.Nil(t, err, name)
+		assert.Equal(t, MsgChoke, msg.ID, name)
+
+		r.Release()
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 7}), DefaultLimits)
+	defer r.Release()
+
+	_, err := r.Read()
+
+	var protocolErr *ProtocolError
+	assert.True(t, errors.As(err, &protocolErr))
+
+	r = NewReader(bytes.NewReader([]byte{0, 0, 0, 5, 7, 0, 0, 0, 0}), DefaultLimits)
+	_, err = r.Read()
+	assert.True(t, errors.As(err, &protocolErr))
+}
+
+// blockStream repeats one serialized Piece message forever
+type blockStream struct {
+	msg []byte
+	off int
+}
+
+func (s *blockStream) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], s.msg[s.off:])
+		n += c
+		s.off = (s.off + c) % len(s.msg)
+	}
+	return n, nil
+}
+
+func newBlockStream() *blockStream {
+	payload := make([]byte, 8+DefaultMaxBlockSize)
+	msg := &Message{ID: MsgPiece, PayLoad: payload}
+	return &blockStream{msg: msg.Serialize()}
+}
+
+func BenchmarkReadParsePiece(b *testing.B) {
+	stream := newBlockStream()
+	buf := make([]byte, DefaultMaxBlockSize)
+
+	b.ReportAllocs()
+	b.SetBytes(DefaultMaxBlockSize)
+
+	for i := 0; i < b.N; i++ {
+		msg, err := Read(stream)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = ParsePiece(0, buf, msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReaderReadPieceInto(b *testing.B) {
+	r := NewReader(newBlockStream(), DefaultLimits)
+	defer r.Release()
+	buf := make([]byte, DefaultMaxBlockSize)
+
+	b.ReportAllocs()
+	b.SetBytes(DefaultMaxBlockSize)
+
+	for i := 0; i < b.N; i++ {
+		_, err := r.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = r.ReadPieceInto(0, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// stallingReader returns data then a fixed error, like a connection whose
+// read deadline expires
+type stallingReader struct {
+	data []byte
+	err  error
+}
+
+func (s *stallingReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, s.err
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func TestReaderResumable(t *testing.T) {
+	timeout := errors.New("timeout")
+
+	src := &stallingReader{data: []byte{0, 0, 0, 1, 1}, err: timeout}
+	r := NewReader(src, DefaultLimits)
+	defer r.Release()
+
+	_, err := r.Read()
+	require.Nil(t, err)
+
+	_, err = r.Read()
+	assert.Equal(t, timeout, err)
+	assert.True(t, r.Resumable())
+
+	src.data = []byte{0, 0, 0, 1, 2}
+	msg, err := r.Read()
+	require.Nil(t, err)
+	assert.Equal(t, MsgInterested, msg.ID)
+
+	src.data = []byte{0, 0, 0, 5, 4, 0}
+	_, err = r.Read()
+	assert.Equal(t, timeout, err)
+	assert.False(t, r.Resumable())
+}
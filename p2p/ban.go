@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// BanEvent reports a peer banned for sending data that failed a hash check
+type BanEvent struct {
+	IP    net.IP
+	Piece int
+}
+
+// BanList holds the IPs banned for the session. A list opened with
+// LoadBanList also persists bans to its file.
+type BanList struct {
+	mu   sync.Mutex
+	ips  map[string]bool
+	file *os.File
+}
+
+func NewBanList() *BanList {
+	return &BanList{ips: make(map[string]bool)}
+}
+
+// LoadBanList reads a ban list with one IP per line, creating the file if
+// needed. New bans are appended to it.
+func LoadBanList(path string) (*BanList, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	b := NewBanList()
+	b.file = file
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ip := net.ParseIP(line)
+		if ip == nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid IP %q in ban list", line)
+		}
+		b.ips[ip.String()] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Ban adds ip to the list, reporting whether it was newly banned
+func (b *BanList) Ban(ip net.IP) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := ip.String()
+	if b.ips[key] {
+		return false, nil
+	}
+	b.ips[key] = true
+
+	if b.file != nil {
+		_, err := fmt.Fprintln(b.file, key)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// Banned reports whether ip is banned. A nil BanList bans nobody.
+func (b *BanList) Banned(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.ips[ip.String()]
+}
+
+func (b *BanList) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanList(t *testing.T) {
+	b := NewBanList()
+
+	assert.False(t, b.Banned(net.IP{10, 0, 0, 1}))
+
+	added, err := b.Ban(net.IP{10, 0, 0, 1})
+	require.Nil(t, err)
+	assert.True(t, added)
+
+	added, err = b.Ban(net.IPv4(10, 0, 0, 1))
+	require.Nil(t, err)
+	assert.False(t, added)
+
+	assert.True(t, b.Banned(net.IP{10, 0, 0, 1}))
+	assert.False(t, b.Banned(net.IP{10, 0, 0, 2}))
+}
+
+func TestLoadBanList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.txt")
+	require.Nil(t, os.WriteFile(path, []byte("# banned\n10.0.0.1\n2001:db8::1\n"), 0644))
+
+	b, err := LoadBanList(path)
+	require.Nil(t, err)
+	assert.True(t, b.Banned(net.ParseIP("2001:db8::1")))
+
+	_, err = b.Ban(net.IP{10, 0, 0, 2})
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	b, err = LoadBanList(path)
+	require.Nil(t, err)
+	defer b.Close()
+	assert.True(t, b.Banned(net.IP{10, 0, 0, 1}))
+	assert.True(t, b.Banned(net.IP{10, 0, 0, 2}))
+
+	require.Nil(t, os.WriteFile(path, []byte("not-an-ip\n"), 0644))
+	_, err = LoadBanList(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,389 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/client"
+	"github.com/prabal199251/Torrent-Client/message"
+	"github.com/prabal199251/Torrent-Client/peers"
+)
+
+// DefaultMaxDials is how many connection attempts a torrent has in progress
+// at once unless Torrent.MaxDials says otherwise
+const DefaultMaxDials = 8
+
+// Retrying a peer after a transient failure waits reconnectBackoff,
+// doubling with every failure in a row up to maxBackoff. A peer that fails
+// maxFailures times in a row without sending anything, or fails in a way
+// that is neither transient nor permanent, is only retried every
+// maxBackoff, and no longer keeps a download from giving up with
+// ErrNoPeers.
+var (
+	reconnectBackoff = 5 * time.Second
+	maxBackoff       = 5 * time.Minute
+)
+
+const maxFailures = 5
+
+// Source is where we heard of a peer
+type Source int
+
+const (
+	// SourceTracker peers came in Torrent.Peers, from a tracker
+	SourceTracker Source = iota
+	// SourceDiscovery peers arrived on Torrent.NewPeers, e.g. from local
+	// service discovery
+	SourceDiscovery
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceDiscovery:
+		return "discovery"
+	}
+	return "unknown"
+}
+
+// rank orders sources by preference. Peers found by discovery are close
+// by, and not handed out to everyone like a tracker's.
+func (s Source) rank() int {
+	if s == SourceDiscovery {
+		return 0
+	}
+	return 1
+}
+
+type candidateState int
+
+const (
+	candidateIdle candidateState = iota
+	candidateDialing
+	candidateConnected
+	// candidateDead is never dialed again
+	candidateDead
+)
+
+// candidate is a peer we may connect to, with what we learned of it from
+// past connections
+type candidate struct {
+	peer   peers.Peer
+	source Source
+	lan    bool
+	// order is when we heard of the peer, to break ties
+	order int
+
+	state candidateState
+
+	// downloaded and connectedFor add up past connections
+	downloaded   int64
+	connectedFor time.Duration
+	// failures counts the attempts in a row that failed or ended without
+	// data
+	failures int
+	retryAt  time.Time
+}
+
+// rate is how fast the peer sent us data while connected
+func (c *candidate) rate() float64 {
+	if c.connectedFor <= 0 {
+		return 0
+	}
+	return float64(c.downloaded) / c.connectedFor.Seconds()
+}
+
+// better reports whether c should be dialed before other. Peers that sent
+// us data come first, fastest first, then peers on our network, then by
+// source, then in the order we heard of them.
+func (c *candidate) better(other *candidate) bool {
+	if c.rate() != other.rate() {
+		return c.rate() > other.rate()
+	}
+	if c.lan != other.lan {
+		return c.lan
+	}
+	if c.source.rank() != other.source.rank() {
+		return c.source.rank() < other.source.rank()
+	}
+	return c.order < other.order
+}
+
+// connResult is how a connection to a candidate went
+type connResult struct {
+	// connected is set if the handshake completed
+	connected    bool
+	downloaded   int64
+	connectedFor time.Duration
+	err          error
+}
+
+var errFiltered = errors.New("peer is filtered")
+
+// DroppedPeer is a peer a download gave up on, and why
+type DroppedPeer struct {
+	Peer   peers.Peer
+	Reason error
+}
+
+// permanent reports whether a connection that ended with err means the
+// peer is not worth trying again: it broke the protocol, is serving another
+// torrent or is banned
+func permanent(err error) bool {
+	var protocolErr *message.ProtocolError
+	return errors.As(err, &protocolErr) || errors.Is(err, client.ErrInfoHashMismatch) || errors.Is(err, errBanned)
+}
+
+// transient reports whether err is likely to pass if the peer is tried
+// again soon: a timeout, a reset or the peer hanging up
+func transient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// connManager keeps the backlog of peers a download may connect to and
+// decides which to dial, within the torrent's limits on connections and
+// on dials in progress. It is only used from the download loop, except for
+// droppedPeers.
+type connManager struct {
+	torrent    *Torrent
+	candidates map[string]*candidate
+	backlog    []*candidate
+
+	dialing   int
+	connected int
+
+	mu      sync.Mutex
+	dropped []DroppedPeer
+}
+
+func newConnManager(t *Torrent) *connManager {
+	return &connManager{torrent: t, candidates: make(map[string]*candidate)}
+}
+
+// add puts a peer in the backlog, unless it is already known or blocked
+func (m *connManager) add(peer peers.Peer, source Source) bool {
+	t := m.torrent
+	key := peer.String()
+
+	if m.candidates[key] != nil || t.Bans.Banned(peer.IP) {
+		return false
+	}
+	if t.Filter.Blocked(peer.IP) {
+		log.Printf("Skipping filtered peer %s\n", peer.IP)
+		return false
+	}
+
+	c := &candidate{peer: peer, source: source, lan: peer.IsLAN(), order: len(m.candidates)}
+	m.candidates[key] = c
+	m.backlog = append(m.backlog, c)
+	return true
+}
+
+// known is the number of peers ever added
+func (m *connManager) known() int {
+	return len(m.candidates)
+}
+
+// active counts the peers being dialed or connected
+func (m *connManager) active() int {
+	return m.dialing + m.connected
+}
+
+func (m *connManager) maxDials() int {
+	if m.torrent.MaxDials > 0 {
+		return m.torrent.MaxDials
+	}
+	return DefaultMaxDials
+}
+
+// dial picks the best candidates to connect to now, as many as the limits
+// allow, and marks them as dialing
+func (m *connManager) dial(now time.Time) []*candidate {
+	t := m.torrent
+
+	var ready []*candidate
+	for _, c := range m.backlog {
+		if c.state != candidateIdle || c.retryAt.After(now) {
+			continue
+		}
+		if t.Bans.Banned(c.peer.IP) {
+			m.drop(c, errBanned)
+			continue
+		}
+		// The filter may have been reloaded since the peer was added
+		if t.Filter.Blocked(c.peer.IP) {
+			m.drop(c, errFiltered)
+			continue
+		}
+		ready = append(ready, c)
+	}
+
+	sort.Slice(ready, func(i, j int) bool { return ready[i].better(ready[j]) })
+
+	var picked []*candidate
+	for _, c := range ready {
+		if m.dialing >= m.maxDials() || (t.MaxPeers > 0 && m.active() >= t.MaxPeers) {
+			break
+		}
+
+		c.state = candidateDialing
+		m.dialing++
+		picked = append(picked, c)
+	}
+
+	m.prune()
+	return picked
+}
+
+// prune drops dead candidates from the backlog. They stay known, so they
+// are not added again.
+func (m *connManager) prune() {
+	live := m.backlog[:0]
+	for _, c := range m.backlog {
+		if c.state != candidateDead {
+			live = append(live, c)
+		}
+	}
+	clear(m.backlog[len(live):])
+	m.backlog = live
+}
+
+// handshaken moves a candidate from dialing to connected
+func (m *connManager) handshaken(c *candidate) {
+	if c.state != candidateDialing {
+		return
+	}
+
+	c.state = candidateConnected
+	m.dialing--
+	m.connected++
+}
+
+// closed records how a connection went and decides whether to try the
+// peer again. Peers that failed for good are dropped; the rest are tried
+// again after a backoff, which is long unless the failure was transient or
+// the connection simply ended.
+func (m *connManager) closed(c *candidate, res connResult, now time.Time) {
+	switch c.state {
+	case candidateDialing:
+		m.dialing--
+	case candidateConnected:
+		m.connected--
+	default:
+		return
+	}
+
+	c.downloaded += res.downloaded
+	c.connectedFor += res.connectedFor
+
+	if permanent(res.err) {
+		m.drop(c, res.err)
+		return
+	}
+	if m.torrent.Bans.Banned(c.peer.IP) {
+		m.drop(c, errBanned)
+		return
+	}
+	if m.torrent.Filter.Blocked(c.peer.IP) {
+		m.drop(c, errFiltered)
+		return
+	}
+
+	if res.downloaded > 0 {
+		c.failures = 0
+	}
+	c.failures++
+	if res.err != nil && !transient(res.err) {
+		c.failures = max(c.failures, maxFailures)
+	}
+
+	delay := backoff(c.failures)
+	if c.failures >= maxFailures {
+		delay = maxBackoff
+	}
+
+	c.state = candidateIdle
+	c.retryAt = now.Add(delay)
+}
+
+// hopeful reports whether a peer that is not connected may still come
+// through soon: one not yet tried, or retried after fewer than maxFailures
+// failures in a row
+func (m *connManager) hopeful() bool {
+	for _, c := range m.backlog {
+		if c.state == candidateIdle && c.failures < maxFailures {
+			return true
+		}
+	}
+	return false
+}
+
+// drop gives up on a candidate for good
+func (m *connManager) drop(c *candidate, reason error) {
+	c.state = candidateDead
+
+	log.Printf("Dropping peer %s: %v\n", c.peer, reason)
+
+	m.mu.Lock()
+	m.dropped = append(m.dropped, DroppedPeer{Peer: c.peer, Reason: reason})
+	m.mu.Unlock()
+}
+
+// droppedPeers lists the peers given up on, in order
+func (m *connManager) droppedPeers() []DroppedPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]DroppedPeer(nil), m.dropped...)
+}
+
+// backoff is how long to wait before the attempt after n failures in a row
+func backoff(n int) time.Duration {
+	d := reconnectBackoff
+	for i := 1; i < n && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+// nextRetry is when the first candidate waiting out a backoff may be
+// dialed again, or false if none is waiting
+func (m *connManager) nextRetry(now time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+
+	for _, c := range m.backlog {
+		if c.state != candidateIdle || !c.retryAt.After(now) {
+			continue
+		}
+		if !found || c.retryAt.Before(next) {
+			next = c.retryAt
+			found = true
+		}
+	}
+
+	return next, found
+}
+
+// reset forgets connections in progress, which all ended when a download
+// was paused, keeping what was learned of each peer
+func (m *connManager) reset() {
+	for _, c := range m.backlog {
+		if c.state == candidateDialing || c.state == candidateConnected {
+			c.state = candidateIdle
+		}
+	}
+	m.dialing = 0
+	m.connected = 0
+}
@@ -0,0 +1,451 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/client"
+	"github.com/prabal199251/Torrent-Client/ipfilter"
+	"github.com/prabal199251/Torrent-Client/message"
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPeer(ip string, port uint16) peers.Peer {
+	return peers.Peer{IP: net.ParseIP(ip), Port: port}
+}
+
+func dialedPeers(picked []*candidate) []peers.Peer {
+	var result []peers.Peer
+	for _, c := range picked {
+		result = append(result, c.peer)
+	}
+	return result
+}
+
+func TestConnManagerLimits(t *testing.T) {
+	torrent := &Torrent{MaxPeers: 10, Bans: NewBanList()}
+	m := newConnManager(torrent)
+
+	for i := 0; i < 200; i++ {
+		m.add(testPeer("203.0.113.1", uint16(1000+i)), SourceTracker)
+	}
+	assert.Equal(t, 200, m.known())
+
+	now := time.Now()
+
+	// Not 200 dials at once
+	first := m.dial(now)
+	assert.Len(t, first, DefaultMaxDials)
+	assert.Empty(t, m.dial(now))
+
+	for _, c := range first {
+		m.handshaken(c)
+	}
+
+	// Room for two more connections
+	second := m.dial(now)
+	assert.Len(t, second, 2)
+	assert.Equal(t, 10, m.active())
+
+	m.closed(second[0], connResult{}, now)
+	assert.Len(t, m.dial(now), 1)
+
+	// Two dials are still in progress
+	torrent.MaxPeers = 0
+	torrent.MaxDials = 3
+	assert.Len(t, m.dial(now), 1)
+}
+
+func TestConnManagerAdd(t *testing.T) {
+	ranges, err := ipfilter.Parse(strings.NewReader("Lab:198.51.100.1-198.51.100.1\n"))
+	require.Nil(t, err)
+
+	torrent := &Torrent{Bans: NewBanList(), Filter: ipfilter.New(ranges)}
+	torrent.Bans.Ban(net.ParseIP("198.51.100.2"))
+
+	m := newConnManager(torrent)
+
+	assert.True(t, m.add(testPeer("203.0.113.1", 1), SourceTracker))
+	assert.False(t, m.add(testPeer("203.0.113.1", 1), SourceDiscovery))
+	assert.False(t, m.add(testPeer("198.51.100.1", 1), SourceTracker))
+	assert.False(t, m.add(testPeer("198.51.100.2", 1), SourceTracker))
+	assert.Equal(t, 1, m.known())
+}
+
+func TestConnManagerFilterReloaded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.Nil(t, os.WriteFile(path, []byte("# nothing yet\n"), 0644))
+
+	filter, err := ipfilter.Load(path)
+	require.Nil(t, err)
+
+	torrent := &Torrent{Bans: NewBanList(), Filter: filter}
+	m := newConnManager(torrent)
+
+	waiting := testPeer("198.51.100.1", 1)
+	idle := testPeer("198.51.100.2", 1)
+	m.add(waiting, SourceTracker)
+
+	// One peer waits out a backoff, the other has not been dialed yet
+	now := time.Now()
+	picked := m.dial(now)
+	require.Len(t, picked, 1)
+	m.closed(picked[0], connResult{err: io.EOF}, now)
+	m.add(idle, SourceTracker)
+
+	require.Nil(t, os.WriteFile(path, []byte("Lab:198.51.100.0-198.51.100.255\n"), 0644))
+	changed, err := filter.Reload()
+	require.Nil(t, err)
+	require.True(t, changed)
+
+	assert.Empty(t, m.dial(now.Add(time.Hour)))
+
+	dropped := m.droppedPeers()
+	require.Len(t, dropped, 2)
+	for _, d := range dropped {
+		assert.ErrorIs(t, d.Reason, errFiltered, d.Peer.String())
+	}
+}
+
+func TestConnManagerPreference(t *testing.T) {
+	torrent := &Torrent{MaxDials: 1, Bans: NewBanList()}
+	m := newConnManager(torrent)
+
+	tracker := testPeer("203.0.113.1", 1)
+	discovered := testPeer("203.0.113.2", 1)
+	lan := testPeer("192.168.1.2", 1)
+	fast := testPeer("203.0.113.3", 1)
+	slow := testPeer("203.0.113.4", 1)
+
+	m.add(tracker, SourceTracker)
+	m.add(fast, SourceTracker)
+	m.add(slow, SourceTracker)
+	m.add(discovered, SourceDiscovery)
+	m.add(lan, SourceTracker)
+
+	now := time.Now()
+
+	// Fast and slow sent us data before, at 1000 and 10 bytes a second
+	for _, past := range []struct {
+		peer peers.Peer
+		rate int64
+	}{{fast, 1000}, {slow, 10}} {
+		c := m.candidates[past.peer.String()]
+		c.downloaded = past.rate * 60
+		c.connectedFor = time.Minute
+	}
+
+	var order []peers.Peer
+	for {
+		picked := m.dial(now)
+		if len(picked) == 0 {
+			break
+		}
+		order = append(order, dialedPeers(picked)...)
+		m.closed(picked[0], connResult{}, now)
+	}
+
+	assert.Equal(t, []peers.Peer{fast, slow, lan, discovered, tracker}, order)
+}
+
+func TestConnManagerReconnect(t *testing.T) {
+	torrent := &Torrent{Bans: NewBanList()}
+	m := newConnManager(torrent)
+
+	peer := testPeer("203.0.113.1", 1)
+	m.add(peer, SourceTracker)
+
+	now := time.Now()
+
+	connect := func() *candidate {
+		picked := m.dial(now)
+		require.Len(t, picked, 1)
+		m.handshaken(picked[0])
+		return picked[0]
+	}
+
+	// A connection that sent data is retried after the shortest backoff
+	c := connect()
+	m.closed(c, connResult{connected: true, downloaded: 100, connectedFor: time.Second}, now)
+	assert.Empty(t, m.dial(now))
+
+	next, ok := m.nextRetry(now)
+	require.True(t, ok)
+	assert.Equal(t, now.Add(reconnectBackoff), next)
+
+	// Drops without data back off further each time
+	for failures := 2; failures < maxFailures; failures++ {
+		now = next
+		c = connect()
+		m.closed(c, connResult{connected: true}, now)
+
+		next, ok = m.nextRetry(now)
+		require.True(t, ok)
+		assert.Equal(t, now.Add(backoff(failures)), next)
+		assert.True(t, m.hopeful())
+	}
+
+	// Then the peer is only retried now and then, and not waited for
+	for i := 0; i < 2; i++ {
+		now = next
+		c = connect()
+		m.closed(c, connResult{connected: true}, now)
+
+		next, ok = m.nextRetry(now)
+		require.True(t, ok)
+		assert.Equal(t, now.Add(maxBackoff), next)
+		assert.False(t, m.hopeful())
+	}
+
+	assert.Empty(t, m.droppedPeers())
+}
+
+func TestConnManagerRetriesDialFailures(t *testing.T) {
+	torrent := &Torrent{Bans: NewBanList()}
+	m := newConnManager(torrent)
+
+	peer := testPeer("203.0.113.1", 1)
+	m.add(peer, SourceTracker)
+
+	timeout := &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}
+	now := time.Now()
+
+	for failures := 1; failures <= maxFailures+1; failures++ {
+		picked := m.dial(now)
+		require.Len(t, picked, 1)
+		m.closed(picked[0], connResult{err: timeout}, now)
+
+		expected := backoff(failures)
+		if failures >= maxFailures {
+			expected = maxBackoff
+		}
+
+		next, ok := m.nextRetry(now)
+		require.True(t, ok)
+		assert.Equal(t, now.Add(expected), next)
+
+		now = next
+	}
+
+	assert.Equal(t, 1, m.known())
+	assert.Empty(t, m.droppedPeers())
+}
+
+func TestConnManagerRefused(t *testing.T) {
+	torrent := &Torrent{Bans: NewBanList()}
+	m := newConnManager(torrent)
+
+	m.add(testPeer("203.0.113.1", 1), SourceTracker)
+
+	now := time.Now()
+	picked := m.dial(now)
+	require.Len(t, picked, 1)
+
+	// Not transient, so retried only after the longest backoff
+	m.closed(picked[0], connResult{err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, now)
+
+	next, ok := m.nextRetry(now)
+	require.True(t, ok)
+	assert.Equal(t, now.Add(maxBackoff), next)
+	assert.False(t, m.hopeful())
+	assert.Empty(t, m.droppedPeers())
+}
+
+func TestTransient(t *testing.T) {
+	tests := map[string]struct {
+		err       error
+		transient bool
+	}{
+		"timeout":          {err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, transient: true},
+		"reset":            {err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, transient: true},
+		"hung up":          {err: io.EOF, transient: true},
+		"hung up mid-read": {err: fmt.Errorf("reading handshake: %w", io.ErrUnexpectedEOF), transient: true},
+		"refused":          {err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}},
+		"unreachable":      {err: &net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}},
+		"other":            {err: errors.New("no buffer space available")},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.transient, transient(test.err), name)
+	}
+}
+
+func TestConnManagerGivesUp(t *testing.T) {
+	mismatch := fmt.Errorf("%w: expected infohash 01, got 02", client.ErrInfoHashMismatch)
+	violation := &message.ProtocolError{Reason: "invalid request"}
+
+	tests := map[string]struct {
+		result connResult
+		ban    bool
+		reason error
+	}{
+		"infohash mismatch": {result: connResult{err: mismatch}, reason: client.ErrInfoHashMismatch},
+		"protocol violation": {
+			result: connResult{connected: true, err: violation},
+			reason: violation,
+		},
+		"banned": {result: connResult{connected: true, err: errBanned}, reason: errBanned},
+		"banned since": {
+			result: connResult{connected: true},
+			ban:    true,
+			reason: errBanned,
+		},
+	}
+
+	for name, test := range tests {
+		torrent := &Torrent{Bans: NewBanList()}
+		m := newConnManager(torrent)
+
+		peer := testPeer("203.0.113.1", 1)
+		m.add(peer, SourceTracker)
+
+		now := time.Now()
+		picked := m.dial(now)
+		require.Len(t, picked, 1, name)
+
+		if test.ban {
+			torrent.Bans.Ban(peer.IP)
+		}
+
+		m.closed(picked[0], test.result, now)
+
+		_, ok := m.nextRetry(now)
+		assert.False(t, ok, name)
+		assert.Empty(t, m.dial(now.Add(time.Hour)), name)
+
+		dropped := m.droppedPeers()
+		require.Len(t, dropped, 1, name)
+		assert.ErrorIs(t, dropped[0].Reason, test.reason, name)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, reconnectBackoff, backoff(1))
+	assert.Equal(t, 2*reconnectBackoff, backoff(2))
+	assert.Equal(t, 8*reconnectBackoff, backoff(4))
+	assert.Equal(t, maxBackoff, backoff(100))
+}
+
+func TestDownloadReconnects(t *testing.T) {
+	defer func(d time.Duration) { reconnectBackoff = d }(reconnectBackoff)
+	reconnectBackoff = 10 * time.Millisecond
+
+	data := randomData(4 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// The only peer hangs up after every few blocks
+	s := newSeeder(t, data, infoHash)
+	s.blocksPerConn = 4
+
+	buf, err := newTestTorrent(data, s).Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Greater(t, s.acceptedConnections(), 1)
+}
+
+func TestDownloadDialLimits(t *testing.T) {
+	tests := map[string]struct {
+		maxDials int
+		dials    *ConnLimit
+		expected int
+	}{
+		"per torrent": {maxDials: 3, expected: 3},
+		"shared":      {maxDials: 3, dials: NewConnLimit(2), expected: 2},
+	}
+
+	for name, test := range tests {
+		data := randomData(testPieceLength)
+		infoHash := [20]byte{1, 2, 3}
+
+		// Seeders that take their time answering the handshake
+		hold := make(chan struct{})
+		var seeders []*seeder
+		for i := 0; i < 10; i++ {
+			s := newSeeder(t, data, infoHash)
+			s.hold = hold
+			seeders = append(seeders, s)
+		}
+
+		accepted := func() int {
+			n := 0
+			for _, s := range seeders {
+				n += s.acceptedConnections()
+			}
+			return n
+		}
+
+		torrent := newTestTorrent(data, seeders...)
+		torrent.MaxDials = test.maxDials
+		torrent.Dials = test.dials
+		torrent.Storage = make(memoryStorage, len(data))
+
+		h := torrent.Start(context.Background())
+
+		require.Eventually(t, func() bool { return accepted() == test.expected }, time.Second, time.Millisecond, name)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, test.expected, accepted(), name)
+
+		close(hold)
+		assert.Nil(t, h.Wait(), name)
+	}
+}
+
+func TestDownloadRetriesUnreachablePeer(t *testing.T) {
+	defer func(d time.Duration) { maxBackoff = d }(maxBackoff)
+	maxBackoff = 50 * time.Millisecond
+
+	data := randomData(2 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// The only peer comes up after the first attempt has failed
+	peer := deadPeer(t)
+	time.AfterFunc(100*time.Millisecond, func() {
+		newSeederAt(t, peer.String(), data, infoHash)
+	})
+
+	// A refused peer is not waited for, so discovery has to keep the
+	// download going until it is retried
+	torrent := newTestTorrent(data)
+	torrent.Peers = []peers.Peer{peer}
+	torrent.NewPeers = make(chan peers.Peer)
+
+	buf, err := torrent.Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadDropsWrongTorrent(t *testing.T) {
+	defer func(d time.Duration) { reconnectBackoff = d }(reconnectBackoff)
+	reconnectBackoff = 10 * time.Millisecond
+
+	data := randomData(2 * testPieceLength)
+
+	// One peer serves another torrent; the good one hangs up now and then
+	other := newSeeder(t, data, [20]byte{9, 9, 9})
+	good := newSeeder(t, data, [20]byte{1, 2, 3})
+	good.blocksPerConn = 4
+
+	torrent := newTestTorrent(data, other, good)
+	torrent.Storage = make(memoryStorage, len(data))
+
+	h := torrent.Start(context.Background())
+	require.Nil(t, h.Wait())
+
+	assert.Equal(t, 1, other.acceptedConnections())
+
+	dropped := h.Stats().Dropped
+	require.Len(t, dropped, 1)
+	assert.Equal(t, other.peer(), dropped[0].Peer)
+	assert.ErrorIs(t, dropped[0].Reason, client.ErrInfoHashMismatch)
+}
@@ -0,0 +1,533 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/bitfield"
+	"github.com/prabal199251/Torrent-Client/peers"
+)
+
+// ErrStopped is returned by Wait after Stop
+var ErrStopped = errors.New("download stopped")
+
+// errPaused ends a download session without finishing the download
+var errPaused = errors.New("download paused")
+
+type State int
+
+const (
+	StateDownloading State = iota
+	StatePaused
+	StateCompleted
+	StateStopped
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDownloading:
+		return "downloading"
+	case StatePaused:
+		return "paused"
+	case StateCompleted:
+		return "completed"
+	case StateStopped:
+		return "stopped"
+	case StateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// StateEvent reports a state transition. Err is set when the download
+// failed.
+type StateEvent struct {
+	From State
+	To   State
+	Err  error
+}
+
+// eventBuffer is how many events may queue up unread before new ones are
+// dropped; a slow consumer must never stall the download
+const eventBuffer = 256
+
+type command int
+
+const (
+	cmdPause command = iota
+	cmdResume
+	cmdStop
+)
+
+type request struct {
+	cmd   command
+	reply chan error
+}
+
+// Handle controls a download started with Torrent.Start
+type Handle struct {
+	torrent *Torrent
+	picker  *picker
+
+	// manager holds every peer we know of, so a resumed download can dial
+	// the ones discovered before it was paused
+	manager  *connManager
+	newPeers <-chan peers.Peer
+
+	// results has room for every piece, so workers never block on it and
+	// pieces verified while pausing are still written
+	results chan *PieceResult
+
+	down *rateMeter
+	up   *rateMeter
+
+	requests chan request
+	events   chan Event
+	done     chan struct{}
+
+	mu           sync.Mutex
+	state        State
+	err          error
+	written      int
+	bytesWritten int64
+	have         bitfield.Bitfield
+	conns        map[*peerConn]bool
+	// eventsClosed is set once events is closed, as peers served by
+	// ServePeer may outlive the download
+	eventsClosed bool
+}
+
+// Start begins downloading in the background. Verified pieces are written
+// to Storage, which must be set.
+func (t *Torrent) Start(ctx context.Context) *Handle {
+	log.Println("Starting download for", t.Name)
+
+	works := make([]*PieceWork, len(t.PieceHashes))
+
+	for index, hash := range t.PieceHashes {
+		length := t.calculatePieceSize(index)
+		works[index] = &PieceWork{index, hash, length}
+	}
+
+	if t.Bans == nil {
+		t.Bans = NewBanList()
+	}
+
+	h := &Handle{
+		torrent:  t,
+		picker:   newPicker(works),
+		manager:  newConnManager(t),
+		newPeers: t.NewPeers,
+		results:  make(chan *PieceResult, len(works)),
+		down:     newRateMeter(),
+		up:       newRateMeter(),
+		requests: make(chan request),
+		events:   make(chan Event, eventBuffer),
+		done:     make(chan struct{}),
+		conns:    make(map[*peerConn]bool),
+		have:     make(bitfield.Bitfield, (len(works)+7)/8),
+	}
+
+	for _, peer := range t.Peers {
+		h.manager.add(peer, SourceTracker)
+	}
+
+	go h.run(ctx)
+	return h
+}
+
+// Pause disconnects all peers after flushing verified pieces to storage.
+// Partially downloaded pieces are kept in memory.
+func (h *Handle) Pause() error {
+	return h.send(cmdPause)
+}
+
+// Resume reconnects to peers and carries on from where Pause left off,
+// without rechecking pieces already downloaded
+func (h *Handle) Resume() error {
+	return h.send(cmdResume)
+}
+
+// Stop ends the download for good; Wait then returns ErrStopped
+func (h *Handle) Stop() error {
+	return h.send(cmdStop)
+}
+
+func (h *Handle) send(cmd command) error {
+	req := request{cmd: cmd, reply: make(chan error, 1)}
+
+	select {
+	case h.requests <- req:
+	case <-h.done:
+		return fmt.Errorf("download already %s", h.State())
+	}
+
+	return <-req.reply
+}
+
+// Events delivers state transitions, pieces, peers and bans, and is closed
+// when the download ends. Events are dropped if the channel is left unread.
+func (h *Handle) Events() <-chan Event {
+	return h.events
+}
+
+func (h *Handle) emit(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.eventsClosed {
+		return
+	}
+
+	select {
+	case h.events <- e:
+	default:
+	}
+}
+
+func (h *Handle) closeEvents() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.eventsClosed = true
+	close(h.events)
+}
+
+func (h *Handle) State() State {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.state
+}
+
+// Done is closed when the download has ended
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the download ends and returns why it did, or nil if
+// it completed
+func (h *Handle) Wait() error {
+	<-h.done
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.err
+}
+
+func (h *Handle) setState(to State, err error) {
+	h.mu.Lock()
+	from := h.state
+	h.state = to
+	h.err = err
+	h.mu.Unlock()
+
+	h.emit(StateEvent{From: from, To: to, Err: err})
+}
+
+func (h *Handle) run(ctx context.Context) {
+	defer h.closeEvents()
+	defer close(h.done)
+
+	for {
+		req, err := h.download(ctx)
+
+		// Pieces verified while the workers wound down still count
+		drainErr := h.drain()
+		if drainErr != nil {
+			err = drainErr
+		}
+
+		if err == errPaused {
+			err = h.flush()
+			if err == nil {
+				h.setState(StatePaused, nil)
+				req.reply <- nil
+
+				req, err = h.waitForResume(ctx)
+				if err == nil {
+					h.setState(StateDownloading, nil)
+					req.reply <- nil
+					continue
+				}
+			}
+		}
+
+		h.finish(err)
+
+		// A stop succeeded; a pause that could not flush did not
+		if req != nil && req.cmd == cmdStop {
+			req.reply <- nil
+		} else if req != nil {
+			req.reply <- err
+		}
+		return
+	}
+}
+
+// finish records how the download ended
+func (h *Handle) finish(err error) {
+	flushErr := h.flush()
+
+	switch {
+	case err == nil && flushErr != nil:
+		h.setState(StateFailed, flushErr)
+	case err == nil:
+		h.setState(StateCompleted, nil)
+	case err == ErrStopped || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		h.setState(StateStopped, err)
+	default:
+		h.setState(StateFailed, err)
+	}
+}
+
+func (h *Handle) waitForResume(ctx context.Context) (*request, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case peer, ok := <-h.newPeers:
+			if !ok {
+				h.newPeers = nil
+				continue
+			}
+			h.manager.add(peer, SourceDiscovery)
+
+		case req := <-h.requests:
+			switch req.cmd {
+			case cmdResume:
+				return &req, nil
+			case cmdStop:
+				return &req, ErrStopped
+			default:
+				req.reply <- fmt.Errorf("download already paused")
+			}
+		}
+	}
+}
+
+// drain writes pieces verified after the download loop stopped reading
+func (h *Handle) drain() error {
+	for {
+		select {
+		case res := <-h.results:
+			err := h.write(res)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (h *Handle) write(res *PieceResult) error {
+	begin, _ := h.torrent.calculateBoundsForPiece(res.index)
+
+	_, err := h.torrent.Storage.WriteAt(res.buf, int64(begin))
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.written++
+	h.bytesWritten += int64(len(res.buf))
+	h.have.SetPiece(res.index)
+	done := h.written
+	h.mu.Unlock()
+
+	h.emit(PieceEvent{Index: res.index, Done: done, Total: len(h.torrent.PieceHashes)})
+	return nil
+}
+
+// connected registers a peer that completed the handshake
+func (h *Handle) connected(c *peerConn) {
+	h.mu.Lock()
+	h.conns[c] = true
+	h.mu.Unlock()
+
+	h.emit(PeerEvent{Peer: c.peer, Connected: true})
+}
+
+func (h *Handle) disconnected(c *peerConn, err error) {
+	h.mu.Lock()
+	delete(h.conns, c)
+	h.mu.Unlock()
+
+	h.emit(PeerEvent{Peer: c.peer, Err: err})
+}
+
+func (h *Handle) numPeers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.conns)
+}
+
+func (h *Handle) ban(peer peers.Peer, index int) {
+	t := h.torrent
+
+	added, err := t.Bans.Ban(peer.IP)
+	if err != nil {
+		log.Printf("Could not save ban list: %v\n", err)
+	}
+
+	if !added {
+		return
+	}
+
+	log.Printf("Banned %s for sending corrupt data in piece #%d\n", peer.IP, index)
+
+	e := BanEvent{IP: peer.IP, Piece: index}
+	if t.OnBan != nil {
+		t.OnBan(e)
+	}
+	h.emit(e)
+}
+
+// flush makes sure verified pieces have reached disk, for storage that
+// buffers writes
+func (h *Handle) flush() error {
+	syncer, ok := h.torrent.Storage.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+	return syncer.Sync()
+}
+
+// download connects to peers and fetches pieces until the download is
+// done or interrupted. A pause or stop request that ended it is returned
+// so it can be answered once the workers are gone.
+func (h *Handle) download(ctx context.Context) (*request, error) {
+	t := h.torrent
+	m := h.manager
+
+	// Connections from before a pause are gone
+	m.reset()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	handshaken := make(chan *candidate)
+	type exit struct {
+		candidate *candidate
+		result    connResult
+	}
+	exited := make(chan exit)
+
+	launch := func(c *candidate) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			result := h.startDownloadWorker(ctx, c.peer, func() {
+				select {
+				case handshaken <- c:
+				case <-ctx.Done():
+				}
+			})
+
+			select {
+			case exited <- exit{c, result}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// Only armed while there are no workers left
+	var waitForPeers <-chan time.Time
+
+	// retry fires when a dropped peer may be dialed again
+	var retry <-chan time.Time
+	var retryAt time.Time
+
+	total := len(t.PieceHashes)
+
+	for h.written < total {
+		now := time.Now()
+		for _, c := range m.dial(now) {
+			launch(c)
+		}
+
+		next, retrying := m.nextRetry(now)
+		if !retrying {
+			retry, retryAt = nil, time.Time{}
+		} else if !next.Equal(retryAt) {
+			retry, retryAt = time.After(next.Sub(now)), next
+		}
+
+		// Workers quit once the last piece is verified, which can be
+		// before its result has been read. Peers that keep failing are
+		// still retried, but not waited for.
+		if m.active() == 0 && !m.hopeful() && !h.picker.finished() {
+			if h.newPeers == nil {
+				return nil, fmt.Errorf("%w (tried %d)", ErrNoPeers, m.known())
+			}
+			if waitForPeers == nil {
+				log.Printf("No peers left, waiting %s for new ones\n", peerWaitTimeout)
+				waitForPeers = time.After(peerWaitTimeout)
+			}
+		} else {
+			waitForPeers = nil
+		}
+
+		var res *PieceResult
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-waitForPeers:
+			return nil, fmt.Errorf("%w (tried %d)", ErrNoPeers, m.known())
+		case <-retry:
+			retry, retryAt = nil, time.Time{}
+			continue
+		case c := <-handshaken:
+			m.handshaken(c)
+			continue
+		case e := <-exited:
+			m.closed(e.candidate, e.result, time.Now())
+			continue
+		case req := <-h.requests:
+			switch req.cmd {
+			case cmdPause:
+				return &req, errPaused
+			case cmdStop:
+				return &req, ErrStopped
+			default:
+				req.reply <- fmt.Errorf("download is not paused")
+			}
+			continue
+		case peer, ok := <-h.newPeers:
+			if !ok {
+				h.newPeers = nil
+				continue
+			}
+			if m.add(peer, SourceDiscovery) {
+				log.Printf("Discovered peer %s\n", peer)
+			}
+			continue
+		case res = <-h.results:
+		}
+
+		err := h.write(res)
+		if err != nil {
+			return nil, err
+		}
+
+		percent := float64(h.written) / float64(total) * 100
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, h.numPeers())
+	}
+
+	return nil, nil
+}
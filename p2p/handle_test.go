@@ -0,0 +1,147 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStorage keeps pieces in memory and counts writes and syncs
+type recordingStorage struct {
+	mu     sync.Mutex
+	data   memoryStorage
+	writes int
+	syncs  int
+}
+
+func (s *recordingStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	return s.data.WriteAt(p, off)
+}
+
+func (s *recordingStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	return nil
+}
+
+func (s *recordingStorage) counts() (writes, syncs int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes, s.syncs
+}
+
+// nextEvent returns the next state transition, skipping other events
+func nextEvent(t *testing.T, h *Handle) StateEvent {
+	for {
+		select {
+		case e := <-h.Events():
+			if se, ok := e.(StateEvent); ok {
+				return se
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return StateEvent{}
+		}
+	}
+}
+
+func TestHandlePauseResume(t *testing.T) {
+	data := randomData(4 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// Only serves the first two pieces until the gate opens
+	var open atomic.Bool
+	s := newSeeder(t, data, infoHash)
+	s.drop = func(index, begin int) bool { return index >= 2 && !open.Load() }
+
+	storage := &recordingStorage{data: make(memoryStorage, len(data))}
+	torrent := newTestTorrent(data, s)
+	torrent.Storage = storage
+
+	h := torrent.Start(context.Background())
+
+	require.Eventually(t, func() bool {
+		writes, _ := storage.counts()
+		return writes == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Nil(t, h.Pause())
+	assert.Equal(t, StatePaused, h.State())
+	assert.Equal(t, StateEvent{From: StateDownloading, To: StatePaused}, nextEvent(t, h))
+
+	_, syncs := storage.counts()
+	assert.Equal(t, 1, syncs)
+
+	assert.NotNil(t, h.Pause())
+
+	open.Store(true)
+
+	require.Nil(t, h.Resume())
+	assert.Equal(t, StateEvent{From: StatePaused, To: StateDownloading}, nextEvent(t, h))
+
+	require.Nil(t, h.Wait())
+	assert.Equal(t, StateEvent{From: StateDownloading, To: StateCompleted}, nextEvent(t, h))
+	assert.Equal(t, StateCompleted, h.State())
+
+	// Pieces finished before the pause were neither checked nor fetched again
+	writes, _ := storage.counts()
+	assert.Equal(t, 4, writes)
+	assert.Equal(t, 4*3, s.servedBlocks())
+	assert.Equal(t, []byte(data), []byte(storage.data))
+
+	for range h.Events() {
+	}
+}
+
+func TestHandleStop(t *testing.T) {
+	data := randomData(2 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	s := newSeeder(t, data, infoHash)
+	s.drop = func(index, begin int) bool { return true }
+
+	torrent := newTestTorrent(data, s)
+	torrent.Storage = make(memoryStorage, len(data))
+
+	h := torrent.Start(context.Background())
+
+	assert.NotNil(t, h.Resume())
+
+	require.Nil(t, h.Stop())
+	assert.ErrorIs(t, h.Wait(), ErrStopped)
+	assert.Equal(t, StateStopped, h.State())
+	assert.Equal(t, StateEvent{From: StateDownloading, To: StateStopped, Err: ErrStopped}, nextEvent(t, h))
+
+	assert.NotNil(t, h.Pause())
+	assert.NotNil(t, h.Stop())
+}
+
+func TestHandleStopWhilePaused(t *testing.T) {
+	data := randomData(testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	s := newSeeder(t, data, infoHash)
+	s.drop = func(index, begin int) bool { return true }
+
+	torrent := newTestTorrent(data, s)
+	torrent.Storage = make(memoryStorage, len(data))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := torrent.Start(ctx)
+
+	require.Nil(t, h.Pause())
+
+	// Cancelling the context also ends a paused download
+	cancel()
+	assert.ErrorIs(t, h.Wait(), context.Canceled)
+	assert.Equal(t, StateStopped, h.State())
+}
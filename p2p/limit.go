@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"context"
+	"net"
+
+	"github.com/prabal199251/Torrent-Client/ratelimit"
+)
+
+// ConnLimit caps the connections of every torrent sharing it. A nil
+// ConnLimit places no limit.
+type ConnLimit struct {
+	slots chan struct{}
+}
+
+func NewConnLimit(max int) *ConnLimit {
+	return &ConnLimit{slots: make(chan struct{}, max)}
+}
+
+// Acquire waits for a free connection slot
+func (l *ConnLimit) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TryAcquire takes a slot if one is free
+func (l *ConnLimit) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot taken with Acquire or TryAcquire
+func (l *ConnLimit) Release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// InUse is the number of slots taken
+func (l *ConnLimit) InUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// throttle applies the torrent's rate limits to conn
+func (t *Torrent) throttle(conn net.Conn) net.Conn {
+	if t.PeerLimits == nil && len(t.Limits) == 0 {
+		return conn
+	}
+	return ratelimit.NewConn(conn, t.PeerLimits, t.Limits...)
+}
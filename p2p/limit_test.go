@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/prabal199251/Torrent-Client/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimit(t *testing.T) {
+	l := NewConnLimit(2)
+
+	assert.True(t, l.TryAcquire())
+	assert.Nil(t, l.Acquire(context.Background()))
+	assert.False(t, l.TryAcquire())
+	assert.Equal(t, 2, l.InUse())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Acquire(ctx), context.DeadlineExceeded)
+
+	acquired := make(chan error)
+	go func() { acquired <- l.Acquire(context.Background()) }()
+
+	l.Release()
+	assert.Nil(t, <-acquired)
+	assert.Equal(t, 2, l.InUse())
+}
+
+func TestConnLimitNil(t *testing.T) {
+	var l *ConnLimit
+
+	assert.True(t, l.TryAcquire())
+	assert.Nil(t, l.Acquire(context.Background()))
+	l.Release()
+	assert.Equal(t, 0, l.InUse())
+}
+
+func TestDownloadSharesConnLimit(t *testing.T) {
+	data := randomData(2 * testPieceLength)
+	_, peer := startSeed(t, data)
+
+	limit := NewConnLimit(1)
+
+	torrent := newTestTorrent(data)
+	torrent.Peers = []peers.Peer{peer}
+	torrent.Conns = limit
+	torrent.Storage = make(memoryStorage, len(data))
+
+	// Another torrent holds the only slot until we let go of it
+	assert.True(t, limit.TryAcquire())
+	h := torrent.Start(context.Background())
+
+	select {
+	case <-h.Done():
+		t.Fatal("download finished without a connection slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	limit.Release()
+	assert.Nil(t, h.Wait())
+	assert.Equal(t, 0, limit.InUse())
+}
+
+func TestDownloadRateLimited(t *testing.T) {
+	data := randomData(4 * testPieceLength)
+	_, peer := startSeed(t, data)
+
+	rate := int64(2 * testPieceLength)
+
+	torrent := newTestTorrent(data)
+	torrent.Peers = []peers.Peer{peer}
+	torrent.Limits = []*ratelimit.Limits{ratelimit.NewLimits(rate, 0), nil}
+	torrent.PeerLimits = ratelimit.NewPerConn(0, 0)
+
+	start := time.Now()
+	downloaded, err := torrent.Download(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, data, downloaded)
+
+	// The limiter lets a second's worth through at once, the rest at the rate
+	minimum := time.Duration(float64(int64(len(data))-rate) / float64(rate) * float64(time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), minimum)
+}
@@ -2,19 +2,34 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"runtime"
+	"net"
 	"time"
 
 	"github.com/prabal199251/Torrent-Client/client"
+	"github.com/prabal199251/Torrent-Client/ipfilter"
 	"github.com/prabal199251/Torrent-Client/message"
 	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/prabal199251/Torrent-Client/ratelimit"
 )
 
 const MaxBlockSize = 16384
-const MaxBacklog = 5
+
+var errBanned = errors.New("peer is banned")
+
+// ErrNoPeers is returned by Download when every peer has failed and no new
+// ones turned up
+var ErrNoPeers = errors.New("all peers failed and no new peers were found")
+
+// peerWaitTimeout is how long Download waits for a newly discovered peer
+// once every connected peer has failed
+var peerWaitTimeout = 2 * time.Minute
 
 type Torrent struct {
 	Peers       []peers.Peer
@@ -24,6 +39,42 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+
+	// NewPeers delivers peers discovered while the download is running,
+	// e.g. through local service discovery
+	NewPeers <-chan peers.Peer
+
+	// Bans holds peers banned for sending corrupt data. If nil, bans only
+	// last for this download.
+	Bans *BanList
+
+	// OnBan, if set, is called whenever a peer is banned
+	OnBan func(BanEvent)
+
+	// Filter, if set, keeps us from ever dialing peers in its ranges
+	Filter *ipfilter.Filter
+
+	// Storage receives each piece as soon as it is verified
+	Storage io.WriterAt
+
+	// MaxPeers limits how many peers are connected at once; 0 means no
+	// limit
+	MaxPeers int
+
+	// MaxDials limits how many peers are being dialed at once; 0 means
+	// DefaultMaxDials
+	MaxDials int
+
+	// Conns, if set, is shared with other torrents to cap the connections
+	// of all of them, and Dials to cap their dials in progress
+	Conns *ConnLimit
+	Dials *ConnLimit
+
+	// Limits throttle all of the torrent's connections together, e.g. the
+	// torrent's own rate limits followed by a session's. PeerLimits, if
+	// set, throttles each connection on its own.
+	Limits     []*ratelimit.Limits
+	PeerLimits *ratelimit.PerConn
 }
 
 type PieceWork struct {
@@ -37,32 +88,87 @@ type PieceResult struct {
 	buf   []byte
 }
 
-type PieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+// requestTimeout is how long a single block request may go unanswered
+// before it is cancelled and handed out again
+var requestTimeout = 15 * time.Second
+
+// A peer that lets this many requests in a row time out is dropped
+const maxTimeouts = 3
+
+// idleTimeout bounds the wait for any message when nothing is requested;
+// peers send keep-alives every two minutes
+const idleTimeout = 3 * time.Minute
+
+const idlePoll = time.Second
+
+// downloadWorker downloads from a single peer. It keeps blocks from
+// several pieces in flight and shares started pieces with the other
+// workers, so blocks of one piece may come from different peers.
+type downloadWorker struct {
+	ctx     context.Context
+	handle  *Handle
+	torrent *Torrent
+	peer    peers.Peer
+	client  *client.Client
+	queue   *requestQueue
+	picker  *picker
+	results chan *PieceResult
+
+	// rejected holds allowed fast pieces this peer refused to serve while
+	// choking us. They are forgotten once it unchokes us.
+	rejected    map[int]bool
+	timeouts    int
+	lastMessage time.Time
+
+	// conn is what the worker shares with Stats
+	conn           *peerConn
+	peerInterested bool
+	// peerHas counts the pieces the peer has
+	peerHas int
 }
 
-func (state *PieceProgress) readMessage() error {
-	msg, err := state.client.Read()
+func (w *downloadWorker) readMessage() error {
+	msg, err := w.client.Read()
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && w.client.Resumable() {
+		if w.queue.outstanding() > 0 {
+			return w.expireRequests()
+		}
+		if time.Since(w.lastMessage) < idleTimeout {
+			return nil
+		}
+	}
 
 	if err != nil {
 		return err
 	}
 
+	w.lastMessage = time.Now()
+
 	if msg == nil {
 		return nil
 	}
 
 	switch msg.ID {
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		w.client.Choked = false
+		clear(w.rejected)
+
+	case message.MsgInterested:
+		w.peerInterested = true
+
+	case message.MsgNotInterested:
+		w.peerInterested = false
 
 	case message.MsgChoke:
-		state.client.Choked = true
+		w.client.Choked = true
+
+		// Without the Fast extension a choke silently drops our requests
+		if !w.client.Fast {
+			w.queue.clear()
+			w.picker.releaseAll(w)
+		}
 
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
@@ -70,58 +176,215 @@ func (state *PieceProgress) readMessage() error {
 			return err
 		}
 
-		state.client.Bitfield.SetPiece(index)
+		if !w.client.Bitfield.HasPiece(index) {
+			w.peerHas++
+		}
+		w.client.Bitfield.SetPiece(index)
+
+	case message.MsgAllowedFast:
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+
+		w.client.AllowedFast.SetPiece(index)
+
+	case message.MsgReject:
+		index, begin, _, err := message.ParseReject(msg)
+		if err != nil {
+			return err
+		}
+
+		// A fast peer rejects our requests when it chokes us. Other pieces
+		// wait for the unchoke anyway, so only allowed fast ones need to be
+		// kept from being requested again straight away.
+		if w.client.Choked && w.client.AllowedFast.HasPiece(index) {
+			w.rejected[index] = true
+		}
+		w.queue.cancel(index, begin)
+		w.picker.release(w, index, begin)
+
+	case message.MsgExtended:
+		if len(msg.PayLoad) > 0 && msg.PayLoad[0] == message.ExtHandshakeID {
+			err := w.client.HandleExtendedHandshake(msg)
+			if err != nil {
+				return err
+			}
+			w.queue.reqq = w.client.Reqq
+		}
 
 	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		index := int(binary.BigEndian.Uint32(msg.PayLoad[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.PayLoad[4:8]))
+
+		// Blocks we cancelled, or that timed out and went to another peer
+		state, block := w.picker.owned(w, index, begin)
+		if state == nil {
+			return nil
+		}
+
+		_, length := state.blockBounds(block)
+		if w.client.BlockLength() != length {
+			return &message.ProtocolError{Reason: fmt.Sprintf("block %d:%d has length %d, expected %d", index, begin, w.client.BlockLength(), length)}
+		}
 
+		n, err := w.client.ReadPieceInto(index, state.buf)
 		if err != nil {
 			return err
 		}
 
-		state.downloaded += n
-		state.backlog--
+		w.queue.received(index, begin, n)
+		w.timeouts = 0
+		w.conn.down.add(n)
+		w.handle.down.add(n)
+
+		if w.picker.receive(state, block) {
+			w.verify(state)
+		}
 	}
 
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *PieceWork) ([]byte, error) {
-	state := PieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+// expireRequests cancels requests that have been outstanding longer than
+// requestTimeout so their blocks can be requested again
+func (w *downloadWorker) expireRequests() error {
+	expired := w.queue.expired(requestTimeout)
+	if len(expired) == 0 {
+		return nil
 	}
 
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
+	w.timeouts++
+	if w.timeouts >= maxTimeouts {
+		return fmt.Errorf("%d requests in a row timed out", w.timeouts)
+	}
 
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
+	for _, key := range expired {
+		w.queue.cancel(key.index, key.begin)
 
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
+		length, ok := w.picker.release(w, key.index, key.begin)
+		if !ok {
+			continue
+		}
 
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
+		err := w.client.SendCancel(key.index, key.begin, length)
+		if err != nil {
+			return err
+		}
+	}
 
-				state.backlog++
-				state.requested += blockSize
-			}
+	return nil
+}
+
+func (w *downloadWorker) verify(state *pieceState) {
+	err := checkIntegrity(state.work, state.buf)
+
+	for _, culprit := range w.picker.verified(state, err == nil) {
+		w.handle.ban(culprit.peer, state.work.index)
+	}
+
+	if err != nil {
+		log.Printf("Piece #%d failed integrity check\n", state.work.index)
+		return
+	}
+
+	w.client.SendHave(state.work.index)
+
+	select {
+	case w.results <- &PieceResult{state.work.index, state.buf}:
+	case <-w.ctx.Done():
+	}
+}
+
+func (w *downloadWorker) canRequest(index int) bool {
+	if !w.client.Bitfield.HasPiece(index) || w.rejected[index] {
+		return false
+	}
+	return !w.client.Choked || w.client.AllowedFast.HasPiece(index)
+}
+
+func (w *downloadWorker) fillRequests() error {
+	for w.queue.outstanding() < w.queue.target() {
+		state, block, ok := w.picker.reserve(w, w.canRequest)
+		if !ok {
+			return nil
 		}
 
-		err := state.readMessage()
+		begin, length := state.blockBounds(block)
+
+		err := w.client.SendRequest(state.work.index, begin, length)
 		if err != nil {
-			return nil, err
+			return err
 		}
+
+		w.queue.requested(state.work.index, begin)
+	}
+
+	return nil
+}
+
+// publish copies the worker's view of the peer to where Stats can read it
+func (w *downloadWorker) publish() {
+	numPieces := len(w.torrent.PieceHashes)
+
+	w.conn.mu.Lock()
+	defer w.conn.mu.Unlock()
+
+	w.conn.client = w.client.ClientName
+	w.conn.progress = float64(w.peerHas) / float64(numPieces)
+	w.conn.seed = w.peerHas == numPieces
+	w.conn.choked = w.client.Choked
+	w.conn.interested = w.peerInterested
+	w.conn.fast = w.client.Fast
+	w.conn.requests = w.queue.outstanding()
+}
+
+func (w *downloadWorker) setDeadline() {
+	// With nothing requested, wake up regularly to look for blocks that
+	// other peers gave up
+	deadline := time.Now().Add(idlePoll)
+
+	if oldest, ok := w.queue.oldest(); ok {
+		deadline = oldest.Add(requestTimeout)
+	}
+
+	w.client.Conn.SetReadDeadline(deadline)
+}
+
+func (w *downloadWorker) run() error {
+	defer w.picker.releaseAll(w)
+
+	w.lastMessage = time.Now()
+
+	// Unblock any pending read when the download is cancelled
+	stop := context.AfterFunc(w.ctx, func() { w.client.Conn.Close() })
+	defer stop()
+
+	for !w.picker.finished() {
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+
+		if w.torrent.Bans.Banned(w.peer.IP) {
+			return errBanned
+		}
+
+		err := w.fillRequests()
+		if err != nil {
+			return err
+		}
+
+		w.setDeadline()
+
+		err = w.readMessage()
+		if err != nil {
+			return err
+		}
+
+		w.publish()
 	}
 
-	return state.buf, nil
+	return nil
 }
 
 func checkIntegrity(pw *PieceWork, buf []byte) error {
@@ -134,43 +397,93 @@ func checkIntegrity(pw *PieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *PieceWork, results chan *PieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
+// startDownloadWorker connects to peer and downloads from it until the
+// connection ends. onConnect is called once the handshake is done.
+func (h *Handle) startDownloadWorker(ctx context.Context, peer peers.Peer, onConnect func()) connResult {
+	t := h.torrent
+
+	err := t.Conns.Acquire(ctx)
+	if err != nil {
+		return connResult{err: err}
+	}
+	defer t.Conns.Release()
+
+	err = t.Dials.Acquire(ctx)
+	if err != nil {
+		return connResult{err: err}
+	}
+
+	c, err := client.New(ctx, peer, t.PeerID, t.InfoHash, len(t.PieceHashes))
+	t.Dials.Release()
+
 	if err != nil {
 		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
+		return connResult{err: err}
 	}
 
-	defer c.Conn.Close()
+	c.Conn = t.throttle(c.Conn)
+	defer c.Close()
 	log.Printf("Completed handshake with %s\n", peer.IP)
 
+	connectedAt := time.Now()
+	onConnect()
+
 	c.SendUnchoke()
 	c.SendInterested()
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw
-			continue
-		}
+	w := downloadWorker{
+		ctx:      ctx,
+		handle:   h,
+		torrent:  t,
+		peer:     peer,
+		client:   c,
+		queue:    newRequestQueue(c.Reqq),
+		picker:   h.picker,
+		results:  h.results,
+		rejected: make(map[int]bool),
+		conn: &peerConn{
+			peer: peer,
+			down: newRateMeter(),
+			up:   newRateMeter(),
+		},
+	}
 
-		buf, err := attemptDownloadPiece(c, pw)
-		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw
-			return
+	for i := range t.PieceHashes {
+		if c.Bitfield.HasPiece(i) {
+			w.peerHas++
 		}
+	}
 
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw
-			continue
-		}
+	w.publish()
+	h.connected(w.conn)
+
+	err = w.run()
+
+	downloaded, _ := w.conn.down.read()
+	result := connResult{
+		connected:    true,
+		downloaded:   downloaded,
+		connectedFor: time.Since(connectedAt),
+		err:          err,
+	}
+
+	if ctx.Err() != nil {
+		h.disconnected(w.conn, nil)
+		return result
+	}
+	h.disconnected(w.conn, err)
+
+	var protocolErr *message.ProtocolError
+	if errors.As(err, &protocolErr) {
+		log.Printf("Disconnecting %s: %v\n", peer.IP, err)
+		return result
+	}
 
-		c.SendHave(pw.index)
-		results <- &PieceResult{pw.index, buf}
+	if err != nil {
+		log.Println("Exiting", err)
 	}
 
+	return result
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
@@ -189,36 +502,33 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-func (t *Torrent) Download() ([]byte, error) {
-	log.Println("Starting download for", t.Name)
-
-	workQueue := make(chan *PieceWork, len(t.PieceHashes))
-	results := make(chan *PieceResult)
-
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &PieceWork{index, hash, length}
+// Download fetches every piece from the torrent's peers. If Storage is set
+// pieces are written there and the returned buffer is nil. It returns
+// ctx.Err() if ctx is cancelled, and ErrNoPeers if every peer failed and
+// none could be found in peerWaitTimeout. All worker goroutines have exited
+// by the time it returns.
+func (t *Torrent) Download(ctx context.Context) ([]byte, error) {
+	var mem memoryStorage
+	if t.Storage == nil {
+		mem = make(memoryStorage, t.Length)
+		t.Storage = mem
+		defer func() { t.Storage = nil }()
 	}
 
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	err := t.Start(ctx).Wait()
+	if err != nil {
+		return nil, err
 	}
 
-	buf := make([]byte, t.Length)
-	donePieces := 0
-
-	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
+	return mem, nil
+}
 
-		copy(buf[begin:end], res.buf)
-		donePieces++
+// memoryStorage holds a whole torrent in memory
+type memoryStorage []byte
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+func (m memoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is out of bounds", len(p), off)
 	}
-	close(workQueue)
-
-	return buf, nil
+	return copy(m[off:], p), nil
 }
@@ -0,0 +1,451 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/bitfield"
+	"github.com/prabal199251/Torrent-Client/handshake"
+	"github.com/prabal199251/Torrent-Client/ipfilter"
+	"github.com/prabal199251/Torrent-Client/message"
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seeder is an in-process peer that has every piece of data
+type seeder struct {
+	ln       net.Listener
+	data     []byte
+	infoHash [20]byte
+
+	// maxBlocks disconnects after serving this many blocks, if non-zero
+	maxBlocks int
+	// blocksPerConn disconnects each connection after serving this many
+	// blocks on it, if non-zero
+	blocksPerConn int
+	// drop silently ignores requests for which it returns true
+	drop func(index, begin int) bool
+	// corrupt flips the data of blocks for which it returns true
+	corrupt func(index, begin int) bool
+	// wait, if set, is called before serving each request
+	wait func(index, begin int)
+	// reject, if set, makes the seeder choke, reject the request and
+	// unchoke again for requests it returns true for
+	reject func(index, begin int) bool
+	// hold delays the handshake until it is closed, if set
+	hold <-chan struct{}
+
+	// exhausted is closed once maxBlocks have been served
+	exhausted     chan struct{}
+	exhaustedOnce sync.Once
+
+	mu          sync.Mutex
+	served      int
+	connections int
+}
+
+func newSeeder(t *testing.T, data []byte, infoHash [20]byte) *seeder {
+	return newSeederOn(t, "127.0.0.1", data, infoHash)
+}
+
+// newSeederOn listens on a specific loopback address, as bans apply to
+// whole IPs
+func newSeederOn(t *testing.T, ip string, data []byte, infoHash [20]byte) *seeder {
+	return newSeederAt(t, net.JoinHostPort(ip, "0"), data, infoHash)
+}
+
+// newSeederAt listens on addr, e.g. to bring a peer that was unreachable
+// up
+func newSeederAt(t *testing.T, addr string, data []byte, infoHash [20]byte) *seeder {
+	ln, err := net.Listen("tcp", addr)
+	require.Nil(t, err)
+
+	s := &seeder{ln: ln, data: data, infoHash: infoHash, exhausted: make(chan struct{})}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *seeder) peer() peers.Peer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (s *seeder) servedBlocks() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.served
+}
+
+func (s *seeder) acceptedConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+func (s *seeder) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
+	_, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+
+	if s.hold != nil {
+		<-s.hold
+	}
+
+	var peerID [20]byte
+	rand.Read(peerID[:])
+	conn.Write(handshake.New(s.infoHash, peerID).Serialize())
+
+	numPieces := (len(s.data) + testPieceLength - 1) / testPieceLength
+	bf := make(bitfield.Bitfield, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	conn.Write((&message.Message{ID: message.MsgBitfield, PayLoad: bf}).Serialize())
+	conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+
+	servedHere := 0
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+
+		if msg == nil || msg.ID != message.MsgRequest {
+			continue
+		}
+
+		if s.blocksPerConn > 0 && servedHere >= s.blocksPerConn {
+			conn.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, conn)
+			return
+		}
+		servedHere++
+
+		index := int(binary.BigEndian.Uint32(msg.PayLoad[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.PayLoad[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.PayLoad[8:12]))
+
+		if s.drop != nil && s.drop(index, begin) {
+			continue
+		}
+
+		if s.reject != nil && s.reject(index, begin) {
+			conn.Write((&message.Message{ID: message.MsgChoke}).Serialize())
+			conn.Write(message.FormatReject(index, begin, length).Serialize())
+			conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+			continue
+		}
+
+		if s.wait != nil {
+			s.wait(index, begin)
+		}
+
+		s.mu.Lock()
+		if s.maxBlocks > 0 && s.served >= s.maxBlocks {
+			s.mu.Unlock()
+			s.exhaustedOnce.Do(func() { close(s.exhausted) })
+
+			// Shut down gracefully so the blocks already sent are not lost to a reset
+			conn.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, conn)
+			return
+		}
+		s.served++
+		s.mu.Unlock()
+
+		offset := index*testPieceLength + begin
+		payload := make([]byte, 8+length)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		copy(payload[8:], s.data[offset:offset+length])
+
+		if s.corrupt != nil && s.corrupt(index, begin) {
+			payload[8] ^= 0xff
+		}
+
+		_, err = conn.Write((&message.Message{ID: message.MsgPiece, PayLoad: payload}).Serialize())
+		if err != nil {
+			return
+		}
+	}
+}
+
+const testPieceLength = 3 * MaxBlockSize
+
+func newTestTorrent(data []byte, seeders ...*seeder) *Torrent {
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += testPieceLength {
+		end := begin + testPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+
+	t := &Torrent{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: hashes,
+		PieceLength: testPieceLength,
+		Length:      len(data),
+		Name:        "test",
+	}
+	for _, s := range seeders {
+		t.Peers = append(t.Peers, s.peer())
+	}
+	return t
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func TestDownload(t *testing.T) {
+	data := randomData(5*testPieceLength + 1000)
+	infoHash := [20]byte{1, 2, 3}
+
+	a := newSeeder(t, data, infoHash)
+	b := newSeeder(t, data, infoHash)
+
+	buf, err := newTestTorrent(data, a, b).Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadSurvivesPeerDisconnect(t *testing.T) {
+	data := randomData(4 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// Drops mid-piece
+	flaky := newSeeder(t, data, infoHash)
+	flaky.maxBlocks = 4
+	good := newSeeder(t, data, infoHash)
+	good.hold = flaky.exhausted
+
+	buf, err := newTestTorrent(data, flaky, good).Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	// Blocks received from the flaky peer are not downloaded again
+	assert.Equal(t, 4, flaky.servedBlocks())
+	assert.Equal(t, 4*3-4, good.servedBlocks())
+}
+
+func TestDownloadRequestTimeout(t *testing.T) {
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+	requestTimeout = 100 * time.Millisecond
+
+	data := randomData(2 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// Never answers the second block of the first piece
+	s := newSeeder(t, data, infoHash)
+	dropped := false
+	s.drop = func(index, begin int) bool {
+		if index == 0 && begin == MaxBlockSize && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	}
+
+	buf, err := newTestTorrent(data, s).Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadRequestsAgainAfterUnchoke(t *testing.T) {
+	data := randomData(2 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// The only peer chokes us once, rejecting the first request, and then
+	// unchokes us again
+	s := newSeeder(t, data, infoHash)
+	var mu sync.Mutex
+	requests := 0
+	s.reject = func(index, begin int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if index != 0 || begin != 0 {
+			return false
+		}
+		requests++
+		return requests == 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	buf, err := newTestTorrent(data, s).Download(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, requests)
+}
+
+func TestDownloadBansCorruptPeer(t *testing.T) {
+	data := randomData(6 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	bad := newSeederOn(t, "127.0.0.2", data, infoHash)
+	bad.corrupt = func(index, begin int) bool { return true }
+	good := newSeeder(t, data, infoHash)
+
+	var mu sync.Mutex
+	var events []BanEvent
+
+	torrent := newTestTorrent(data, bad, good)
+	torrent.OnBan = func(e BanEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	buf, err := torrent.Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	assert.True(t, torrent.Bans.Banned(net.IP{127, 0, 0, 2}))
+	assert.False(t, torrent.Bans.Banned(net.IP{127, 0, 0, 1}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, events, 1)
+	assert.Equal(t, "127.0.0.2", events[0].IP.String())
+}
+
+func TestDownloadSkipsFilteredPeers(t *testing.T) {
+	data := randomData(2 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	blocked := newSeederOn(t, "127.0.0.2", data, infoHash)
+	good := newSeeder(t, data, infoHash)
+
+	ranges, err := ipfilter.Parse(strings.NewReader("Lab:127.0.0.2-127.0.0.2\n"))
+	require.Nil(t, err)
+
+	torrent := newTestTorrent(data, blocked, good)
+	torrent.Filter = ipfilter.New(ranges)
+
+	buf, err := torrent.Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, 0, blocked.acceptedConnections())
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	data := randomData(2 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// Accepts requests but never answers them
+	s := newSeeder(t, data, infoHash)
+	s.drop = func(index, begin int) bool { return true }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	buf, err := newTestTorrent(data, s).Download(ctx)
+
+	assert.Nil(t, buf)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// deadPeer returns an address nothing is listening on
+func deadPeer(t *testing.T) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestDownloadNoPeers(t *testing.T) {
+	defer func(d time.Duration) { peerWaitTimeout = d }(peerWaitTimeout)
+	peerWaitTimeout = 100 * time.Millisecond
+
+	data := randomData(testPieceLength)
+
+	torrent := newTestTorrent(data)
+	torrent.Peers = []peers.Peer{deadPeer(t)}
+
+	_, err := torrent.Download(context.Background())
+	assert.ErrorIs(t, err, ErrNoPeers)
+
+	// Still gives up when discovery is running but finds nothing
+	torrent.NewPeers = make(chan peers.Peer)
+	_, err = torrent.Download(context.Background())
+	assert.ErrorIs(t, err, ErrNoPeers)
+}
+
+func TestDownloadWaitsForNewPeers(t *testing.T) {
+	data := randomData(testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	s := newSeeder(t, data, infoHash)
+
+	newPeers := make(chan peers.Peer)
+	time.AfterFunc(100*time.Millisecond, func() { newPeers <- s.peer() })
+
+	torrent := newTestTorrent(data)
+	torrent.Peers = []peers.Peer{deadPeer(t)}
+	torrent.NewPeers = newPeers
+
+	buf, err := torrent.Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadMaxPeers(t *testing.T) {
+	data := randomData(2 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	a := newSeeder(t, data, infoHash)
+	b := newSeeder(t, data, infoHash)
+
+	// The second peer only gets a slot once the dead one has failed, and
+	// the third never does
+	torrent := newTestTorrent(data)
+	torrent.Peers = []peers.Peer{deadPeer(t), a.peer(), b.peer()}
+	torrent.MaxPeers = 1
+
+	buf, err := torrent.Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, 1, a.acceptedConnections())
+	assert.Equal(t, 0, b.acceptedConnections())
+}
@@ -0,0 +1,305 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"sync"
+)
+
+type blockState uint8
+
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// pieceState tracks the blocks of a piece being downloaded. Blocks of one
+// piece may be requested from several peers at once; each requested block
+// has a single owner, which is the only worker allowed to write it.
+type pieceState struct {
+	work     *PieceWork
+	buf      []byte
+	blocks   []blockState
+	owners   []*downloadWorker
+	sources  []*downloadWorker
+	received int
+
+	// After a hash failure with blocks from several peers the piece is
+	// downloaded again from a single peer on parole. Comparing its blocks
+	// with the suspects' identifies who sent the corrupt data.
+	onParole bool
+	parole   *downloadWorker
+	suspects []suspectBlock
+}
+
+type suspectBlock struct {
+	source *downloadWorker
+	hash   [20]byte
+}
+
+func newPieceState(pw *PieceWork) *pieceState {
+	numBlocks := (pw.length + MaxBlockSize - 1) / MaxBlockSize
+
+	return &pieceState{
+		work:    pw,
+		buf:     make([]byte, pw.length),
+		blocks:  make([]blockState, numBlocks),
+		owners:  make([]*downloadWorker, numBlocks),
+		sources: make([]*downloadWorker, numBlocks),
+	}
+}
+
+func (p *pieceState) blockBounds(block int) (begin, length int) {
+	begin = block * MaxBlockSize
+	length = MaxBlockSize
+
+	if p.work.length-begin < length {
+		length = p.work.length - begin
+	}
+
+	return begin, length
+}
+
+func (p *pieceState) blockHash(block int) [20]byte {
+	begin, length := p.blockBounds(block)
+	return sha1.Sum(p.buf[begin : begin+length])
+}
+
+func (p *pieceState) releaseOwnedBy(w *downloadWorker) {
+	for block, owner := range p.owners {
+		if owner == w {
+			p.blocks[block] = blockMissing
+			p.owners[block] = nil
+		}
+	}
+
+	if p.parole == w {
+		p.parole = nil
+	}
+}
+
+func (p *pieceState) reset() {
+	for block := range p.blocks {
+		p.blocks[block] = blockMissing
+		p.owners[block] = nil
+		p.sources[block] = nil
+	}
+	p.received = 0
+}
+
+// canReserve reports whether w may request blocks of this piece; a piece
+// on parole goes to the first peer that asks for it, and only that peer
+func (p *pieceState) canReserve(w *downloadWorker) bool {
+	if !p.onParole {
+		return true
+	}
+
+	if p.parole == nil {
+		p.parole = w
+	}
+	return p.parole == w
+}
+
+// culprits compares a verified piece with the blocks recorded before it
+// went on parole
+func (p *pieceState) culprits() []*downloadWorker {
+	var culprits []*downloadWorker
+	seen := make(map[*downloadWorker]bool)
+
+	for block, suspect := range p.suspects {
+		if suspect.source == nil || seen[suspect.source] {
+			continue
+		}
+
+		if p.blockHash(block) != suspect.hash {
+			seen[suspect.source] = true
+			culprits = append(culprits, suspect.source)
+		}
+	}
+
+	return culprits
+}
+
+func (p *picker) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.done == p.total
+}
+
+// release gives up w's request for a block, returning the block's length
+// if it was still w's
+func (p *picker) release(w *downloadWorker, index, begin int) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.find(index)
+	if state == nil {
+		return 0, false
+	}
+
+	block := begin / MaxBlockSize
+	if block >= len(state.blocks) || state.owners[block] != w {
+		return 0, false
+	}
+
+	state.blocks[block] = blockMissing
+	state.owners[block] = nil
+
+	_, length := state.blockBounds(block)
+	return length, true
+}
+
+// releaseAll returns every block w has requested to the pool, e.g. when w's
+// peer disconnects. Blocks already received are kept.
+func (p *picker) releaseAll(w *downloadWorker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, state := range p.started {
+		state.releaseOwnedBy(w)
+	}
+}
+
+// picker hands out blocks to workers. It is shared by every worker of a
+// download and keeps the block map of each started piece, so blocks that
+// were already received survive the peer that sent them disconnecting.
+type picker struct {
+	mu      sync.Mutex
+	pending []*PieceWork
+	started []*pieceState
+	done    int
+	total   int
+}
+
+func newPicker(works []*PieceWork) *picker {
+	return &picker{
+		pending: works,
+		total:   len(works),
+	}
+}
+
+// reserve assigns w a missing block it may request, preferring pieces that
+// are already started so they complete sooner
+func (p *picker) reserve(w *downloadWorker, canRequest func(index int) bool) (*pieceState, int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, state := range p.started {
+		if !canRequest(state.work.index) || !state.canReserve(w) {
+			continue
+		}
+
+		for block, bs := range state.blocks {
+			if bs == blockMissing {
+				state.blocks[block] = blockRequested
+				state.owners[block] = w
+				return state, block, true
+			}
+		}
+	}
+
+	for i, pw := range p.pending {
+		if !canRequest(pw.index) {
+			continue
+		}
+
+		p.pending = append(p.pending[:i], p.pending[i+1:]...)
+
+		state := newPieceState(pw)
+		p.started = append(p.started, state)
+
+		state.blocks[0] = blockRequested
+		state.owners[0] = w
+		return state, 0, true
+	}
+
+	return nil, 0, false
+}
+
+func (p *picker) find(index int) *pieceState {
+	for _, state := range p.started {
+		if state.work.index == index {
+			return state
+		}
+	}
+	return nil
+}
+
+// owned returns the piece and block for a block w requested, or nil if the
+// block is not w's to write
+func (p *picker) owned(w *downloadWorker, index, begin int) (*pieceState, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.find(index)
+	if state == nil || begin%MaxBlockSize != 0 {
+		return nil, 0
+	}
+
+	block := begin / MaxBlockSize
+	if block >= len(state.blocks) || state.blocks[block] != blockRequested || state.owners[block] != w {
+		return nil, 0
+	}
+
+	return state, block
+}
+
+// receive marks a block as written and reports whether every block of the
+// piece is now present and it is ready to be verified
+func (p *picker) receive(state *pieceState, block int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state.blocks[block] = blockReceived
+	state.sources[block] = state.owners[block]
+	state.owners[block] = nil
+	state.received++
+
+	return state.received == len(state.blocks)
+}
+
+// verified records the result of hashing a complete piece and returns the
+// workers found to have sent corrupt data. A piece that fails is downloaded
+// again from scratch.
+func (p *picker) verified(state *pieceState, ok bool) []*downloadWorker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		for i, s := range p.started {
+			if s == state {
+				p.started = append(p.started[:i], p.started[i+1:]...)
+				break
+			}
+		}
+		p.done++
+
+		return state.culprits()
+	}
+
+	var sources []*downloadWorker
+	seen := make(map[*downloadWorker]bool)
+	for _, source := range state.sources {
+		if !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+
+	var culprits []*downloadWorker
+
+	if len(sources) == 1 {
+		culprits = sources
+	} else if !state.onParole {
+		state.onParole = true
+		state.suspects = make([]suspectBlock, len(state.blocks))
+		for block, source := range state.sources {
+			state.suspects[block] = suspectBlock{source: source, hash: state.blockHash(block)}
+		}
+	}
+
+	state.parole = nil
+	state.reset()
+	return culprits
+}
@@ -0,0 +1,213 @@
+package p2p
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func allowAll(int) bool { return true }
+
+func TestPickerSharesPiecesAcrossWorkers(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 3, length: 2*MaxBlockSize + 100}})
+	a, b := &downloadWorker{}, &downloadWorker{}
+
+	state, block, ok := p.reserve(a, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, 0, block)
+
+	// A second worker joins the same piece and gets the next block
+	state2, block2, ok := p.reserve(b, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, state, state2)
+	assert.Equal(t, 1, block2)
+
+	_, block3, ok := p.reserve(b, allowAll)
+	require.True(t, ok)
+	begin, length := state.blockBounds(block3)
+	assert.Equal(t, 2*MaxBlockSize, begin)
+	assert.Equal(t, 100, length)
+
+	_, _, ok = p.reserve(a, allowAll)
+	assert.False(t, ok)
+
+	// Only the owner may write a block
+	owned, _ := p.owned(a, 3, MaxBlockSize)
+	assert.Nil(t, owned)
+	owned, _ = p.owned(b, 3, MaxBlockSize)
+	assert.Equal(t, state, owned)
+
+	assert.False(t, p.receive(state, 0))
+	assert.False(t, p.receive(state, 1))
+	assert.True(t, p.receive(state, 2))
+
+	assert.False(t, p.finished())
+	p.verified(state, true)
+	assert.True(t, p.finished())
+}
+
+func TestPickerPrefersStartedPieces(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 0, length: MaxBlockSize}, {index: 1, length: 2 * MaxBlockSize}})
+	a := &downloadWorker{}
+
+	state, _, ok := p.reserve(a, func(index int) bool { return index == 1 })
+	require.True(t, ok)
+	assert.Equal(t, 1, state.work.index)
+
+	state, block, ok := p.reserve(a, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, 1, state.work.index)
+	assert.Equal(t, 1, block)
+}
+
+func TestPickerKeepsBlocksAcrossDisconnect(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 0, length: 3 * MaxBlockSize}})
+	a, b := &downloadWorker{}, &downloadWorker{}
+
+	state, _, _ := p.reserve(a, allowAll)
+	p.reserve(a, allowAll)
+	p.reserve(a, allowAll)
+	p.receive(state, 0)
+
+	// a's peer disconnects with two blocks outstanding
+	p.releaseAll(a)
+
+	_, block, ok := p.reserve(b, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, 1, block)
+	_, block, ok = p.reserve(b, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, 2, block)
+
+	assert.False(t, p.receive(state, 1))
+	assert.True(t, p.receive(state, 2))
+}
+
+func TestPickerRelease(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 0, length: 2 * MaxBlockSize}})
+	a, b := &downloadWorker{}, &downloadWorker{}
+
+	p.reserve(a, allowAll)
+	p.reserve(a, allowAll)
+
+	// A timed out block goes back to the pool for anyone to take
+	length, ok := p.release(a, 0, MaxBlockSize)
+	assert.True(t, ok)
+	assert.Equal(t, MaxBlockSize, length)
+
+	_, ok = p.release(b, 0, 0)
+	assert.False(t, ok)
+
+	_, block, ok := p.reserve(b, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, 1, block)
+}
+
+func TestPickerFailedVerification(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 0, length: MaxBlockSize}})
+	a := &downloadWorker{}
+
+	state, _, _ := p.reserve(a, allowAll)
+	require.True(t, p.receive(state, 0))
+	p.verified(state, false)
+
+	state2, block, ok := p.reserve(a, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, state, state2)
+	assert.Equal(t, 0, block)
+	assert.False(t, p.finished())
+}
+
+func TestPickerConcurrentWorkers(t *testing.T) {
+	var works []*PieceWork
+	for i := 0; i < 20; i++ {
+		works = append(works, &PieceWork{index: i, length: 4 * MaxBlockSize})
+	}
+	p := newPicker(works)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &downloadWorker{}
+			for {
+				state, block, ok := p.reserve(w, allowAll)
+				if !ok {
+					return
+				}
+				if p.receive(state, block) {
+					p.verified(state, true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, p.finished())
+}
+
+func TestPickerBansSingleSource(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 0, length: 2 * MaxBlockSize}})
+	a := &downloadWorker{}
+
+	state, _, _ := p.reserve(a, allowAll)
+	p.reserve(a, allowAll)
+	p.receive(state, 0)
+	p.receive(state, 1)
+
+	assert.Equal(t, []*downloadWorker{a}, p.verified(state, false))
+	assert.False(t, state.onParole)
+}
+
+func TestPickerParole(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 0, length: 2 * MaxBlockSize}})
+	good, bad, trusted := &downloadWorker{}, &downloadWorker{}, &downloadWorker{}
+
+	state, _, _ := p.reserve(good, allowAll)
+	p.reserve(bad, allowAll)
+	copy(state.buf, []byte("good"))
+	copy(state.buf[MaxBlockSize:], []byte("corrupt"))
+	p.receive(state, 0)
+	p.receive(state, 1)
+
+	// Two sources: nobody can be blamed yet
+	assert.Empty(t, p.verified(state, false))
+	assert.True(t, state.onParole)
+
+	// The first peer to ask gets the whole piece to itself
+	_, block, ok := p.reserve(trusted, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, 0, block)
+	_, _, ok = p.reserve(good, allowAll)
+	assert.False(t, ok)
+	_, block, ok = p.reserve(trusted, allowAll)
+	require.True(t, ok)
+	assert.Equal(t, 1, block)
+
+	copy(state.buf, []byte("good"))
+	copy(state.buf[MaxBlockSize:], []byte("correct"))
+	p.receive(state, 0)
+	p.receive(state, 1)
+
+	assert.Equal(t, []*downloadWorker{bad}, p.verified(state, true))
+}
+
+func TestPickerParoleReleasedOnDisconnect(t *testing.T) {
+	p := newPicker([]*PieceWork{{index: 0, length: 2 * MaxBlockSize}})
+	a, b, c := &downloadWorker{}, &downloadWorker{}, &downloadWorker{}
+
+	state, _, _ := p.reserve(a, allowAll)
+	p.reserve(b, allowAll)
+	p.receive(state, 0)
+	p.receive(state, 1)
+	p.verified(state, false)
+
+	p.reserve(c, allowAll)
+	p.releaseAll(c)
+
+	_, _, ok := p.reserve(a, allowAll)
+	assert.True(t, ok)
+}
@@ -0,0 +1,160 @@
+package p2p
+
+import (
+	"math"
+	"time"
+)
+
+// InitialBacklog is the number of requests kept outstanding to a peer
+// before its rate and round-trip time have been measured
+const InitialBacklog = 5
+
+const MinBacklog = 2
+const MaxBacklog = 500
+
+const rateWindow = 500 * time.Millisecond
+
+// Fraction of each new rate sample blended into the estimate
+const rateSmoothing = 0.3
+
+type blockKey struct {
+	index int
+	begin int
+}
+
+// requestQueue sizes the number of outstanding requests to a peer so that
+// roughly twice the delay-bandwidth product is in flight: the measured rate
+// times the smallest observed round trip. Using the minimum RTT keeps the
+// peer's own queueing delay from inflating the target.
+type requestQueue struct {
+	reqq int
+	sent map[blockKey]time.Time
+
+	minRTT      time.Duration
+	rate        float64
+	windowStart time.Time
+	windowBytes int
+
+	now func() time.Time
+}
+
+func newRequestQueue(reqq int) *requestQueue {
+	return &requestQueue{
+		reqq: reqq,
+		sent: make(map[blockKey]time.Time),
+		now:  time.Now,
+	}
+}
+
+func (q *requestQueue) outstanding() int {
+	return len(q.sent)
+}
+
+func (q *requestQueue) target() int {
+	limit := MaxBacklog
+	if q.reqq > 0 && q.reqq < limit {
+		limit = q.reqq
+	}
+
+	target := InitialBacklog
+	if q.rate > 0 && q.minRTT > 0 {
+		bdp := q.rate * q.minRTT.Seconds() / MaxBlockSize
+		target = int(math.Ceil(2*bdp)) + 1
+	}
+
+	if target < MinBacklog {
+		target = MinBacklog
+	}
+	if target > limit {
+		target = limit
+	}
+
+	return target
+}
+
+func (q *requestQueue) requested(index, begin int) {
+	now := q.now()
+	if q.windowStart.IsZero() {
+		q.windowStart = now
+	}
+	q.sent[blockKey{index, begin}] = now
+}
+
+// received records the arrival of a block and reports whether it was one
+// we were waiting for
+func (q *requestQueue) received(index, begin, n int) bool {
+	key := blockKey{index, begin}
+
+	sentAt, ok := q.sent[key]
+	if !ok {
+		return false
+	}
+	delete(q.sent, key)
+
+	now := q.now()
+
+	rtt := now.Sub(sentAt)
+	if rtt > 0 && (q.minRTT == 0 || rtt < q.minRTT) {
+		q.minRTT = rtt
+	}
+
+	q.windowBytes += n
+	elapsed := now.Sub(q.windowStart)
+	if elapsed >= rateWindow {
+		sample := float64(q.windowBytes) / elapsed.Seconds()
+		if q.rate == 0 {
+			q.rate = sample
+		} else {
+			q.rate = (1-rateSmoothing)*q.rate + rateSmoothing*sample
+		}
+		q.windowStart = now
+		q.windowBytes = 0
+	}
+
+	return true
+}
+
+// oldest returns when the longest-outstanding request was sent
+func (q *requestQueue) oldest() (time.Time, bool) {
+	var oldest time.Time
+	for _, sentAt := range q.sent {
+		if oldest.IsZero() || sentAt.Before(oldest) {
+			oldest = sentAt
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// expired returns the requests outstanding for longer than timeout
+func (q *requestQueue) expired(timeout time.Duration) []blockKey {
+	now := q.now()
+
+	var expired []blockKey
+	for key, sentAt := range q.sent {
+		if now.Sub(sentAt) >= timeout {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+func (q *requestQueue) cancel(index, begin int) {
+	delete(q.sent, blockKey{index, begin})
+}
+
+// cancelPiece forgets the outstanding requests for a piece we gave up on
+func (q *requestQueue) cancelPiece(index int) {
+	for key := range q.sent {
+		if key.index == index {
+			delete(q.sent, key)
+		}
+	}
+}
+
+// clear forgets every outstanding request, as when a peer without the Fast
+// extension chokes us
+func (q *requestQueue) clear() {
+	q.sent = make(map[blockKey]time.Time)
+	q.windowStart = time.Time{}
+	q.windowBytes = 0
+}
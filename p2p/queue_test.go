@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestQueueTarget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := newRequestQueue(0)
+	q.now = func() time.Time { return now }
+
+	assert.Equal(t, InitialBacklog, q.target())
+
+	// 64 blocks per second over a 100ms round trip: 1 MiB/s * 0.1s = 6.4 blocks
+	for i := 0; i < 64; i++ {
+		q.requested(0, i*MaxBlockSize)
+		now = now.Add(100 * time.Millisecond)
+		assert.True(t, q.received(0, i*MaxBlockSize, MaxBlockSize))
+		now = now.Add(-100*time.Millisecond + time.Second/64)
+	}
+
+	// Twice the delay-bandwidth product plus one, allowing for the smoothing
+	assert.InDelta(t, 15, q.target(), 2)
+	assert.Equal(t, 0, q.outstanding())
+}
+
+func TestRequestQueueRespectsReqq(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := newRequestQueue(8)
+	q.now = func() time.Time { return now }
+
+	// A fast peer with a 200ms round trip would otherwise get hundreds of requests
+	for i := 0; i < 1000; i++ {
+		q.requested(0, i)
+	}
+	now = now.Add(200 * time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		now = now.Add(time.Millisecond)
+		q.received(0, i, MaxBlockSize)
+	}
+
+	assert.Equal(t, 8, q.target())
+}
+
+func TestRequestQueueCancel(t *testing.T) {
+	q := newRequestQueue(0)
+
+	q.requested(1, 0)
+	q.requested(1, MaxBlockSize)
+	q.requested(2, 0)
+	assert.Equal(t, 3, q.outstanding())
+
+	q.cancelPiece(1)
+	assert.Equal(t, 1, q.outstanding())
+	assert.False(t, q.received(1, 0, MaxBlockSize))
+
+	q.clear()
+	assert.Equal(t, 0, q.outstanding())
+	assert.False(t, q.received(2, 0, MaxBlockSize))
+}
@@ -0,0 +1,242 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/bitfield"
+	"github.com/prabal199251/Torrent-Client/handshake"
+	"github.com/prabal199251/Torrent-Client/message"
+	"github.com/prabal199251/Torrent-Client/peers"
+)
+
+// handshakeTimeout bounds how long an inbound peer may take to introduce
+// itself
+const handshakeTimeout = 10 * time.Second
+
+// Seed uploads the complete torrent in data to peers that connect through
+// ln, until ctx is cancelled. Every peer is unchoked.
+func (t *Torrent) Seed(ctx context.Context, ln net.Listener, data io.ReaderAt) error {
+	if t.Bans == nil {
+		t.Bans = NewBanList()
+	}
+
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var mu sync.Mutex
+	active := 0
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		mu.Lock()
+		full := t.MaxPeers > 0 && active >= t.MaxPeers
+		if !full {
+			full = !t.Conns.TryAcquire()
+		}
+		if !full {
+			active++
+		}
+		mu.Unlock()
+
+		if full {
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := t.serveUpload(ctx, conn, data)
+			if err != nil && ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				log.Printf("Stopped uploading to %s: %v\n", conn.RemoteAddr(), err)
+			}
+
+			mu.Lock()
+			active--
+			t.Conns.Release()
+			mu.Unlock()
+		}()
+	}
+}
+
+func (t *Torrent) serveUpload(ctx context.Context, conn net.Conn, data io.ReaderAt) error {
+	if t.blocked(conn) {
+		conn.Close()
+		return fmt.Errorf("peer is filtered or banned")
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	res, err := handshake.Read(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	return t.ServePeer(ctx, conn, res, data)
+}
+
+func (t *Torrent) blocked(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && (t.Filter.Blocked(addr.IP) || t.Bans.Banned(addr.IP))
+}
+
+// ServePeer uploads the complete torrent in data to a peer that connected
+// to us and whose handshake res has already been read, e.g. by a listener
+// shared between torrents. It closes conn when done.
+func (t *Torrent) ServePeer(ctx context.Context, conn net.Conn, res *handshake.Handshake, data io.ReaderAt) error {
+	return t.servePeer(ctx, conn, res, data, nil)
+}
+
+// ServePeer is Torrent.ServePeer for the handle's torrent, e.g. to seed
+// what the handle downloaded. The upload counts in the handle's Stats, and
+// the peer is reported on Events while the download runs.
+func (h *Handle) ServePeer(ctx context.Context, conn net.Conn, res *handshake.Handshake, data io.ReaderAt) error {
+	return h.torrent.servePeer(ctx, conn, res, data, h)
+}
+
+// servePeer uploads to a peer. h, if set, is told of the peer and counts
+// what it is sent.
+func (t *Torrent) servePeer(ctx context.Context, conn net.Conn, res *handshake.Handshake, data io.ReaderAt, h *Handle) (err error) {
+	conn = t.throttle(conn)
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if t.blocked(conn) {
+		return fmt.Errorf("peer is filtered or banned")
+	}
+
+	if res.InfoHash != t.InfoHash {
+		return fmt.Errorf("unknown infohash %x", res.InfoHash)
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	_, err = conn.Write(handshake.New(t.InfoHash, t.PeerID).Serialize())
+	if err != nil {
+		return err
+	}
+
+	numPieces := len(t.PieceHashes)
+	fast := res.SupportsFast()
+
+	have := &message.Message{ID: message.MsgHaveAll}
+	if !fast {
+		bf := make(bitfield.Bitfield, (numPieces+7)/8)
+		for i := 0; i < numPieces; i++ {
+			bf.SetPiece(i)
+		}
+		have = &message.Message{ID: message.MsgBitfield, PayLoad: bf}
+	}
+
+	_, err = conn.Write(have.Serialize())
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+	if err != nil {
+		return err
+	}
+
+	var pc *peerConn
+	if h != nil {
+		pc = &peerConn{peer: remotePeer(conn), down: newRateMeter(), up: newRateMeter()}
+		h.connected(pc)
+
+		defer func() {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				h.disconnected(pc, nil)
+			} else {
+				h.disconnected(pc, err)
+			}
+		}()
+	}
+
+	limits := message.NewLimits(numPieces)
+	block := make([]byte, MaxBlockSize)
+
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+
+		msg, err := message.ReadLimited(conn, limits)
+		if err != nil {
+			return err
+		}
+
+		if msg == nil || msg.ID != message.MsgRequest {
+			continue
+		}
+
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		if !t.validRequest(index, begin, length) {
+			if !fast {
+				return &message.ProtocolError{Reason: fmt.Sprintf("invalid request %d:%d+%d", index, begin, length)}
+			}
+
+			_, err = conn.Write(message.FormatReject(index, begin, length).Serialize())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = data.ReadAt(block[:length], int64(index*t.PieceLength+begin))
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write(message.FormatPiece(index, begin, block[:length]).Serialize())
+		if err != nil {
+			return err
+		}
+
+		if pc != nil {
+			pc.up.add(length)
+			h.up.add(length)
+		}
+	}
+}
+
+// remotePeer is the address conn is connected to
+func remotePeer(conn net.Conn) peers.Peer {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return peers.Peer{}
+	}
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (t *Torrent) validRequest(index, begin, length int) bool {
+	if index < 0 || index >= len(t.PieceHashes) {
+		return false
+	}
+	if length <= 0 || length > MaxBlockSize || begin < 0 {
+		return false
+	}
+	return begin+length <= t.calculatePieceSize(index)
+}
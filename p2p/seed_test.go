@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/handshake"
+	"github.com/prabal199251/Torrent-Client/message"
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startSeed(t *testing.T, data []byte) (*Torrent, peers.Peer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	torrent := newTestTorrent(data)
+	torrent.PeerID = [20]byte{9, 9, 9}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- torrent.Seed(ctx, ln, bytes.NewReader(data)) }()
+
+	t.Cleanup(func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	})
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return torrent, peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestSeed(t *testing.T) {
+	data := randomData(3*testPieceLength + 100)
+	_, peer := startSeed(t, data)
+
+	torrent := newTestTorrent(data)
+	torrent.Peers = []peers.Peer{peer}
+
+	buf, err := torrent.Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestSeedRejectsInvalidRequests(t *testing.T) {
+	data := randomData(2 * testPieceLength)
+	seed, peer := startSeed(t, data)
+
+	conn, err := net.Dial("tcp", peer.String())
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write(handshake.New(seed.InfoHash, [20]byte{1}).Serialize())
+	require.Nil(t, err)
+
+	res, err := handshake.Read(conn)
+	require.Nil(t, err)
+	assert.Equal(t, seed.PeerID, res.PeerID)
+
+	msg, err := message.Read(conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgHaveAll, msg.ID)
+
+	msg, err = message.Read(conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgUnchoke, msg.ID)
+
+	tests := map[string][3]int{
+		"piece out of range":  {2, 0, MaxBlockSize},
+		"block too long":      {0, 0, MaxBlockSize + 1},
+		"past end of piece":   {1, testPieceLength - 10, 20},
+		"zero length request": {0, 0, 0},
+	}
+
+	for name, req := range tests {
+		_, err = conn.Write(message.FormatRequest(req[0], req[1], req[2]).Serialize())
+		require.Nil(t, err, name)
+
+		msg, err = message.Read(conn)
+		require.Nil(t, err, name)
+		assert.Equal(t, message.FormatReject(req[0], req[1], req[2]), msg, name)
+	}
+
+	_, err = conn.Write(message.FormatRequest(1, MaxBlockSize, 100).Serialize())
+	require.Nil(t, err)
+
+	msg, err = message.Read(conn)
+	require.Nil(t, err)
+	offset := testPieceLength + MaxBlockSize
+	assert.Equal(t, message.FormatPiece(1, MaxBlockSize, data[offset:offset+100]), msg)
+}
+
+func TestSeedRefusesUnknownInfoHash(t *testing.T) {
+	_, peer := startSeed(t, randomData(testPieceLength))
+
+	conn, err := net.Dial("tcp", peer.String())
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write(handshake.New([20]byte{4, 5, 6}, [20]byte{1}).Serialize())
+	require.Nil(t, err)
+
+	_, err = handshake.Read(conn)
+	assert.NotNil(t, err)
+}
+
+func TestHandleServePeer(t *testing.T) {
+	data := randomData(3*testPieceLength + 100)
+	infoHash := [20]byte{1, 2, 3}
+
+	s := newSeeder(t, data, infoHash)
+	torrent := newTestTorrent(data, s)
+	torrent.Storage = make(memoryStorage, len(data))
+
+	h := torrent.Start(context.Background())
+	require.Nil(t, h.Wait())
+
+	// Seed what was downloaded through the handle
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		res, err := handshake.Read(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		h.ServePeer(context.Background(), conn, res, bytes.NewReader(data))
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	leecher := newTestTorrent(data)
+	leecher.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+
+	buf, err := leecher.Download(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	require.Eventually(t, func() bool {
+		return h.Stats().Uploaded == int64(len(data))
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(len(data)), h.Stats().Downloaded)
+}
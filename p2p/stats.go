@@ -0,0 +1,237 @@
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/bitfield"
+	"github.com/prabal199251/Torrent-Client/peers"
+)
+
+// Event is anything reported on a Handle's event stream: a StateEvent,
+// PieceEvent, PeerEvent or BanEvent
+type Event interface {
+	event()
+}
+
+func (StateEvent) event() {}
+func (PieceEvent) event() {}
+func (PeerEvent) event()  {}
+func (BanEvent) event()   {}
+
+// PieceEvent reports a piece verified and written to storage
+type PieceEvent struct {
+	Index int
+	Done  int
+	Total int
+}
+
+// PeerEvent reports a peer connecting or disconnecting. Err says why a
+// disconnected peer was dropped, and is nil if we simply no longer needed
+// it.
+type PeerEvent struct {
+	Peer      peers.Peer
+	Connected bool
+	Err       error
+}
+
+// Stats is a snapshot of a download. Rates are in bytes per second.
+type Stats struct {
+	State State
+
+	PiecesDone  int
+	PiecesTotal int
+	// Pieces marks the pieces written to storage
+	Pieces     bitfield.Bitfield
+	BytesDone  int64
+	BytesTotal int64
+
+	Downloaded   int64
+	Uploaded     int64
+	DownloadRate float64
+	UploadRate   float64
+
+	// Peers counts connected peers, Seeds those that have every piece,
+	// Choked those choking us and Interested those interested in us
+	Peers      int
+	Seeds      int
+	Choked     int
+	Interested int
+	PeerStats  []PeerStats
+	// Dropped lists the peers given up on and why
+	Dropped []DroppedPeer
+
+	// ETA is the expected time left at the current rate, or 0 if unknown
+	ETA time.Duration
+}
+
+type PeerStats struct {
+	Peer   peers.Peer
+	Client string
+
+	Downloaded   int64
+	Uploaded     int64
+	DownloadRate float64
+	UploadRate   float64
+
+	// Progress is the fraction of pieces the peer has
+	Progress float64
+	// Choked is set while the peer chokes us, Interested while it is
+	// interested in us
+	Choked     bool
+	Interested bool
+	Fast       bool
+	Requests   int
+}
+
+// rateMeter counts bytes and estimates their rate over time
+type rateMeter struct {
+	mu          sync.Mutex
+	total       int64
+	rate        float64
+	windowStart time.Time
+	windowBytes int64
+
+	now func() time.Time
+}
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{now: time.Now}
+}
+
+func (m *rateMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll()
+	m.total += int64(n)
+	m.windowBytes += int64(n)
+}
+
+// read returns the byte count and current rate
+func (m *rateMeter) read() (int64, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll()
+	return m.total, m.rate
+}
+
+// roll folds each finished window into the rate, so an idle meter decays
+// towards zero
+func (m *rateMeter) roll() {
+	now := m.now()
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+		return
+	}
+
+	elapsed := now.Sub(m.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+
+	sample := float64(m.windowBytes) / elapsed.Seconds()
+	if m.rate == 0 {
+		m.rate = sample
+	} else {
+		m.rate = (1-rateSmoothing)*m.rate + rateSmoothing*sample
+	}
+
+	m.windowStart = now
+	m.windowBytes = 0
+}
+
+// peerConn is the part of a worker's state visible outside its goroutine
+type peerConn struct {
+	peer peers.Peer
+	down *rateMeter
+	up   *rateMeter
+
+	mu         sync.Mutex
+	client     string
+	progress   float64
+	seed       bool
+	choked     bool
+	interested bool
+	fast       bool
+	requests   int
+}
+
+func (c *peerConn) stats() PeerStats {
+	downloaded, downRate := c.down.read()
+	uploaded, upRate := c.up.read()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return PeerStats{
+		Peer:         c.peer,
+		Client:       c.client,
+		Downloaded:   downloaded,
+		Uploaded:     uploaded,
+		DownloadRate: downRate,
+		UploadRate:   upRate,
+		Progress:     c.progress,
+		Choked:       c.choked,
+		Interested:   c.interested,
+		Fast:         c.fast,
+		Requests:     c.requests,
+	}
+}
+
+func (h *Handle) Stats() Stats {
+	downloaded, downRate := h.down.read()
+	uploaded, upRate := h.up.read()
+
+	h.mu.Lock()
+	s := Stats{
+		State:        h.state,
+		PiecesDone:   h.written,
+		PiecesTotal:  len(h.torrent.PieceHashes),
+		BytesDone:    h.bytesWritten,
+		BytesTotal:   int64(h.torrent.Length),
+		Downloaded:   downloaded,
+		Uploaded:     uploaded,
+		DownloadRate: downRate,
+		UploadRate:   upRate,
+		Pieces:       append(bitfield.Bitfield(nil), h.have...),
+		Dropped:      h.manager.droppedPeers(),
+	}
+	conns := make([]*peerConn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range conns {
+		ps := c.stats()
+		s.PeerStats = append(s.PeerStats, ps)
+
+		c.mu.Lock()
+		seed := c.seed
+		c.mu.Unlock()
+
+		if seed {
+			s.Seeds++
+		}
+		if ps.Choked {
+			s.Choked++
+		}
+		if ps.Interested {
+			s.Interested++
+		}
+	}
+	s.Peers = len(conns)
+
+	sort.Slice(s.PeerStats, func(i, j int) bool {
+		return s.PeerStats[i].DownloadRate > s.PeerStats[j].DownloadRate
+	})
+
+	if remaining := s.BytesTotal - s.BytesDone; remaining > 0 && s.DownloadRate > 0 {
+		s.ETA = time.Duration(float64(remaining) / s.DownloadRate * float64(time.Second))
+	}
+
+	return s
+}
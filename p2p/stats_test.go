@@ -0,0 +1,102 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateMeter(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := newRateMeter()
+	m.now = func() time.Time { return now }
+
+	m.add(0)
+	for i := 0; i < 100; i++ {
+		now = now.Add(100 * time.Millisecond)
+		m.add(10000)
+	}
+
+	total, rate := m.read()
+	assert.Equal(t, int64(1000000), total)
+	assert.InEpsilon(t, 100000, rate, 0.01)
+
+	// An idle meter decays
+	now = now.Add(time.Second)
+	_, idle := m.read()
+	assert.Less(t, idle, rate)
+}
+
+func TestHandleStats(t *testing.T) {
+	data := randomData(4 * testPieceLength)
+	infoHash := [20]byte{1, 2, 3}
+
+	// Holds back the last two pieces until the gate opens
+	open := make(chan struct{})
+	s := newSeeder(t, data, infoHash)
+	s.wait = func(index, begin int) {
+		if index >= 2 {
+			<-open
+		}
+	}
+
+	torrent := newTestTorrent(data, s)
+	torrent.Storage = make(memoryStorage, len(data))
+
+	h := torrent.Start(context.Background())
+
+	require.Eventually(t, func() bool {
+		return h.Stats().PiecesDone == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := h.Stats()
+	assert.Equal(t, StateDownloading, stats.State)
+	assert.Equal(t, 4, stats.PiecesTotal)
+	assert.Equal(t, int64(2*testPieceLength), stats.BytesDone)
+	assert.Equal(t, int64(len(data)), stats.BytesTotal)
+	assert.Equal(t, int64(2*testPieceLength), stats.Downloaded)
+	assert.True(t, stats.Pieces.HasPiece(1))
+	assert.False(t, stats.Pieces.HasPiece(2))
+	assert.Equal(t, 1, stats.Peers)
+	assert.Equal(t, 1, stats.Seeds)
+	assert.Equal(t, 0, stats.Choked)
+
+	require.Len(t, stats.PeerStats, 1)
+	assert.Equal(t, s.peer(), stats.PeerStats[0].Peer)
+	assert.Equal(t, 1.0, stats.PeerStats[0].Progress)
+	assert.True(t, stats.PeerStats[0].Fast)
+
+	close(open)
+	require.Nil(t, h.Wait())
+
+	var pieces []PieceEvent
+	var peerEvents []PeerEvent
+	for e := range h.Events() {
+		switch e := e.(type) {
+		case PieceEvent:
+			pieces = append(pieces, e)
+		case PeerEvent:
+			peerEvents = append(peerEvents, e)
+		}
+	}
+
+	require.Len(t, pieces, 4)
+	for i, p := range pieces {
+		assert.Equal(t, i+1, p.Done)
+		assert.Equal(t, 4, p.Total)
+	}
+
+	require.Len(t, peerEvents, 2)
+	assert.True(t, peerEvents[0].Connected)
+	assert.False(t, peerEvents[1].Connected)
+	assert.Nil(t, peerEvents[1].Err)
+
+	stats = h.Stats()
+	assert.Equal(t, StateCompleted, stats.State)
+	assert.Equal(t, int64(len(data)), stats.Downloaded)
+	assert.Equal(t, 0, stats.Peers)
+	assert.Equal(t, time.Duration(0), stats.ETA)
+}
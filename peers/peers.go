@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 )
 
@@ -36,3 +37,17 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
+
+// IsLAN reports whether the peer is on a private, loopback or link-local
+// address, where transfers are cheap and fast.
+func (p Peer) IsLAN() bool {
+	return p.IP.IsPrivate() || p.IP.IsLoopback() || p.IP.IsLinkLocalUnicast()
+}
+
+// SortLANFirst orders LAN peers ahead of the rest, otherwise keeping the
+// original order.
+func SortLANFirst(peers []Peer) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].IsLAN() && !peers[j].IsLAN()
+	})
+}
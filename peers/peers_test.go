@@ -54,4 +54,22 @@ func TestString(t *testing.T) {
 		s := test.input.String()
 		assert.Equal(t, test.output, s)
 	}
-}
\ No newline at end of file
+}
+
+func TestSortLANFirst(t *testing.T) {
+	input := []Peer{
+		{IP: net.IP{8, 8, 8, 8}, Port: 1},
+		{IP: net.IP{192, 168, 1, 5}, Port: 2},
+		{IP: net.IP{1, 1, 1, 1}, Port: 3},
+		{IP: net.IP{10, 0, 0, 7}, Port: 4},
+	}
+	expected := []Peer{
+		{IP: net.IP{192, 168, 1, 5}, Port: 2},
+		{IP: net.IP{10, 0, 0, 7}, Port: 4},
+		{IP: net.IP{8, 8, 8, 8}, Port: 1},
+		{IP: net.IP{1, 1, 1, 1}, Port: 3},
+	}
+
+	SortLANFirst(input)
+	assert.Equal(t, expected, input)
+}
@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Reads and writes are split into chunks of at most maxChunk bytes, so
+// connections sharing a limiter take turns rather than one of them
+// reserving a long stretch of it. Slow limits use smaller chunks, down to
+// minChunk, to keep each wait short.
+const (
+	maxChunk = 16 << 10
+	minChunk = 512
+)
+
+// Conn throttles a connection with a limiter per level: its own, then
+// those it shares, e.g. with the other peers of its torrent and then with
+// every torrent of a session. Each read or write waits for the slowest
+// level.
+type Conn struct {
+	net.Conn
+	clock Clock
+
+	own     *Limits
+	perConn *PerConn
+	down    []*Limiter
+	up      []*Limiter
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewConn throttles conn. perConn, if set, gives the connection limits of
+// its own; levels are the limits it shares, and may be nil.
+func NewConn(conn net.Conn, perConn *PerConn, levels ...*Limits) *Conn {
+	return newConn(conn, systemClock{}, perConn, levels...)
+}
+
+func newConn(conn net.Conn, clock Clock, perConn *PerConn, levels ...*Limits) *Conn {
+	c := &Conn{
+		Conn:    conn,
+		clock:   clock,
+		perConn: perConn,
+		closed:  make(chan struct{}),
+	}
+
+	c.own = perConn.add()
+
+	for _, l := range append([]*Limits{c.own}, levels...) {
+		if down := l.download(); down != nil {
+			c.down = append(c.down, down)
+		}
+		if up := l.upload(); up != nil {
+			c.up = append(c.up, up)
+		}
+	}
+
+	return c
+}
+
+// chunk is how many bytes to read or write at once
+func chunk(limiters []*Limiter, n int) int {
+	n = min(n, maxChunk)
+
+	for _, l := range limiters {
+		// A tenth of a second's worth
+		if rate := int(l.Rate() / 10); rate > 0 {
+			n = min(n, max(rate, minChunk))
+		}
+	}
+
+	return n
+}
+
+// wait reserves n bytes from each limiter and waits for the slowest. It
+// returns false if the connection was closed in the meantime.
+func (c *Conn) wait(limiters []*Limiter, n int) bool {
+	var delay time.Duration
+	for _, l := range limiters {
+		delay = max(delay, l.reserve(n))
+	}
+
+	if delay <= 0 {
+		return true
+	}
+
+	select {
+	case <-c.clock.After(delay):
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// Read reads first and waits afterwards, as we cannot know how much the
+// peer will send
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.down) > 0 && len(p) > 0 {
+		p = p[:chunk(c.down, len(p))]
+	}
+
+	n, err := c.Conn.Read(p)
+
+	if n > 0 && len(c.down) > 0 && !c.wait(c.down, n) && err == nil {
+		err = net.ErrClosed
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if len(c.up) == 0 {
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for written < len(p) {
+		n := chunk(c.up, len(p)-written)
+
+		if !c.wait(c.up, n) {
+			return written, net.ErrClosed
+		}
+
+		n, err := c.Conn.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Limits are the connection's own limits, or nil if it has none
+func (c *Conn) Limits() *Limits {
+	return c.own
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.perConn.remove(c.own)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,225 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// endlessConn reads and writes as fast as it is asked to
+type endlessConn struct {
+	net.Conn
+}
+
+func (endlessConn) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (endlessConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (endlessConn) Close() error {
+	return nil
+}
+
+// counter runs a read or write over and over, counting the bytes
+type counter struct {
+	bytes atomic.Int64
+	op    func([]byte) (int, error)
+}
+
+func reads(c *Conn) *counter {
+	return &counter{op: c.Read}
+}
+
+func writes(c *Conn) *counter {
+	return &counter{op: c.Write}
+}
+
+// simulate runs the counters for d on the fake clock. The clock only moves
+// once every counter is waiting on it.
+func simulate(clock *fakeClock, d time.Duration, counters ...*counter) {
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+
+	for _, c := range counters {
+		wg.Add(1)
+		go func(c *counter) {
+			defer wg.Done()
+
+			buf := make([]byte, 1<<10)
+			for !stop.Load() {
+				n, _ := c.op(buf)
+				c.bytes.Add(int64(n))
+			}
+		}(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	end := clock.Now().Add(d)
+	for {
+		if !clock.Now().Before(end) {
+			stop.Store(true)
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if clock.waiting() < len(counters) && !stop.Load() {
+			time.Sleep(10 * time.Microsecond)
+			continue
+		}
+
+		if clock.waiting() > 0 {
+			clock.advance(clock.next())
+		} else {
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+}
+
+// measure runs the counters for d once the limiters have settled, i.e.
+// spent the second's worth they start with
+func measure(clock *fakeClock, d time.Duration, counters ...*counter) {
+	simulate(clock, 5*time.Second, counters...)
+
+	for _, c := range counters {
+		c.bytes.Store(0)
+	}
+
+	simulate(clock, d, counters...)
+}
+
+// assertRate checks that about rate bytes a second went through in d
+func assertRate(t *testing.T, rate int64, d time.Duration, got int64, msgAndArgs ...interface{}) {
+	assert.InEpsilon(t, float64(rate)*d.Seconds(), float64(got), 0.02, msgAndArgs...)
+}
+
+func TestConnRead(t *testing.T) {
+	clock := newFakeClock()
+	limits := newLimits(10000, 0, clock)
+
+	c := reads(newConn(endlessConn{}, clock, nil, limits))
+	measure(clock, 30*time.Second, c)
+
+	assertRate(t, 10000, 30*time.Second, c.bytes.Load())
+}
+
+func TestConnWrite(t *testing.T) {
+	clock := newFakeClock()
+	limits := newLimits(0, 10000, clock)
+
+	c := writes(newConn(endlessConn{}, clock, nil, limits))
+	measure(clock, 30*time.Second, c)
+
+	assertRate(t, 10000, 30*time.Second, c.bytes.Load())
+}
+
+func TestConnFairSharing(t *testing.T) {
+	clock := newFakeClock()
+	session := newLimits(30000, 0, clock)
+
+	a := reads(newConn(endlessConn{}, clock, nil, session))
+	b := reads(newConn(endlessConn{}, clock, nil, session))
+	c := reads(newConn(endlessConn{}, clock, nil, session))
+	measure(clock, 30*time.Second, a, b, c)
+
+	for _, conn := range []*counter{a, b, c} {
+		assertRate(t, 10000, 30*time.Second, conn.bytes.Load())
+	}
+}
+
+func TestConnLevels(t *testing.T) {
+	clock := newFakeClock()
+	session := newLimits(10000, 0, clock)
+	torrent := newLimits(5000, 0, clock)
+	peer := NewPerConn(1000, 0)
+	peer.clock = clock
+
+	// The peer limit holds one connection back, and the others share what
+	// is left of the torrent's limit
+	slow := reads(newConn(endlessConn{}, clock, peer, torrent, session))
+	a := reads(newConn(endlessConn{}, clock, nil, torrent, session))
+	b := reads(newConn(endlessConn{}, clock, nil, torrent, session))
+	// Another torrent takes the rest of the session's limit
+	other := reads(newConn(endlessConn{}, clock, nil, nil, session))
+	measure(clock, 30*time.Second, slow, a, b, other)
+
+	assertRate(t, 1000, 30*time.Second, slow.bytes.Load())
+	assertRate(t, 2000, 30*time.Second, a.bytes.Load())
+	assertRate(t, 2000, 30*time.Second, b.bytes.Load())
+	assertRate(t, 5000, 30*time.Second, other.bytes.Load())
+}
+
+func TestConnSetRate(t *testing.T) {
+	clock := newFakeClock()
+	limits := newLimits(10000, 0, clock)
+	peer := NewPerConn(0, 0)
+	peer.clock = clock
+
+	conn := newConn(endlessConn{}, clock, peer, limits)
+
+	c := reads(conn)
+	measure(clock, 30*time.Second, c)
+	assertRate(t, 10000, 30*time.Second, c.bytes.Load())
+
+	// Lowering the limit takes effect on the open connection
+	limits.Set(4000, 0)
+	measure(clock, 30*time.Second, c)
+	assertRate(t, 4000, 30*time.Second, c.bytes.Load())
+
+	peer.Set(1000, 0)
+	assert.Equal(t, int64(1000), conn.Limits().Download.Rate())
+	measure(clock, 30*time.Second, c)
+	assertRate(t, 1000, 30*time.Second, c.bytes.Load())
+}
+
+func TestConnClose(t *testing.T) {
+	clock := newFakeClock()
+	peer := NewPerConn(0, 1000)
+	peer.clock = clock
+
+	conn := newConn(endlessConn{}, clock, peer)
+
+	// The first second's worth is free; the next write has to wait
+	n, err := conn.Write(make([]byte, 1000))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, n)
+
+	result := make(chan error)
+	go func() {
+		_, err := conn.Write(make([]byte, 1000))
+		result <- err
+	}()
+
+	assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+	conn.Close()
+	assert.ErrorIs(t, <-result, net.ErrClosed)
+
+	// The closed connection no longer follows changes to the limits
+	peer.Set(0, 5000)
+	assert.Equal(t, int64(1000), conn.Limits().Upload.Rate())
+}
+
+func TestNewConnUnlimited(t *testing.T) {
+	clock := newFakeClock()
+	c := reads(newConn(endlessConn{}, clock, nil, nil))
+
+	n, err := c.op(make([]byte, 1<<20))
+	assert.Nil(t, err)
+	assert.Equal(t, 1<<20, n)
+	assert.Equal(t, 0, clock.waiting())
+}
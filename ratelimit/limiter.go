@@ -0,0 +1,224 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time. Tests use a fake one to control time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Limiter is a token bucket of bytes. Callers reserve bytes and wait until
+// the bucket has paid for them, so waiting connections are served in the
+// order they asked. A nil Limiter, or one with a rate of 0, places no limit.
+type Limiter struct {
+	clock Clock
+
+	mu sync.Mutex
+	// rate is in bytes per second; the bucket holds one second of it
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter limits to rate bytes per second; 0 means no limit
+func NewLimiter(rate int64) *Limiter {
+	return newLimiter(rate, systemClock{})
+}
+
+func newLimiter(rate int64, clock Clock) *Limiter {
+	l := &Limiter{clock: clock}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the limit, taking effect for bytes not yet reserved
+func (l *Limiter) SetRate(rate int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(l.clock.Now())
+
+	wasUnlimited := l.rate == 0
+	l.rate = float64(max(rate, 0))
+
+	switch {
+	case l.rate == 0:
+		l.tokens = 0
+	case wasUnlimited:
+		l.tokens = l.rate
+	default:
+		l.tokens = min(l.tokens, l.rate)
+	}
+}
+
+// Rate is the limit in bytes per second, or 0 for none
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int64(l.rate)
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 && now.After(l.last) {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	}
+	l.last = now
+}
+
+// reserve takes n bytes from the bucket, which may go into debt, and
+// returns how long the caller must wait before the bytes are paid for
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	l.refill(l.clock.Now())
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Limits are the download and upload limiters of one level: a session, a
+// torrent or a peer
+type Limits struct {
+	Download *Limiter
+	Upload   *Limiter
+}
+
+// NewLimits limits to download and upload bytes per second; 0 means no
+// limit
+func NewLimits(download, upload int64) *Limits {
+	return newLimits(download, upload, systemClock{})
+}
+
+func newLimits(download, upload int64, clock Clock) *Limits {
+	return &Limits{Download: newLimiter(download, clock), Upload: newLimiter(upload, clock)}
+}
+
+// Set changes both limits
+func (l *Limits) Set(download, upload int64) {
+	if l == nil {
+		return
+	}
+
+	l.Download.SetRate(download)
+	l.Upload.SetRate(upload)
+}
+
+func (l *Limits) download() *Limiter {
+	if l == nil {
+		return nil
+	}
+	return l.Download
+}
+
+func (l *Limits) upload() *Limiter {
+	if l == nil {
+		return nil
+	}
+	return l.Upload
+}
+
+// PerConn gives each connection limits of its own, all with the same rates.
+// Changing the rates changes them for every open connection.
+type PerConn struct {
+	clock Clock
+
+	mu       sync.Mutex
+	download int64
+	upload   int64
+	conns    map[*Limits]bool
+}
+
+func NewPerConn(download, upload int64) *PerConn {
+	return &PerConn{
+		clock:    systemClock{},
+		download: download,
+		upload:   upload,
+		conns:    make(map[*Limits]bool),
+	}
+}
+
+// Set changes the limits of each connection
+func (p *PerConn) Set(download, upload int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.download, p.upload = download, upload
+	for l := range p.conns {
+		l.Set(download, upload)
+	}
+}
+
+// Rates are the limits each connection gets
+func (p *PerConn) Rates() (download, upload int64) {
+	if p == nil {
+		return 0, 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.download, p.upload
+}
+
+func (p *PerConn) add() *Limits {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := newLimits(p.download, p.upload, p.clock)
+	p.conns[l] = true
+	return l
+}
+
+func (p *PerConn) remove(l *Limits) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, l)
+}
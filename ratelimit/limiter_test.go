@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock only moves when advanced, firing its timers in order
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// waiting is the number of timers yet to fire
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+// advance moves the clock by d, firing the timers that are then due
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.ch <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// next is how long until the first timer fires
+func (c *fakeClock) next() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var next time.Duration
+	for i, timer := range c.timers {
+		if d := timer.at.Sub(c.now); i == 0 || d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+func TestLimiterReserve(t *testing.T) {
+	clock := newFakeClock()
+	l := newLimiter(1000, clock)
+
+	// The bucket starts full
+	assert.Equal(t, time.Duration(0), l.reserve(1000))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(500))
+	assert.Equal(t, time.Second, l.reserve(500))
+
+	clock.advance(time.Second)
+	assert.Equal(t, 500*time.Millisecond, l.reserve(500))
+
+	// The bucket holds at most a second's worth
+	clock.advance(time.Hour)
+	assert.Equal(t, time.Duration(0), l.reserve(1000))
+	assert.Equal(t, 100*time.Millisecond, l.reserve(100))
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	clock := newFakeClock()
+	l := newLimiter(0, clock)
+
+	assert.Equal(t, int64(0), l.Rate())
+	assert.Equal(t, time.Duration(0), l.reserve(1<<30))
+
+	l.SetRate(1000)
+	assert.Equal(t, int64(1000), l.Rate())
+	assert.Equal(t, time.Duration(0), l.reserve(1000))
+	assert.Equal(t, time.Second, l.reserve(1000))
+
+	// The debt is paid at the new rate
+	l.SetRate(2000)
+	assert.Equal(t, time.Second, l.reserve(1000))
+
+	// Lifting the limit forgives the debt
+	l.SetRate(0)
+	assert.Equal(t, time.Duration(0), l.reserve(1000))
+
+	l.SetRate(-5)
+	assert.Equal(t, int64(0), l.Rate())
+}
+
+func TestLimiterNil(t *testing.T) {
+	var l *Limiter
+	l.SetRate(1000)
+	assert.Equal(t, int64(0), l.Rate())
+	assert.Equal(t, time.Duration(0), l.reserve(1000))
+
+	var limits *Limits
+	limits.Set(1000, 1000)
+	assert.Nil(t, limits.download())
+	assert.Nil(t, limits.upload())
+
+	var p *PerConn
+	p.Set(1000, 1000)
+	assert.Nil(t, p.add())
+}
+
+func TestPerConn(t *testing.T) {
+	p := NewPerConn(1000, 2000)
+
+	a := p.add()
+	b := p.add()
+	assert.Equal(t, int64(1000), a.Download.Rate())
+	assert.Equal(t, int64(2000), b.Upload.Rate())
+
+	p.remove(b)
+	p.Set(3000, 4000)
+
+	download, upload := p.Rates()
+	assert.Equal(t, int64(3000), download)
+	assert.Equal(t, int64(4000), upload)
+
+	assert.Equal(t, int64(3000), a.Download.Rate())
+	assert.Equal(t, int64(4000), a.Upload.Rate())
+	assert.Equal(t, int64(1000), b.Download.Rate())
+}
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Profile is a named pair of rate limits in bytes per second, e.g. "day"
+// at 2 MB/s. 0 means no limit.
+type Profile struct {
+	Name     string
+	Download int64
+	Upload   int64
+}
+
+// Rule applies a profile on some days between two hours. Hours run from 0
+// to 24, From included and To not. A rule whose To is not after its From
+// runs past midnight, and the hours after midnight belong to the day it
+// started on.
+type Rule struct {
+	// Days are the days the rule applies on; none means every day
+	Days    []time.Weekday
+	From    int
+	To      int
+	Profile string
+}
+
+func (r Rule) appliesOn(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, d := range r.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(t time.Time) bool {
+	hour := t.Hour()
+
+	if r.From < r.To {
+		return hour >= r.From && hour < r.To && r.appliesOn(t.Weekday())
+	}
+
+	if hour >= r.From {
+		return r.appliesOn(t.Weekday())
+	}
+	return hour < r.To && r.appliesOn(t.AddDate(0, 0, -1).Weekday())
+}
+
+// Schedule picks a profile by weekday and hour. The first rule that
+// matches wins, and Default applies when none does.
+type Schedule struct {
+	Profiles []Profile
+	Rules    []Rule
+	Default  string
+}
+
+func (s *Schedule) profile(name string) (Profile, bool) {
+	for _, p := range s.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Validate checks that every rule is sound and names a known profile
+func (s *Schedule) Validate() error {
+	seen := make(map[string]bool)
+	for _, p := range s.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile has no name")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("profile %q is defined twice", p.Name)
+		}
+		if p.Download < 0 || p.Upload < 0 {
+			return fmt.Errorf("profile %q has a negative rate", p.Name)
+		}
+		seen[p.Name] = true
+	}
+
+	if !seen[s.Default] {
+		return fmt.Errorf("unknown default profile %q", s.Default)
+	}
+
+	for i, r := range s.Rules {
+		if r.From < 0 || r.From > 23 || r.To < 0 || r.To > 24 {
+			return fmt.Errorf("rule %d has invalid hours %d-%d", i+1, r.From, r.To)
+		}
+		if !seen[r.Profile] {
+			return fmt.Errorf("rule %d names unknown profile %q", i+1, r.Profile)
+		}
+	}
+
+	return nil
+}
+
+// ProfileAt is the profile that applies at t, in t's time zone
+func (s *Schedule) ProfileAt(t time.Time) Profile {
+	for _, r := range s.Rules {
+		if r.matches(t) {
+			p, _ := s.profile(r.Profile)
+			return p
+		}
+	}
+
+	p, _ := s.profile(s.Default)
+	return p
+}
+
+// Scheduler sets limits to the schedule's profile as time passes. Because
+// connections read their limits on every read and write, a new profile
+// takes effect on them without reconnecting.
+type Scheduler struct {
+	schedule Schedule
+	limits   *Limits
+	clock    Clock
+
+	mu      sync.Mutex
+	current Profile
+	applied bool
+}
+
+// NewScheduler schedules limits. clock may be nil for the system clock,
+// whose time zone decides the hours.
+func NewScheduler(schedule Schedule, limits *Limits, clock Clock) (*Scheduler, error) {
+	err := schedule.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	return &Scheduler{schedule: schedule, limits: limits, clock: clock}, nil
+}
+
+// Run applies the current profile, then each new one as the hours pass,
+// until ctx is cancelled. Limits changed by hand stay until the next
+// change of profile.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		now := s.clock.Now()
+		s.apply(now)
+
+		// Profiles only change on the hour
+		next := time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(next.Sub(now)):
+		}
+	}
+}
+
+func (s *Scheduler) apply(now time.Time) {
+	p := s.schedule.ProfileAt(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.applied && p == s.current {
+		return
+	}
+
+	s.limits.Set(p.Download, p.Upload)
+	s.current = p
+	s.applied = true
+}
+
+// Current is the profile last applied
+func (s *Scheduler) Current() Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.current
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+func testSchedule() Schedule {
+	return Schedule{
+		Profiles: []Profile{
+			{Name: "full"},
+			{Name: "office", Download: 2000000, Upload: 500000},
+			{Name: "weekend", Download: 5000000},
+		},
+		Rules: []Rule{
+			{Days: weekdays, From: 9, To: 17, Profile: "office"},
+			// Friday night into Saturday morning, and so on
+			{Days: []time.Weekday{time.Friday, time.Saturday}, From: 20, To: 8, Profile: "weekend"},
+		},
+		Default: "full",
+	}
+}
+
+// at is a time in the first week of January 2024, which starts on a Monday
+func at(day time.Weekday, hour, minute int) time.Time {
+	return time.Date(2024, time.January, int(day+6)%7+1, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleProfileAt(t *testing.T) {
+	tests := map[string]struct {
+		time    time.Time
+		profile string
+	}{
+		"before work":          {time: at(time.Monday, 8, 59), profile: "full"},
+		"start of work":        {time: at(time.Monday, 9, 0), profile: "office"},
+		"end of work":          {time: at(time.Friday, 16, 59), profile: "office"},
+		"after work":           {time: at(time.Friday, 17, 0), profile: "full"},
+		"friday night":         {time: at(time.Friday, 23, 0), profile: "weekend"},
+		"saturday morning":     {time: at(time.Saturday, 7, 59), profile: "weekend"},
+		"saturday noon":        {time: at(time.Saturday, 12, 0), profile: "full"},
+		"sunday morning":       {time: at(time.Sunday, 3, 0), profile: "weekend"},
+		"monday morning":       {time: at(time.Monday, 3, 0), profile: "full"},
+		"thursday night":       {time: at(time.Thursday, 23, 0), profile: "full"},
+		"sunday business hour": {time: at(time.Sunday, 10, 0), profile: "full"},
+	}
+
+	s := testSchedule()
+	require.Nil(t, s.Validate())
+
+	for name, test := range tests {
+		assert.Equal(t, test.profile, s.ProfileAt(test.time).Name, name)
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := map[string]func(s *Schedule){
+		"unknown default":      func(s *Schedule) { s.Default = "nope" },
+		"unknown rule profile": func(s *Schedule) { s.Rules[0].Profile = "nope" },
+		"duplicate profile":    func(s *Schedule) { s.Profiles[1].Name = "full" },
+		"unnamed profile":      func(s *Schedule) { s.Profiles[1].Name = "" },
+		"negative rate":        func(s *Schedule) { s.Profiles[1].Upload = -1 },
+		"hour past midnight":   func(s *Schedule) { s.Rules[0].To = 25 },
+		"start at midnight":    func(s *Schedule) { s.Rules[0].From = 24 },
+	}
+
+	for name, change := range tests {
+		s := testSchedule()
+		change(&s)
+		assert.NotNil(t, s.Validate(), name)
+
+		_, err := NewScheduler(s, NewLimits(0, 0), nil)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = at(time.Friday, 8, 30)
+
+	limits := newLimits(0, 0, clock)
+	conn := newConn(endlessConn{}, clock, nil, limits)
+
+	s, err := NewScheduler(testSchedule(), limits, clock)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	// advance moves to the given time once the scheduler is waiting for the
+	// next hour
+	advance := func(to time.Time) {
+		require.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		clock.advance(to.Sub(clock.Now()))
+	}
+
+	expect := func(name string, download, upload int64) {
+		require.Eventually(t, func() bool { return s.Current().Name == name }, time.Second, time.Millisecond)
+		assert.Equal(t, download, limits.Download.Rate())
+		assert.Equal(t, upload, limits.Upload.Rate())
+	}
+
+	expect("full", 0, 0)
+
+	advance(at(time.Friday, 9, 0))
+	expect("office", 2000000, 500000)
+
+	// Limits set by hand last until the profile changes
+	limits.Set(1000, 1000)
+	advance(at(time.Friday, 10, 0))
+	advance(at(time.Friday, 11, 0))
+	assert.Equal(t, int64(1000), limits.Download.Rate())
+
+	advance(at(time.Friday, 17, 0))
+	expect("full", 0, 0)
+
+	advance(at(time.Friday, 20, 0))
+	expect("weekend", 5000000, 0)
+
+	// The open connection uses the limits the scheduler changed
+	down := conn.down[0]
+	assert.Equal(t, int64(5000000), down.Rate())
+
+	cancel()
+	<-done
+}
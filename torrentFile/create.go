@@ -0,0 +1,134 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Bounds for automatically chosen piece lengths, which aim for about
+// targetPieces pieces
+const (
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
+	targetPieces   = 1500
+)
+
+// Create builds a single-file torrent for the file at path. A pieceLength
+// of 0 picks one from the file size.
+func Create(path, announce string, pieceLength int) (TorrentFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	if info.IsDir() {
+		return TorrentFile{}, fmt.Errorf("%s is a directory; only single files are supported", path)
+	}
+
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(info.Size())
+	}
+
+	if pieceLength < MinPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return TorrentFile{}, fmt.Errorf("piece length %d is not a power of two of at least %d", pieceLength, MinPieceLength)
+	}
+
+	var pieces strings.Builder
+	buf := make([]byte, pieceLength)
+	length := 0
+
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			hash := sha1.Sum(buf[:n])
+			pieces.Write(hash[:])
+			length += n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+
+	if length == 0 {
+		return TorrentFile{}, fmt.Errorf("%s is empty", path)
+	}
+
+	bto := bencodeTorrent{
+		Announce: announce,
+		Info: bencodeInfo{
+			Pieces:      pieces.String(),
+			PieceLength: pieceLength,
+			Length:      length,
+			Name:        filepath.Base(path),
+		},
+	}
+
+	return bto.toTorrentFile()
+}
+
+func choosePieceLength(size int64) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && size/int64(pieceLength) > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Write encodes the torrent as a .torrent file
+func (t *TorrentFile) Write(w io.Writer) error {
+	var pieces strings.Builder
+	for _, h := range t.PieceHashes {
+		pieces.Write(h[:])
+	}
+
+	bto := bencodeTorrent{
+		Announce: t.Announce,
+		Info: bencodeInfo{
+			Pieces:      pieces.String(),
+			PieceLength: t.PieceLength,
+			Length:      t.Length,
+			Name:        t.Name,
+		},
+	}
+
+	return bencode.Marshal(w, bto)
+}
+
+// Magnet returns a magnet link for the torrent
+func (t *TorrentFile) Magnet() string {
+	var b strings.Builder
+
+	b.WriteString("magnet:?xt=urn:btih:")
+	b.WriteString(hex.EncodeToString(t.InfoHash[:]))
+
+	if t.Name != "" {
+		b.WriteString("&dn=" + url.QueryEscape(t.Name))
+	}
+	if t.Length > 0 {
+		b.WriteString("&xl=" + strconv.Itoa(t.Length))
+	}
+	if t.Announce != "" {
+		b.WriteString("&tr=" + url.QueryEscape(t.Announce))
+	}
+
+	return b.String()
+}
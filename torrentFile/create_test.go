@@ -0,0 +1,113 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRandomFile(t *testing.T, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	path := filepath.Join(t.TempDir(), "data.bin")
+	require.Nil(t, os.WriteFile(path, data, 0644))
+
+	return path, data
+}
+
+func TestCreate(t *testing.T) {
+	path, _ := writeRandomFile(t, 3*MinPieceLength+100)
+
+	tf, err := Create(path, "http://tracker.example/announce", MinPieceLength)
+	require.Nil(t, err)
+
+	assert.Equal(t, "data.bin", tf.Name)
+	assert.Equal(t, 3*MinPieceLength+100, tf.Length)
+	assert.Equal(t, MinPieceLength, tf.PieceLength)
+	assert.Len(t, tf.PieceHashes, 4)
+
+	result, err := tf.Verify(path)
+	require.Nil(t, err)
+	assert.True(t, result.OK())
+
+	// Writing and reading back gives the same torrent
+	out := filepath.Join(t.TempDir(), "data.torrent")
+	file, err := os.Create(out)
+	require.Nil(t, err)
+	require.Nil(t, tf.Write(file))
+	require.Nil(t, file.Close())
+
+	opened, err := Open(out)
+	require.Nil(t, err)
+	assert.Equal(t, tf, opened)
+}
+
+func TestCreateErrors(t *testing.T) {
+	path, _ := writeRandomFile(t, 100)
+
+	tests := map[string]struct {
+		path        string
+		pieceLength int
+	}{
+		"missing file":             {filepath.Join(t.TempDir(), "missing"), 0},
+		"directory":                {t.TempDir(), 0},
+		"piece length too small":   {path, 1024},
+		"piece length not a power": {path, 3 * MinPieceLength},
+	}
+
+	for name, test := range tests {
+		_, err := Create(test.path, "", test.pieceLength)
+		assert.NotNil(t, err, name)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	require.Nil(t, os.WriteFile(empty, nil, 0644))
+	_, err := Create(empty, "", 0)
+	assert.NotNil(t, err)
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := map[int64]int{
+		0:          MinPieceLength,
+		10 << 20:   MinPieceLength,
+		700 << 20:  512 << 10,
+		4 << 30:    4 << 20,
+		1000 << 30: MaxPieceLength,
+	}
+
+	for size, pieceLength := range tests {
+		assert.Equal(t, pieceLength, choosePieceLength(size), size)
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	tf, err := Open("testdata/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	require.Nil(t, tf.Write(&buf))
+
+	path := filepath.Join(t.TempDir(), "copy.torrent")
+	require.Nil(t, os.WriteFile(path, buf.Bytes(), 0644))
+
+	opened, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, tf.InfoHash, opened.InfoHash)
+}
+
+func TestMagnet(t *testing.T) {
+	tf := TorrentFile{
+		Announce: "http://tracker.example/announce?key=1",
+		InfoHash: [20]byte{0xde, 0xad, 0xbe, 0xef},
+		Length:   1234,
+		Name:     "my file.iso",
+	}
+
+	assert.Equal(t, "magnet:?xt=urn:btih:deadbeef00000000000000000000000000000000&dn=my+file.iso&xl=1234&tr=http%3A%2F%2Ftracker.example%2Fannounce%3Fkey%3D1", tf.Magnet())
+}
@@ -0,0 +1,387 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Metainfo is everything a .torrent file says about itself, for showing
+// to people rather than downloading
+type Metainfo struct {
+	Name string `json:"name"`
+
+	// InfoHash is set for v1 and hybrid torrents, InfoHashV2 for v2 and
+	// hybrid torrents (BEP 52)
+	InfoHash   Hash `json:"infohash,omitempty"`
+	InfoHashV2 Hash `json:"infohash_v2,omitempty"`
+
+	PieceLength int    `json:"piece_length"`
+	Pieces      int    `json:"pieces"`
+	Length      int64  `json:"length"`
+	Files       []File `json:"files"`
+
+	// Trackers are grouped into tiers, which are tried in order (BEP 12)
+	Trackers [][]string `json:"trackers,omitempty"`
+	WebSeeds []string   `json:"web_seeds,omitempty"`
+	Nodes    []string   `json:"nodes,omitempty"`
+
+	Private      bool       `json:"private"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	Source       string     `json:"source,omitempty"`
+}
+
+// File is one file of a torrent. Path starts with the torrent's name for
+// torrents that are a directory.
+type File struct {
+	Path   []string `json:"path"`
+	Length int64    `json:"length"`
+
+	// Padding files (BEP 47) are all zeros and never written to disk
+	Padding bool `json:"padding,omitempty"`
+}
+
+// Hash is an infohash. It encodes to JSON as its hex and base32 forms.
+type Hash []byte
+
+func (h Hash) Hex() string {
+	return hex.EncodeToString(h)
+}
+
+func (h Hash) Base32() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h)
+}
+
+func (h Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"hex": h.Hex(), "base32": h.Base32()})
+}
+
+// ReadMetainfo reads the metainfo of the .torrent file at path
+func ReadMetainfo(path string) (*Metainfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMetainfo(data)
+}
+
+// ParseMetainfo parses the contents of a .torrent file
+func ParseMetainfo(data []byte) (*Metainfo, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	top, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent is not a dictionary")
+	}
+
+	info, ok := top["info"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent has no info dictionary")
+	}
+
+	rawInfo, err := infoBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metainfo{
+		Name:        str(info["name"]),
+		PieceLength: int(integer(info["piece length"])),
+		Private:     integer(info["private"]) == 1,
+		Comment:     str(top["comment"]),
+		CreatedBy:   str(top["created by"]),
+		Source:      str(info["source"]),
+	}
+
+	pieces, v1 := info["pieces"].(string)
+	v2 := integer(info["meta version"]) == 2
+
+	if !v1 && !v2 {
+		return nil, errors.New("info dictionary has neither pieces nor a v2 file tree")
+	}
+
+	if v1 {
+		if len(pieces)%20 != 0 {
+			return nil, fmt.Errorf("received malformed pieces of length %d", len(pieces))
+		}
+
+		h := sha1.Sum(rawInfo)
+		m.InfoHash = h[:]
+		m.Pieces = len(pieces) / 20
+	}
+
+	if v2 {
+		h := sha256.Sum256(rawInfo)
+		m.InfoHashV2 = h[:]
+	}
+
+	switch files := info["files"].(type) {
+	case []interface{}:
+		m.Files = v1Files(m.Name, files)
+	default:
+		if tree, ok := info["file tree"].(map[string]interface{}); ok {
+			m.Files = v2Files(m.Name, tree)
+		} else {
+			m.Files = []File{{Path: []string{m.Name}, Length: integer(info["length"])}}
+		}
+	}
+
+	for _, f := range m.Files {
+		m.Length += f.Length
+
+		// v2 pieces never span files
+		if !v1 && m.PieceLength > 0 {
+			m.Pieces += int((f.Length + int64(m.PieceLength) - 1) / int64(m.PieceLength))
+		}
+	}
+
+	if date, ok := top["creation date"]; ok {
+		t := time.Unix(integer(date), 0).UTC()
+		m.CreationDate = &t
+	}
+
+	m.Trackers = trackerTiers(top)
+	m.WebSeeds = stringList(top["url-list"])
+	m.Nodes = nodes(top["nodes"])
+
+	return m, nil
+}
+
+// v1Files lists the files of a multi-file torrent, leaving out BEP 47
+// padding files
+func v1Files(name string, files []interface{}) []File {
+	var result []File
+
+	for _, f := range files {
+		file, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if attr := str(file["attr"]); strings.ContainsRune(attr, 'p') {
+			continue
+		}
+
+		path := append([]string{name}, stringList(file["path"])...)
+		result = append(result, File{Path: path, Length: integer(file["length"])})
+	}
+
+	return result
+}
+
+// v2Files flattens a BEP 52 file tree, in which each file is a dictionary
+// with an empty key
+func v2Files(name string, tree map[string]interface{}) []File {
+	var result []File
+
+	var walk func(path []string, node map[string]interface{})
+	walk = func(path []string, node map[string]interface{}) {
+		if leaf, ok := node[""].(map[string]interface{}); ok {
+			result = append(result, File{Path: path, Length: integer(leaf["length"])})
+			return
+		}
+
+		keys := make([]string, 0, len(node))
+		for key := range node {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if child, ok := node[key].(map[string]interface{}); ok {
+				walk(append(append([]string(nil), path...), key), child)
+			}
+		}
+	}
+
+	walk(nil, tree)
+
+	// A lone file is the torrent itself; otherwise the name is a directory
+	if len(result) == 1 && len(result[0].Path) == 1 {
+		return result
+	}
+
+	for i := range result {
+		result[i].Path = append([]string{name}, result[i].Path...)
+	}
+	return result
+}
+
+// trackerTiers prefers announce-list over announce, as BEP 12 says clients
+// should
+func trackerTiers(top map[string]interface{}) [][]string {
+	var tiers [][]string
+
+	if list, ok := top["announce-list"].([]interface{}); ok {
+		for _, tier := range list {
+			urls := stringList(tier)
+			if len(urls) > 0 {
+				tiers = append(tiers, urls)
+			}
+		}
+	}
+
+	if len(tiers) == 0 {
+		if announce := str(top["announce"]); announce != "" {
+			tiers = [][]string{{announce}}
+		}
+	}
+
+	return tiers
+}
+
+// nodes reads the DHT nodes of a trackerless torrent (BEP 5), a list of
+// [host, port] pairs
+func nodes(v interface{}) []string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var result []string
+	for _, n := range list {
+		pair, ok := n.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+
+		host := str(pair[0])
+		if host == "" {
+			continue
+		}
+		result = append(result, net.JoinHostPort(host, strconv.FormatInt(integer(pair[1]), 10)))
+	}
+
+	return result
+}
+
+func str(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func integer(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case uint64:
+		return int64(n)
+	}
+	return 0
+}
+
+// stringList reads a list of strings, or a single string as a list of one
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var result []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// infoBytes finds the info dictionary exactly as it is encoded in data.
+// The infohash covers these bytes, which re-encoding the decoded
+// dictionary would not reproduce for unknown or unsorted keys.
+func infoBytes(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("torrent is not a dictionary")
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		keyEnd, err := skipValue(data, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		valueEnd, err := skipValue(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+
+		colon := bytes.IndexByte(data[pos:keyEnd], ':')
+		if colon >= 0 && string(data[pos+colon+1:keyEnd]) == "info" {
+			return data[keyEnd:valueEnd], nil
+		}
+
+		pos = valueEnd
+	}
+
+	return nil, errors.New("torrent has no info dictionary")
+}
+
+// skipValue returns where the bencoded value starting at pos ends
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, errors.New("torrent is truncated")
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, errors.New("torrent is truncated")
+		}
+		return pos + end + 1, nil
+
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			var err error
+			pos, err = skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if pos >= len(data) {
+			return 0, errors.New("torrent is truncated")
+		}
+		return pos + 1, nil
+
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[pos:], ':')
+		if colon < 0 {
+			return 0, errors.New("torrent is truncated")
+		}
+
+		n, err := strconv.Atoi(string(data[pos : pos+colon]))
+		if err != nil {
+			return 0, fmt.Errorf("invalid string length at offset %d", pos)
+		}
+
+		end := pos + colon + 1 + n
+		if end > len(data) {
+			return 0, errors.New("torrent is truncated")
+		}
+		return end, nil
+	}
+
+	return 0, fmt.Errorf("invalid bencode at offset %d", pos)
+}
@@ -0,0 +1,208 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	require.Nil(t, bencode.Marshal(&buf, v))
+	return buf.Bytes()
+}
+
+func TestReadMetainfo(t *testing.T) {
+	m, err := ReadMetainfo("testdata/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Nil(t, err)
+
+	torrent, err := Open("testdata/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Nil(t, err)
+
+	assert.Equal(t, "archlinux-2019.12.01-x86_64.iso", m.Name)
+	assert.Equal(t, Hash(torrent.InfoHash[:]), m.InfoHash)
+	assert.Equal(t, "33UGU75G6KDKTV2MGYQBIYLKB726JBB5", m.InfoHash.Base32())
+	assert.Nil(t, m.InfoHashV2)
+	assert.Equal(t, 1278, m.Pieces)
+	assert.Equal(t, 524288, m.PieceLength)
+	assert.Equal(t, int64(670040064), m.Length)
+	assert.Equal(t, []File{{Path: []string{"archlinux-2019.12.01-x86_64.iso"}, Length: 670040064}}, m.Files)
+	assert.Equal(t, [][]string{{"http://tracker.archlinux.org:6969/announce"}}, m.Trackers)
+	assert.NotEmpty(t, m.WebSeeds)
+	assert.Equal(t, time.Date(2019, 12, 1, 9, 8, 30, 0, time.UTC), *m.CreationDate)
+	assert.Equal(t, "mktorrent 1.1", m.CreatedBy)
+	assert.Equal(t, "Arch Linux 2019.12.01 (www.archlinux.org)", m.Comment)
+	assert.False(t, m.Private)
+}
+
+func TestParseMetainfo(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "photos",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 40),
+		"private":      1,
+		"source":       "internal",
+		"meta version": 2,
+		"files": []interface{}{
+			map[string]interface{}{"length": 20000, "path": []interface{}{"2024", "a.jpg"}},
+			map[string]interface{}{"length": 12768, "path": []interface{}{".pad", "12768"}, "attr": "p"},
+			map[string]interface{}{"length": 100, "path": []interface{}{"readme.txt"}},
+		},
+		"file tree": map[string]interface{}{
+			"readme.txt": map[string]interface{}{"": map[string]interface{}{"length": 100}},
+			"2024": map[string]interface{}{
+				"a.jpg": map[string]interface{}{"": map[string]interface{}{"length": 20000}},
+			},
+		},
+	}
+
+	data := encode(t, map[string]interface{}{
+		"announce":      "http://ignored.example/announce",
+		"announce-list": []interface{}{[]interface{}{"http://a.example/announce", "http://b.example/announce"}, []interface{}{"udp://c.example:80"}},
+		"url-list":      "http://mirror.example/photos/",
+		"nodes":         []interface{}{[]interface{}{"router.example", 6881}, []interface{}{"::1", 6882}},
+		"info":          info,
+	})
+
+	m, err := ParseMetainfo(data)
+	require.Nil(t, err)
+
+	rawInfo := encode(t, info)
+	v1 := sha1.Sum(rawInfo)
+	v2 := sha256.Sum256(rawInfo)
+
+	assert.Equal(t, Hash(v1[:]), m.InfoHash)
+	assert.Equal(t, Hash(v2[:]), m.InfoHashV2)
+	assert.Equal(t, 2, m.Pieces)
+	assert.Equal(t, int64(20100), m.Length)
+	assert.Equal(t, []File{
+		{Path: []string{"photos", "2024", "a.jpg"}, Length: 20000},
+		{Path: []string{"photos", "readme.txt"}, Length: 100},
+	}, m.Files)
+	assert.Equal(t, [][]string{{"http://a.example/announce", "http://b.example/announce"}, {"udp://c.example:80"}}, m.Trackers)
+	assert.Equal(t, []string{"http://mirror.example/photos/"}, m.WebSeeds)
+	assert.Equal(t, []string{"router.example:6881", "[::1]:6882"}, m.Nodes)
+	assert.True(t, m.Private)
+	assert.Equal(t, "internal", m.Source)
+	assert.Nil(t, m.CreationDate)
+}
+
+func TestParseMetainfoV2Only(t *testing.T) {
+	tests := map[string]struct {
+		tree   map[string]interface{}
+		pieces int
+		files  []File
+	}{
+		"single file": {
+			tree: map[string]interface{}{
+				"a.bin": map[string]interface{}{"": map[string]interface{}{"length": 40000}},
+			},
+			pieces: 3,
+			files:  []File{{Path: []string{"a.bin"}, Length: 40000}},
+		},
+		"directory": {
+			tree: map[string]interface{}{
+				"b.bin": map[string]interface{}{"": map[string]interface{}{"length": 100}},
+				"a.bin": map[string]interface{}{"": map[string]interface{}{"length": 16385}},
+			},
+			pieces: 3,
+			files: []File{
+				{Path: []string{"dir", "a.bin"}, Length: 16385},
+				{Path: []string{"dir", "b.bin"}, Length: 100},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		m, err := ParseMetainfo(encode(t, map[string]interface{}{
+			"info": map[string]interface{}{
+				"name":         "dir",
+				"piece length": 16384,
+				"meta version": 2,
+				"file tree":    test.tree,
+			},
+		}))
+		require.Nil(t, err, name)
+
+		assert.Nil(t, m.InfoHash, name)
+		assert.Len(t, m.InfoHashV2, 32, name)
+		assert.Equal(t, test.pieces, m.Pieces, name)
+		assert.Equal(t, test.files, m.Files, name)
+		assert.Nil(t, m.Trackers, name)
+	}
+}
+
+func TestParseMetainfoInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"not bencode":      []byte("hello"),
+		"not a dictionary": []byte("li1ee"),
+		"no info":          []byte("d8:announce3:urle"),
+		"no pieces":        []byte("d4:infod4:name1:aee"),
+		"malformed pieces": []byte("d4:infod6:pieces3:abcee"),
+	}
+
+	for name, data := range tests {
+		_, err := ParseMetainfo(data)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestInfoBytes(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output string
+		fails  bool
+	}{
+		"info last": {
+			input:  "d8:announce3:url4:infod4:name1:a6:lengthi5eee",
+			output: "d4:name1:a6:lengthi5ee",
+		},
+		"nested values before info": {
+			input:  "d1:ald1:xi1eee1:bi-3e4:infod1:kl1:vee1:z0:e",
+			output: "d1:kl1:vee",
+		},
+		"no info":          {input: "d1:ai1ee", fails: true},
+		"truncated":        {input: "d4:infod4:name", fails: true},
+		"bad bencode":      {input: "d4:infox", fails: true},
+		"not a dictionary": {input: "i1e", fails: true},
+	}
+
+	for name, test := range tests {
+		raw, err := infoBytes([]byte(test.input))
+
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, string(raw), name)
+	}
+}
+
+func TestOpenHashesWholeInfo(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "a.bin",
+		"length":       10,
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 20),
+		"private":      1,
+	}
+
+	path := filepath.Join(t.TempDir(), "a.torrent")
+	require.Nil(t, os.WriteFile(path, encode(t, map[string]interface{}{"info": info}), 0644))
+
+	torrent, err := Open(path)
+	require.Nil(t, err)
+
+	assert.Equal(t, [20]byte(sha1.Sum(encode(t, info))), torrent.InfoHash)
+}
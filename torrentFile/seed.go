@@ -0,0 +1,120 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultAnnounceInterval is used when the tracker does not say how often
+// to announce
+const defaultAnnounceInterval = 30 * time.Minute
+
+// Seed uploads the complete data at path to other peers until ctx is
+// cancelled. The data is verified first, so corrupt data is never served.
+func (t *TorrentFile) Seed(ctx context.Context, path string, opts Options) error {
+	if t.Files != nil {
+		return errMultiFile
+	}
+
+	result, err := t.Verify(path)
+	if err != nil {
+		return err
+	}
+
+	if !result.OK() {
+		return fmt.Errorf("%s is incomplete: %d of %d pieces missing or corrupt", path, len(result.Bad), result.Pieces)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	port := opts.port()
+
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return err
+	}
+
+	peerID, err := newPeerID()
+	if err != nil {
+		return err
+	}
+
+	s := &swarm{peerID: peerID, port: port, opts: opts}
+
+	s.lsd = listenLocal(port)
+	defer s.closeLocal()
+
+	defer t.advertise(ctx, s, "started")()
+
+	torrent := t.p2pTorrent(s, opts.rates())
+
+	log.Printf("Seeding %s on port %d\n", t.Name, port)
+	return torrent.Seed(ctx, ln, file)
+}
+
+// advertise tells the tracker and local peers that we are seeding until
+// ctx is cancelled, starting with event. The returned function tells the
+// tracker we left.
+func (t *TorrentFile) advertise(ctx context.Context, s *swarm, event string) func() {
+	for _, service := range s.lsd {
+		go announceLocally(ctx, service, t.InfoHash)
+	}
+
+	// Seeds need no peers, but keep the source announcing them
+	if s.source != nil {
+		go func() {
+			for range s.source.Peers(ctx, t.InfoHash, s.port) {
+			}
+		}()
+	}
+
+	if t.Announce == "" {
+		return func() {}
+	}
+
+	go t.announceSeeding(ctx, s.peerID, s.port, event)
+
+	return func() {
+		err := t.announceStopped(s.peerID, s.port)
+		if err != nil {
+			log.Printf("Could not send stopped event to tracker: %v\n", err)
+		}
+	}
+}
+
+// announceSeeding tells the tracker we have the whole torrent, and keeps
+// telling it at the interval it asks for
+func (t *TorrentFile) announceSeeding(ctx context.Context, peerID [20]byte, port uint16, event string) {
+	c := &http.Client{Timeout: 15 * time.Second}
+
+	for {
+		interval := defaultAnnounceInterval
+
+		resp, err := t.announceEvent(ctx, c, peerID, port, event, 0)
+		if err != nil {
+			log.Printf("Tracker announce failed: %v\n", err)
+		} else {
+			event = ""
+			if resp.Interval > 0 {
+				interval = time.Duration(resp.Interval) * time.Second
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
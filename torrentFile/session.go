@@ -0,0 +1,770 @@
+package torrentfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/handshake"
+	"github.com/prabal199251/Torrent-Client/p2p"
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/prabal199251/Torrent-Client/ratelimit"
+)
+
+// inboundHandshakeTimeout bounds how long a peer connecting to a session
+// may take to say which torrent it wants
+const inboundHandshakeTimeout = 10 * time.Second
+
+var errSessionClosed = errors.New("session is closed")
+
+// SessionOptions configures a Session. Options apply to each torrent.
+type SessionOptions struct {
+	Options
+
+	// MaxConns caps the peer connections of all torrents together; 0
+	// means no limit
+	MaxConns int
+
+	// MaxDials caps the connection attempts in progress for all torrents
+	// together; 0 leaves each torrent to p2p.DefaultMaxDials
+	MaxDials int
+
+	// MaxDownloads and MaxSeeds cap how many torrents download and seed at
+	// once. The rest wait in the queue. 0 means no limit.
+	MaxDownloads int
+	MaxSeeds     int
+
+	// StallTimeout is how long a download may go without receiving data
+	// before it stops holding a download slot, letting the next queued
+	// torrent start. 0 means downloads never stall.
+	StallTimeout time.Duration
+
+	// TotalDownloadRate and TotalUploadRate cap the traffic of all torrents
+	// together, in bytes per second; 0 means no limit
+	TotalDownloadRate int64
+	TotalUploadRate   int64
+
+	// Schedule, if set, switches the total rates between its profiles by
+	// weekday and hour, in place of TotalDownloadRate and TotalUploadRate
+	Schedule *ratelimit.Schedule
+
+	// PeerSource, if set, finds peers for every torrent on top of the
+	// trackers and local service discovery, e.g. a DHT node owned by the
+	// caller. This module has no DHT node of its own.
+	PeerSource PeerSource
+}
+
+// PeerSource finds peers beyond the trackers, e.g. through the DHT. A
+// session shares one between all its torrents.
+type PeerSource interface {
+	// Peers looks for peers of infoHash and announces that we accept
+	// connections for it on port. It sends the peers it finds until ctx is
+	// cancelled, then closes the channel.
+	Peers(ctx context.Context, infoHash [20]byte, port uint16) <-chan peers.Peer
+}
+
+// Session runs many torrents at once. They share one peer ID, one listening
+// socket, local service discovery, the optional peer source, a ban list and
+// the connection limit.
+type Session struct {
+	swarm swarm
+	ln    net.Listener
+	opts  SessionOptions
+
+	// wake asks the scheduler to look for torrents to start
+	wake chan struct{}
+	// bandwidth, if set, changes the total rate limits by time of day
+	bandwidth *ratelimit.Scheduler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// torrents is in queue order; earlier torrents start first
+	torrents []*SessionTorrent
+	closed   bool
+}
+
+// NewSession starts listening for peers on the configured port
+func NewSession(opts SessionOptions) (*Session, error) {
+	peerID, err := newPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	port := opts.port()
+	limits := ratelimit.NewLimits(opts.TotalDownloadRate, opts.TotalUploadRate)
+
+	var bandwidth *ratelimit.Scheduler
+	if opts.Schedule != nil {
+		bandwidth, err = ratelimit.NewScheduler(*opts.Schedule, limits, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		swarm: swarm{
+			peerID: peerID,
+			port:   port,
+			opts:   opts.Options,
+			bans:   p2p.NewBanList(),
+			limits: limits,
+			source: opts.PeerSource,
+		},
+		ln:        ln,
+		opts:      opts,
+		wake:      make(chan struct{}, 1),
+		bandwidth: bandwidth,
+	}
+
+	if opts.MaxConns > 0 {
+		s.swarm.conns = p2p.NewConnLimit(opts.MaxConns)
+	}
+	if opts.MaxDials > 0 {
+		s.swarm.dials = p2p.NewConnLimit(opts.MaxDials)
+	}
+
+	s.swarm.lsd = listenLocal(port)
+	for _, service := range s.swarm.lsd {
+		go service.Serve()
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.wg.Add(2)
+	go s.accept()
+	go s.scheduleLoop()
+
+	if bandwidth != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			bandwidth.Run(s.ctx)
+		}()
+	}
+
+	return s, nil
+}
+
+func (s *Session) PeerID() [20]byte {
+	return s.swarm.peerID
+}
+
+// Port is the port the session accepts peer connections on
+func (s *Session) Port() uint16 {
+	return s.swarm.port
+}
+
+// Add queues a torrent whose data lives at path, behind the torrents
+// already in the session. Data that is already complete is seeded;
+// otherwise it is downloaded first.
+func (s *Session) Add(t *TorrentFile, path string) (*SessionTorrent, error) {
+	if t.Files != nil {
+		return nil, errMultiFile
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errSessionClosed
+	}
+
+	for _, st := range s.torrents {
+		if st.file.InfoHash == t.InfoHash {
+			return nil, fmt.Errorf("torrent %x is already in the session", t.InfoHash)
+		}
+	}
+
+	st := &SessionTorrent{
+		file:    t,
+		path:    path,
+		session: s,
+		done:    make(chan struct{}),
+		granted: make(chan struct{}),
+		state:   TorrentQueued,
+		rates:   s.swarm.opts.rates(),
+	}
+	st.ctx, st.cancel = context.WithCancel(s.ctx)
+
+	s.torrents = append(s.torrents, st)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		st.run()
+	}()
+
+	return st, nil
+}
+
+// Remove stops a torrent and takes it out of the session. Its data is
+// left on disk.
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+
+	var st *SessionTorrent
+	if i := s.indexOf(infoHash); i >= 0 {
+		st = s.torrents[i]
+		s.torrents = append(s.torrents[:i:i], s.torrents[i+1:]...)
+	}
+
+	s.mu.Unlock()
+
+	if st == nil {
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+
+	st.cancel()
+	<-st.done
+	return nil
+}
+
+// Move puts a torrent at position in the queue, counting from 0. Positions
+// past the end move it to the back.
+func (s *Session) Move(infoHash [20]byte, position int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from := s.indexOf(infoHash)
+	if from < 0 {
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	if position < 0 {
+		return fmt.Errorf("invalid queue position %d", position)
+	}
+
+	st := s.torrents[from]
+	rest := append(s.torrents[:from:from], s.torrents[from+1:]...)
+	if position > len(rest) {
+		position = len(rest)
+	}
+
+	s.torrents = append(rest[:position:position], append([]*SessionTorrent{st}, rest[position:]...)...)
+
+	s.wakeScheduler()
+	return nil
+}
+
+// QueuePosition is where a torrent is in the queue, or -1 if it is not in
+// the session
+func (s *Session) QueuePosition(infoHash [20]byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.indexOf(infoHash)
+}
+
+func (s *Session) indexOf(infoHash [20]byte) int {
+	for i, st := range s.torrents {
+		if st.file.InfoHash == infoHash {
+			return i
+		}
+	}
+	return -1
+}
+
+// Torrents lists the session's torrents in queue order
+func (s *Session) Torrents() []*SessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*SessionTorrent(nil), s.torrents...)
+}
+
+// Torrent finds a torrent by infohash, returning nil if it is not in the
+// session
+func (s *Session) Torrent(infoHash [20]byte) *SessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.indexOf(infoHash)
+	if i < 0 {
+		return nil
+	}
+	return s.torrents[i]
+}
+
+// SetRateLimit changes the cap on the traffic of all torrents together, in
+// bytes per second; 0 means no limit. Open connections follow the change.
+// With a Schedule, the change lasts until the next change of profile.
+func (s *Session) SetRateLimit(download, upload int64) {
+	s.swarm.limits.Set(download, upload)
+}
+
+// RateLimit is the cap on the traffic of all torrents together
+func (s *Session) RateLimit() (download, upload int64) {
+	return s.swarm.limits.Download.Rate(), s.swarm.limits.Upload.Rate()
+}
+
+// Profile is the scheduled rate limit profile in effect, or false if the
+// session has no Schedule
+func (s *Session) Profile() (ratelimit.Profile, bool) {
+	if s.bandwidth == nil {
+		return ratelimit.Profile{}, false
+	}
+	return s.bandwidth.Current(), true
+}
+
+// Close stops every torrent and stops listening
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.cancel()
+	err := s.ln.Close()
+	s.wg.Wait()
+
+	s.swarm.closeLocal()
+
+	return err
+}
+
+func (s *Session) wakeScheduler() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) scheduleLoop() {
+	defer s.wg.Done()
+
+	var tick <-chan time.Time
+	if s.opts.StallTimeout > 0 {
+		ticker := time.NewTicker(s.opts.StallTimeout / 4)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.wake:
+		case <-tick:
+		}
+
+		s.schedule()
+	}
+}
+
+// schedule starts queued torrents, in queue order, while there are free
+// download and seed slots. Only one torrent at a time checks its data, so
+// that many torrents added together do not fight over the disk.
+func (s *Session) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checks, downloads, seeds := 0, 0, 0
+
+	for _, st := range s.torrents {
+		switch st.State() {
+		case TorrentChecking:
+			checks++
+		case TorrentDownloading:
+			if st.holdsSlot(s.opts.StallTimeout) {
+				downloads++
+			}
+		case TorrentSeeding:
+			seeds++
+		}
+	}
+
+	for _, st := range s.torrents {
+		if st.State() != TorrentQueued {
+			continue
+		}
+
+		switch {
+		case !st.checked:
+			if checks > 0 {
+				continue
+			}
+			checks++
+			st.grant(TorrentChecking)
+		case st.complete:
+			if s.opts.MaxSeeds > 0 && seeds >= s.opts.MaxSeeds {
+				continue
+			}
+			seeds++
+			st.grant(TorrentSeeding)
+		default:
+			if s.opts.MaxDownloads > 0 && downloads >= s.opts.MaxDownloads {
+				continue
+			}
+			downloads++
+			st.grant(TorrentDownloading)
+		}
+	}
+}
+
+func (s *Session) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("Stopped accepting peers: %v\n", err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleInbound(conn)
+		}()
+	}
+}
+
+// handleInbound reads which torrent a connecting peer wants and hands the
+// connection to it
+func (s *Session) handleInbound(conn net.Conn) {
+	if !s.swarm.conns.TryAcquire() {
+		conn.Close()
+		return
+	}
+	defer s.swarm.conns.Release()
+
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(inboundHandshakeTimeout))
+
+	res, err := handshake.Read(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	st := s.Torrent(res.InfoHash)
+	if st == nil {
+		conn.Close()
+		return
+	}
+
+	err = st.serve(conn, res)
+	if err != nil && s.ctx.Err() == nil {
+		log.Printf("Stopped uploading to %s: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// TorrentState is where a torrent in a Session is in its life
+type TorrentState int
+
+const (
+	TorrentQueued TorrentState = iota
+	TorrentChecking
+	TorrentDownloading
+	TorrentSeeding
+	TorrentStopped
+	TorrentFailed
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case TorrentQueued:
+		return "queued"
+	case TorrentChecking:
+		return "checking"
+	case TorrentDownloading:
+		return "downloading"
+	case TorrentSeeding:
+		return "seeding"
+	case TorrentStopped:
+		return "stopped"
+	case TorrentFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("TorrentState(%d)", int(s))
+}
+
+// SessionTorrent is a torrent running in a Session
+type SessionTorrent struct {
+	file    *TorrentFile
+	path    string
+	session *Session
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	rates  rates
+
+	// checked and complete say what is known about the data on disk. The
+	// scheduler reads them under the session's lock.
+	checked  bool
+	complete bool
+	// granted is closed by the scheduler to start a queued torrent
+	granted chan struct{}
+
+	mu     sync.Mutex
+	state  TorrentState
+	err    error
+	handle *p2p.Handle
+
+	// lastData is when the download last received data, and downloaded
+	// how much it had then
+	lastData   time.Time
+	downloaded int64
+
+	// seeding and data are set while seeding
+	seeding *p2p.Torrent
+	data    *os.File
+	uploads sync.WaitGroup
+}
+
+func (st *SessionTorrent) File() *TorrentFile {
+	return st.file
+}
+
+func (st *SessionTorrent) Path() string {
+	return st.path
+}
+
+func (st *SessionTorrent) State() TorrentState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.state
+}
+
+// Err is why the torrent failed, if it did
+func (st *SessionTorrent) Err() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.err
+}
+
+// Handle controls and reports on the torrent's download. It is nil until
+// the download starts, and stays nil for data that was already complete.
+func (st *SessionTorrent) Handle() *p2p.Handle {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.handle
+}
+
+// Done is closed once the torrent has stopped or failed
+func (st *SessionTorrent) Done() <-chan struct{} {
+	return st.done
+}
+
+// SetRateLimit changes the cap on the torrent's traffic, in bytes per
+// second; 0 means no limit. Open connections follow the change.
+func (st *SessionTorrent) SetRateLimit(download, upload int64) {
+	st.rates.torrent.Set(download, upload)
+}
+
+// SetPeerRateLimit changes the cap on each peer's traffic
+func (st *SessionTorrent) SetPeerRateLimit(download, upload int64) {
+	st.rates.peer.Set(download, upload)
+}
+
+func (st *SessionTorrent) setState(state TorrentState, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.state = state
+	st.err = err
+}
+
+// Stalled reports whether the torrent is downloading but has not received
+// any data for the session's StallTimeout
+func (st *SessionTorrent) Stalled() bool {
+	return st.State() == TorrentDownloading && !st.holdsSlot(st.session.opts.StallTimeout)
+}
+
+// holdsSlot reports whether a downloading torrent counts against
+// MaxDownloads. Paused downloads do not, nor do stalled ones.
+func (st *SessionTorrent) holdsSlot(stallTimeout time.Duration) bool {
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.handle == nil {
+		return true
+	}
+
+	stats := st.handle.Stats()
+	if stats.State == p2p.StatePaused {
+		return false
+	}
+
+	if stats.Downloaded != st.downloaded {
+		st.downloaded = stats.Downloaded
+		st.lastData = now
+	}
+
+	return stallTimeout <= 0 || now.Sub(st.lastData) < stallTimeout
+}
+
+// grant starts a queued torrent. The session's lock must be held.
+func (st *SessionTorrent) grant(state TorrentState) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.state = state
+	st.lastData = time.Now()
+	close(st.granted)
+}
+
+// waitForSlot queues the torrent until the scheduler starts it
+func (st *SessionTorrent) waitForSlot() error {
+	s := st.session
+
+	s.mu.Lock()
+	st.granted = make(chan struct{})
+	st.setState(TorrentQueued, nil)
+	s.mu.Unlock()
+
+	s.wakeScheduler()
+
+	select {
+	case <-st.granted:
+		return nil
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	}
+}
+
+func (st *SessionTorrent) run() {
+	defer close(st.done)
+	defer st.session.wakeScheduler()
+
+	err := st.waitForSlot()
+	if err == nil {
+		err = st.check()
+	}
+
+	event := "started"
+
+	if err == nil && !st.complete {
+		err = st.waitForSlot()
+		if err == nil {
+			err = st.download()
+			event = "completed"
+		}
+	}
+
+	if err == nil {
+		err = st.waitForSlot()
+	}
+	if err == nil {
+		err = st.seed(event)
+	}
+
+	switch {
+	case st.ctx.Err() != nil:
+		st.setState(TorrentStopped, nil)
+	case err != nil:
+		log.Printf("%s failed: %v\n", st.file.Name, err)
+		st.setState(TorrentFailed, err)
+	default:
+		st.setState(TorrentStopped, nil)
+	}
+}
+
+// check looks at the data already on disk
+func (st *SessionTorrent) check() error {
+	result, err := st.file.Verify(st.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	st.session.mu.Lock()
+	st.checked = true
+	st.complete = err == nil && result.OK()
+	st.session.mu.Unlock()
+
+	return nil
+}
+
+// download fetches the data, which is then complete
+func (st *SessionTorrent) download() error {
+	d, err := st.file.startDownload(st.ctx, st.path, &st.session.swarm, st.rates)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	st.handle = d.Handle
+	st.mu.Unlock()
+
+	err = d.Wait()
+	if err != nil {
+		return err
+	}
+
+	st.session.mu.Lock()
+	st.complete = true
+	st.session.mu.Unlock()
+
+	return nil
+}
+
+// seed serves the complete data to peers connecting through the session
+// until the torrent is stopped
+func (st *SessionTorrent) seed(event string) error {
+	data, err := os.Open(st.path)
+	if err != nil {
+		return err
+	}
+
+	torrent := st.file.p2pTorrent(&st.session.swarm, st.rates)
+
+	st.mu.Lock()
+	st.seeding = &torrent
+	st.data = data
+	st.mu.Unlock()
+
+	stopAnnouncing := st.file.advertise(st.ctx, &st.session.swarm, event)
+
+	<-st.ctx.Done()
+
+	st.mu.Lock()
+	st.seeding = nil
+	st.mu.Unlock()
+
+	stopAnnouncing()
+	st.uploads.Wait()
+	return data.Close()
+}
+
+// serve uploads to a peer that connected through the session. A torrent
+// downloaded in this session counts the upload in its handle's Stats.
+func (st *SessionTorrent) serve(conn net.Conn, res *handshake.Handshake) error {
+	st.mu.Lock()
+	torrent, data, handle := st.seeding, st.data, st.handle
+	if torrent == nil {
+		st.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("%s is not seeding", st.file.Name)
+	}
+	st.uploads.Add(1)
+	st.mu.Unlock()
+
+	defer st.uploads.Done()
+
+	if handle != nil {
+		return handle.ServePeer(st.ctx, conn, res, data)
+	}
+	return torrent.ServePeer(st.ctx, conn, res, data)
+}
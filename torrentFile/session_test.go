@@ -0,0 +1,381 @@
+package torrentfile
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/prabal199251/Torrent-Client/ratelimit"
+	"github.com/prabal199251/Torrent-Client/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func newTestSession(t *testing.T, opts SessionOptions) *Session {
+	opts.Port = freePort(t)
+
+	s, err := NewSession(opts)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func waitForState(t *testing.T, st *SessionTorrent, state TorrentState) {
+	require.Eventually(t, func() bool { return st.State() == state }, 10*time.Second, 10*time.Millisecond, "waiting for %s, torrent is %s (%v)", state, st.State(), st.Err())
+}
+
+func TestSession(t *testing.T) {
+	store := tracker.NewStore(time.Hour)
+	srv := httptest.NewServer(tracker.NewServer(store, time.Minute).Handler())
+	defer srv.Close()
+
+	path, data := writeRandomFile(t, 5*MinPieceLength+300)
+	tf, err := Create(path, srv.URL+"/announce", MinPieceLength)
+	require.Nil(t, err)
+
+	seeder := newTestSession(t, SessionOptions{})
+	seeding, err := seeder.Add(&tf, path)
+	require.Nil(t, err)
+	waitForState(t, seeding, TorrentSeeding)
+	assert.Nil(t, seeding.Handle())
+
+	require.Eventually(t, func() bool {
+		return store.Scrape([][20]byte{tf.InfoHash})[tf.InfoHash].Complete == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	leecher := newTestSession(t, SessionOptions{MaxConns: 4, MaxDials: 2, MaxDownloads: 1})
+	out := filepath.Join(t.TempDir(), "out.bin")
+	downloading, err := leecher.Add(&tf, out)
+	require.Nil(t, err)
+
+	// Nobody seeds this one, so it downloads forever once it starts
+	next := unseededTorrent(t, srv.URL)
+	queued, err := leecher.Add(next, filepath.Join(t.TempDir(), "next.bin"))
+	require.Nil(t, err)
+
+	waitForState(t, downloading, TorrentSeeding)
+	require.NotNil(t, downloading.Handle())
+
+	// Completing the first download frees its slot
+	waitForState(t, queued, TorrentDownloading)
+
+	downloaded, err := os.ReadFile(out)
+	require.Nil(t, err)
+	assert.Equal(t, data, downloaded)
+
+	// Both now seed, so the tracker counts two complete peers
+	require.Eventually(t, func() bool {
+		return store.Scrape([][20]byte{tf.InfoHash})[tf.InfoHash].Complete == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Nil(t, seeder.Remove(tf.InfoHash))
+	assert.Equal(t, TorrentStopped, seeding.State())
+	assert.Empty(t, seeder.Torrents())
+}
+
+// staticSource hands out the same peers for every torrent, and records the
+// port it was asked to announce for each
+type staticSource struct {
+	peers []peers.Peer
+
+	mu    sync.Mutex
+	ports map[[20]byte]uint16
+}
+
+func (s *staticSource) Peers(ctx context.Context, infoHash [20]byte, port uint16) <-chan peers.Peer {
+	s.mu.Lock()
+	if s.ports == nil {
+		s.ports = make(map[[20]byte]uint16)
+	}
+	s.ports[infoHash] = port
+	s.mu.Unlock()
+
+	ch := make(chan peers.Peer)
+	go func() {
+		defer close(ch)
+
+		for _, peer := range s.peers {
+			select {
+			case ch <- peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+
+	return ch
+}
+
+func (s *staticSource) port(infoHash [20]byte) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ports[infoHash]
+}
+
+func TestSessionPeerSource(t *testing.T) {
+	store := tracker.NewStore(time.Hour)
+	srv := httptest.NewServer(tracker.NewServer(store, time.Minute).Handler())
+	defer srv.Close()
+
+	path, data := writeRandomFile(t, 3*MinPieceLength)
+	tf, err := Create(path, srv.URL+"/announce", MinPieceLength)
+	require.Nil(t, err)
+
+	// The seeder keeps away from the tracker, so only the source knows it
+	seederSource := &staticSource{}
+	seeder := newTestSession(t, SessionOptions{PeerSource: seederSource})
+	untracked := tf
+	untracked.Announce = ""
+	seeding, err := seeder.Add(&untracked, path)
+	require.Nil(t, err)
+	waitForState(t, seeding, TorrentSeeding)
+
+	source := &staticSource{peers: []peers.Peer{{IP: net.IPv4(127, 0, 0, 1), Port: seeder.opts.port()}}}
+	leecher := newTestSession(t, SessionOptions{PeerSource: source})
+	out := filepath.Join(t.TempDir(), "out.bin")
+	st, err := leecher.Add(&tf, out)
+	require.Nil(t, err)
+	waitForState(t, st, TorrentSeeding)
+
+	downloaded, err := os.ReadFile(out)
+	require.Nil(t, err)
+	assert.Equal(t, data, downloaded)
+
+	assert.Equal(t, leecher.opts.port(), source.port(tf.InfoHash))
+	require.Eventually(t, func() bool {
+		return seederSource.port(tf.InfoHash) == seeder.opts.port()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionTorrents(t *testing.T) {
+	s := newTestSession(t, SessionOptions{})
+
+	pathA, _ := writeRandomFile(t, 100)
+	a, err := Create(pathA, "", 0)
+	require.Nil(t, err)
+
+	pathB, _ := writeRandomFile(t, 200)
+	b, err := Create(pathB, "", 0)
+	require.Nil(t, err)
+
+	stA, err := s.Add(&a, pathA)
+	require.Nil(t, err)
+	stB, err := s.Add(&b, pathB)
+	require.Nil(t, err)
+
+	_, err = s.Add(&a, pathA)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []*SessionTorrent{stA, stB}, s.Torrents())
+	assert.Equal(t, stB, s.Torrent(b.InfoHash))
+	assert.Nil(t, s.Torrent([20]byte{1}))
+	assert.NotNil(t, s.Remove([20]byte{1}))
+
+	waitForState(t, stA, TorrentSeeding)
+	waitForState(t, stB, TorrentSeeding)
+
+	require.Nil(t, s.Close())
+	assert.Equal(t, TorrentStopped, stA.State())
+	assert.Equal(t, TorrentStopped, stB.State())
+
+	_, err = s.Add(&a, pathA)
+	assert.Equal(t, errSessionClosed, err)
+}
+
+// unseededTorrent makes a torrent announced to trackerURL whose data
+// exists nowhere
+func unseededTorrent(t *testing.T, trackerURL string) *TorrentFile {
+	path, _ := writeRandomFile(t, 2*MinPieceLength)
+	tf, err := Create(path, trackerURL+"/announce", MinPieceLength)
+	require.Nil(t, err)
+	require.Nil(t, os.Remove(path))
+
+	return &tf
+}
+
+func TestSessionQueue(t *testing.T) {
+	store := tracker.NewStore(time.Hour)
+	srv := httptest.NewServer(tracker.NewServer(store, time.Minute).Handler())
+	defer srv.Close()
+
+	s := newTestSession(t, SessionOptions{MaxDownloads: 1})
+	dir := t.TempDir()
+
+	var torrents []*SessionTorrent
+	for i := 0; i < 3; i++ {
+		st, err := s.Add(unseededTorrent(t, srv.URL), filepath.Join(dir, strconv.Itoa(i)))
+		require.Nil(t, err)
+		torrents = append(torrents, st)
+	}
+
+	waitForState(t, torrents[0], TorrentDownloading)
+	waitForState(t, torrents[1], TorrentQueued)
+	waitForState(t, torrents[2], TorrentQueued)
+
+	// The last torrent jumps the queue
+	last := torrents[2].File().InfoHash
+	require.Nil(t, s.Move(last, 0))
+	assert.Equal(t, 0, s.QueuePosition(last))
+	assert.Equal(t, []*SessionTorrent{torrents[2], torrents[0], torrents[1]}, s.Torrents())
+
+	assert.NotNil(t, s.Move([20]byte{1}, 0))
+	assert.NotNil(t, s.Move(last, -1))
+	assert.Equal(t, -1, s.QueuePosition([20]byte{1}))
+
+	require.Nil(t, s.Remove(torrents[0].File().InfoHash))
+	waitForState(t, torrents[2], TorrentDownloading)
+	assert.Equal(t, TorrentQueued, torrents[1].State())
+
+	// Past the end is the back of the queue
+	require.Nil(t, s.Move(last, 10))
+	assert.Equal(t, 1, s.QueuePosition(last))
+}
+
+func TestSessionStalled(t *testing.T) {
+	store := tracker.NewStore(time.Hour)
+	srv := httptest.NewServer(tracker.NewServer(store, time.Minute).Handler())
+	defer srv.Close()
+
+	s := newTestSession(t, SessionOptions{MaxDownloads: 1, StallTimeout: 200 * time.Millisecond})
+	dir := t.TempDir()
+
+	stalled, err := s.Add(unseededTorrent(t, srv.URL), filepath.Join(dir, "a"))
+	require.Nil(t, err)
+	next, err := s.Add(unseededTorrent(t, srv.URL), filepath.Join(dir, "b"))
+	require.Nil(t, err)
+
+	waitForState(t, stalled, TorrentDownloading)
+
+	// Without any peers the first download never gets data, so the second
+	// starts once it stalls
+	waitForState(t, next, TorrentDownloading)
+	assert.True(t, stalled.Stalled())
+}
+
+func TestSessionMaxSeeds(t *testing.T) {
+	s := newTestSession(t, SessionOptions{MaxSeeds: 1})
+
+	pathA, _ := writeRandomFile(t, 100)
+	a, err := Create(pathA, "", 0)
+	require.Nil(t, err)
+
+	pathB, _ := writeRandomFile(t, 200)
+	b, err := Create(pathB, "", 0)
+	require.Nil(t, err)
+
+	stA, err := s.Add(&a, pathA)
+	require.Nil(t, err)
+	stB, err := s.Add(&b, pathB)
+	require.Nil(t, err)
+
+	waitForState(t, stA, TorrentSeeding)
+	waitForState(t, stB, TorrentQueued)
+	assert.False(t, stB.Stalled())
+
+	require.Nil(t, s.Remove(a.InfoHash))
+	waitForState(t, stB, TorrentSeeding)
+}
+
+func TestSessionRateLimit(t *testing.T) {
+	store := tracker.NewStore(time.Hour)
+	srv := httptest.NewServer(tracker.NewServer(store, time.Minute).Handler())
+	defer srv.Close()
+
+	path, data := writeRandomFile(t, 4*MinPieceLength)
+	tf, err := Create(path, srv.URL+"/announce", MinPieceLength)
+	require.Nil(t, err)
+
+	seeder := newTestSession(t, SessionOptions{})
+	seeding, err := seeder.Add(&tf, path)
+	require.Nil(t, err)
+	waitForState(t, seeding, TorrentSeeding)
+
+	rate := int64(2 * MinPieceLength)
+	leecher := newTestSession(t, SessionOptions{TotalDownloadRate: rate})
+
+	download, upload := leecher.RateLimit()
+	assert.Equal(t, rate, download)
+	assert.Equal(t, int64(0), upload)
+
+	start := time.Now()
+	downloading, err := leecher.Add(&tf, filepath.Join(t.TempDir(), "out.bin"))
+	require.Nil(t, err)
+	waitForState(t, downloading, TorrentSeeding)
+
+	// A second's worth goes through at once, the rest at the rate
+	minimum := time.Duration(float64(int64(len(data))-rate) / float64(rate) * float64(time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), minimum)
+
+	leecher.SetRateLimit(0, 1000)
+	download, upload = leecher.RateLimit()
+	assert.Equal(t, int64(0), download)
+	assert.Equal(t, int64(1000), upload)
+
+	downloading.SetRateLimit(100, 200)
+	assert.Equal(t, int64(100), downloading.rates.torrent.Download.Rate())
+	assert.Equal(t, int64(200), downloading.rates.torrent.Upload.Rate())
+
+	downloading.SetPeerRateLimit(300, 400)
+	download, upload = downloading.rates.peer.Rates()
+	assert.Equal(t, int64(300), download)
+	assert.Equal(t, int64(400), upload)
+}
+
+func TestSessionSchedule(t *testing.T) {
+	schedule := &ratelimit.Schedule{
+		Profiles: []ratelimit.Profile{{Name: "slow", Download: 1000, Upload: 2000}},
+		Default:  "slow",
+	}
+
+	s := newTestSession(t, SessionOptions{Schedule: schedule, TotalDownloadRate: 5})
+
+	require.Eventually(t, func() bool {
+		download, upload := s.RateLimit()
+		return download == 1000 && upload == 2000
+	}, time.Second, time.Millisecond)
+
+	profile, ok := s.Profile()
+	assert.True(t, ok)
+	assert.Equal(t, "slow", profile.Name)
+
+	_, ok = newTestSession(t, SessionOptions{}).Profile()
+	assert.False(t, ok)
+
+	schedule.Default = "fast"
+	_, err := NewSession(SessionOptions{Schedule: schedule})
+	assert.NotNil(t, err)
+}
+
+func TestSessionTorrentFails(t *testing.T) {
+	s := newTestSession(t, SessionOptions{})
+
+	path, _ := writeRandomFile(t, 100)
+	tf, err := Create(path, "", 0)
+	require.Nil(t, err)
+
+	// A directory where the file should be
+	st, err := s.Add(&tf, t.TempDir())
+	require.Nil(t, err)
+
+	<-st.Done()
+	assert.Equal(t, TorrentFailed, st.State())
+	assert.NotNil(t, st.Err())
+}
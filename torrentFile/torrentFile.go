@@ -2,17 +2,29 @@ package torrentfile
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jackpal/bencode-go"
+	"github.com/prabal199251/Torrent-Client/ipfilter"
+	"github.com/prabal199251/Torrent-Client/lsd"
 	"github.com/prabal199251/Torrent-Client/p2p"
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/prabal199251/Torrent-Client/ratelimit"
 )
 
 const Port uint16 = 6881
 
+var errMultiFile = errors.New("downloading and seeding multi-file torrents is not supported yet")
+
 type TorrentFile struct {
 	Announce    string
 	InfoHash    [20]byte
@@ -20,13 +32,64 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+
+	// Files lists the files of a multi-file torrent in the order their
+	// data is laid out, padding files included. It is nil for single-file
+	// torrents.
+	Files []File
+}
+
+// Options configures downloading and seeding. The zero value uses Port
+// and places no limits.
+type Options struct {
+	Port     uint16
+	MaxPeers int
+
+	// Filter, if set, blocks peers from every source before they are dialed
+	Filter *ipfilter.Filter
+
+	// DownloadRate and UploadRate cap the torrent's traffic, and
+	// PeerDownloadRate and PeerUploadRate each peer's, in bytes per second.
+	// 0 means no limit.
+	DownloadRate     int64
+	UploadRate       int64
+	PeerDownloadRate int64
+	PeerUploadRate   int64
+}
+
+func (o Options) port() uint16 {
+	if o.Port == 0 {
+		return Port
+	}
+	return o.Port
+}
+
+// rates throttle one torrent: all of its peers together, and each of them
+// on its own
+type rates struct {
+	torrent *ratelimit.Limits
+	peer    *ratelimit.PerConn
+}
+
+func (o Options) rates() rates {
+	return rates{
+		torrent: ratelimit.NewLimits(o.DownloadRate, o.UploadRate),
+		peer:    ratelimit.NewPerConn(o.PeerDownloadRate, o.PeerUploadRate),
+	}
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr,omitempty"`
 }
 
 type bencodeTorrent struct {
@@ -34,66 +97,281 @@ type bencodeTorrent struct {
 	Info     bencodeInfo `bencode:"info"`
 }
 
-func (t *TorrentFile) DownloadToFile(path string) error {
+// Download is a download started with StartDownload. The embedded handle
+// pauses, resumes and reports on it.
+type Download struct {
+	*p2p.Handle
 
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+	cleanup []func()
+	once    sync.Once
+}
+
+// Wait blocks until the download ends, then closes the output file and
+// tells the tracker we have left the swarm
+func (d *Download) Wait() error {
+	err := d.Handle.Wait()
+
+	d.once.Do(func() {
+		for i := len(d.cleanup) - 1; i >= 0; i-- {
+			d.cleanup[i]()
+		}
+	})
+
+	return err
+}
+
+// DownloadToFile downloads the torrent and writes it to path. Cancelling
+// ctx stops the download and tells the tracker we have left the swarm.
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, opts Options) error {
+	d, err := t.StartDownload(ctx, path, opts)
 	if err != nil {
 		return err
 	}
 
-	peers, err := t.requestPeers(peerID, Port)
+	return d.Wait()
+}
+
+// StartDownload starts downloading the torrent to path in the background.
+// Pieces are written to the file as soon as they are verified.
+func (t *TorrentFile) StartDownload(ctx context.Context, path string, opts Options) (*Download, error) {
+	if t.Files != nil {
+		return nil, errMultiFile
+	}
+
+	peerID, err := newPeerID()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	s := &swarm{peerID: peerID, port: opts.port(), opts: opts}
+
+	s.lsd = listenLocal(s.port)
+	for _, service := range s.lsd {
+		go service.Serve()
+	}
+
+	d, err := t.startDownload(ctx, path, s, opts.rates())
+	if err != nil {
+		s.closeLocal()
+		return nil, err
 	}
 
-	torrent := p2p.Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
+	d.cleanup = append([]func(){s.closeLocal}, d.cleanup...)
+
+	return d, nil
+}
+
+// swarm is what downloading or seeding a torrent shares with the rest of
+// the process
+type swarm struct {
+	peerID [20]byte
+	port   uint16
+	opts   Options
+
+	// lsd runs local service discovery on each IP family where it is
+	// available
+	lsd []*lsd.Service
+	// source is nil unless the session was given one
+	source PeerSource
+
+	conns *p2p.ConnLimit
+	dials *p2p.ConnLimit
+	bans  *p2p.BanList
+
+	// limits throttle every torrent together; nil means no limit
+	limits *ratelimit.Limits
+}
+
+// listenLocal joins the IPv4 and IPv6 local service discovery groups,
+// whichever are available
+func listenLocal(port uint16) []*lsd.Service {
+	var services []*lsd.Service
+
+	for _, family := range []struct {
+		name   string
+		listen func(port uint16) (*lsd.Service, error)
+	}{{"IPv4", lsd.Listen}, {"IPv6", lsd.Listen6}} {
+		service, err := family.listen(port)
+		if err != nil {
+			log.Printf("Local service discovery over %s unavailable: %v\n", family.name, err)
+			continue
+		}
+		services = append(services, service)
+	}
+
+	return services
+}
+
+func (s *swarm) closeLocal() {
+	for _, service := range s.lsd {
+		service.Close()
+	}
+}
+
+func newPeerID() ([20]byte, error) {
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:])
+	return peerID, err
+}
+
+// p2pTorrent describes the torrent to the p2p package
+func (t *TorrentFile) p2pTorrent(s *swarm, r rates) p2p.Torrent {
+	return p2p.Torrent{
+		PeerID:      s.peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Filter:      s.opts.Filter,
+		MaxPeers:    s.opts.MaxPeers,
+		Conns:       s.conns,
+		Dials:       s.dials,
+		Bans:        s.bans,
+		Limits:      []*ratelimit.Limits{r.torrent, s.limits},
+		PeerLimits:  r.peer,
 	}
+}
 
-	buf, err := torrent.Download()
-	if err != nil {
-		return err
+// startDownload finds peers and starts downloading to path. The download's
+// cleanup tells the tracker we left.
+func (t *TorrentFile) startDownload(ctx context.Context, path string, s *swarm, r rates) (*Download, error) {
+	d := &Download{}
+
+	fail := func(err error) (*Download, error) {
+		for i := len(d.cleanup) - 1; i >= 0; i-- {
+			d.cleanup[i]()
+		}
+		return nil, err
 	}
 
-	outFile, err := os.Create(path)
+	found, err := t.requestPeers(ctx, s.peerID, s.port)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer outFile.Close()
+	d.cleanup = append(d.cleanup, func() {
+		err := t.announceStopped(s.peerID, s.port)
+		if err != nil {
+			log.Printf("Could not send stopped event to tracker: %v\n", err)
+		}
+	})
 
-	_, err = outFile.Write(buf)
+	torrent := t.p2pTorrent(s, r)
+	torrent.Peers = filterPeers(found, s.opts.Filter)
 
+	discoverCtx, stopDiscovery := context.WithCancel(ctx)
+	d.cleanup = append(d.cleanup, stopDiscovery)
+
+	var discovered []<-chan peers.Peer
+	for _, service := range s.lsd {
+		go announceLocally(ctx, service, t.InfoHash)
+		discovered = append(discovered, service.Watch(t.InfoHash))
+		d.cleanup = append(d.cleanup, func() { service.Unwatch(t.InfoHash) })
+	}
+	if s.source != nil {
+		discovered = append(discovered, s.source.Peers(discoverCtx, t.InfoHash, s.port))
+	}
+
+	switch len(discovered) {
+	case 0:
+	case 1:
+		torrent.NewPeers = discovered[0]
+	default:
+		torrent.NewPeers = mergePeers(discoverCtx, discovered...)
+	}
+
+	outFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		return err
+		return fail(err)
+	}
+
+	d.cleanup = append(d.cleanup, func() { outFile.Close() })
+
+	err = outFile.Truncate(int64(t.Length))
+	if err != nil {
+		return fail(err)
 	}
 
-	return nil
+	torrent.Storage = outFile
+
+	d.Handle = torrent.Start(ctx)
+	return d, nil
+}
+
+func announceLocally(ctx context.Context, s *lsd.Service, infoHash [20]byte) {
+	ticker := time.NewTicker(lsd.AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		err := s.Announce(infoHash)
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// mergePeers forwards the peers sent on every channel to one, which is
+// closed once they all are or ctx is cancelled
+func mergePeers(ctx context.Context, chans ...<-chan peers.Peer) <-chan peers.Peer {
+	out := make(chan peers.Peer)
+
+	var wg sync.WaitGroup
+	for _, ch := range chans {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for peer := range ch {
+				select {
+				case out <- peer:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
 }
 
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	defer file.Close()
-
 	bto := bencodeTorrent{}
 
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	t, err := bto.toTorrentFile()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	return bto.toTorrentFile()
+	// bencodeInfo only knows some of the keys, so hash what the file holds
+	rawInfo, err := infoBytes(data)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	t.InfoHash = sha1.Sum(rawInfo)
+
+	return t, nil
 }
 
 func (i *bencodeInfo) hash() ([20]byte, error) {
@@ -146,5 +424,19 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 		Length:      bto.Info.Length,
 		Name:        bto.Info.Name,
 	}
+
+	if len(bto.Info.Files) > 0 {
+		t.Length = 0
+
+		for _, f := range bto.Info.Files {
+			t.Files = append(t.Files, File{
+				Path:    append([]string{bto.Info.Name}, f.Path...),
+				Length:  int64(f.Length),
+				Padding: strings.ContainsRune(f.Attr, 'p'),
+			})
+			t.Length += f.Length
+		}
+	}
+
 	return t, nil
 }
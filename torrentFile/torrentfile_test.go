@@ -1,11 +1,17 @@
 package torrentfile
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/prabal199251/Torrent-Client/peers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -92,3 +98,51 @@ func TestToTorrentFile(t *testing.T) {
 
 	}
 }
+
+func TestOpenMultiFile(t *testing.T) {
+	data := encode(t, map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"name":         "set",
+			"piece length": 16384,
+			"pieces":       strings.Repeat("x", 40),
+			"files": []interface{}{
+				map[string]interface{}{"length": 20000, "path": []interface{}{"a.bin"}},
+				map[string]interface{}{"length": 12768, "path": []interface{}{".pad", "12768"}, "attr": "p"},
+				map[string]interface{}{"length": 100, "path": []interface{}{"sub", "b.bin"}},
+			},
+		},
+	})
+
+	path := filepath.Join(t.TempDir(), "set.torrent")
+	require.Nil(t, os.WriteFile(path, data, 0644))
+
+	torrent, err := Open(path)
+	require.Nil(t, err)
+
+	assert.Equal(t, 32868, torrent.Length)
+	assert.Equal(t, []File{
+		{Path: []string{"set", "a.bin"}, Length: 20000},
+		{Path: []string{"set", ".pad", "12768"}, Length: 12768, Padding: true},
+		{Path: []string{"set", "sub", "b.bin"}, Length: 100},
+	}, torrent.Files)
+
+	_, err = torrent.StartDownload(context.Background(), filepath.Join(t.TempDir(), "set"), Options{})
+	assert.Equal(t, errMultiFile, err)
+}
+
+func TestMergePeers(t *testing.T) {
+	ipv4 := make(chan peers.Peer, 1)
+	ipv6 := make(chan peers.Peer, 1)
+	ipv4 <- peers.Peer{IP: net.IPv4(192, 168, 1, 2), Port: 6881}
+	ipv6 <- peers.Peer{IP: net.ParseIP("fe80::2"), Port: 6881}
+	close(ipv4)
+	close(ipv6)
+
+	var found []string
+	for peer := range mergePeers(context.Background(), ipv4, ipv6) {
+		found = append(found, peer.String())
+	}
+
+	assert.ElementsMatch(t, []string{"192.168.1.2:6881", "[fe80::2]:6881"}, found)
+}
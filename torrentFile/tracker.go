@@ -1,18 +1,63 @@
 package torrentfile
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/jackpal/bencode-go"
+	"github.com/prabal199251/Torrent-Client/ipfilter"
 	"github.com/prabal199251/Torrent-Client/peers"
 )
 
+const trackerMaxAttempts = 4
+
+// trackerStoppedTimeout bounds the farewell announce sent on shutdown, which
+// must not hold up exiting
+const trackerStoppedTimeout = 5 * time.Second
+
+var trackerBackoff = 1 * time.Second
+
 type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int    `bencode:"interval"`
+	Complete       int    `bencode:"complete"`
+	Incomplete     int    `bencode:"incomplete"`
+	Peers          string `bencode:"peers"`
+}
+
+type TrackerFailureError struct {
+	Reason string
+}
+
+func (e *TrackerFailureError) Error() string {
+	return fmt.Sprintf("tracker failure: %s", e.Reason)
+}
+
+type TrackerStatusError struct {
+	StatusCode int
+}
+
+func (e *TrackerStatusError) Error() string {
+	return fmt.Sprintf("tracker responded with status %d", e.StatusCode)
+}
+
+// TrackerDecodeError reports a tracker response that is not valid bencode
+type TrackerDecodeError struct {
+	Err error
+}
+
+func (e *TrackerDecodeError) Error() string {
+	return fmt.Sprintf("malformed tracker response: %v", e.Err)
+}
+
+func (e *TrackerDecodeError) Unwrap() error {
+	return e.Err
 }
 
 func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
@@ -35,27 +80,132 @@ func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 	return base.String(), nil
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
+func (t *TorrentFile) requestPeers(ctx context.Context, peerID [20]byte, port uint16) ([]peers.Peer, error) {
 	url, err := t.buildTrackerURL(peerID, port)
 	if err != nil {
 		return nil, err
 	}
 
 	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	backoff := trackerBackoff
+
+	for attempt := 1; ; attempt++ {
+		trackerResp, err := announce(ctx, c, url)
+		if err == nil {
+			if trackerResp.WarningMessage != "" {
+				log.Printf("Tracker warning: %s\n", trackerResp.WarningMessage)
+			}
+			log.Printf("Tracker reports %d seeders, %d leechers\n", trackerResp.Complete, trackerResp.Incomplete)
+
+			return peers.Unmarshal([]byte(trackerResp.Peers))
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if !retryable(err) || attempt == trackerMaxAttempts {
+			return nil, err
+		}
+
+		log.Printf("Tracker request failed (%v), retrying in %s\n", err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// announceStopped tells the tracker we are leaving the swarm. It runs even
+// after the download's context is cancelled, under its own short timeout.
+func (t *TorrentFile) announceStopped(peerID [20]byte, port uint16) error {
+	ctx, cancel := context.WithTimeout(context.Background(), trackerStoppedTimeout)
+	defer cancel()
+
+	_, err := t.announceEvent(ctx, http.DefaultClient, peerID, port, "stopped", t.Length)
+	return err
+}
+
+// announceEvent makes a single announce reporting event, if not empty,
+// and left bytes still to download
+func (t *TorrentFile) announceEvent(ctx context.Context, c *http.Client, peerID [20]byte, port uint16, event string, left int) (*bencodeTrackerResp, error) {
+	base, err := t.buildTrackerURL(peerID, port)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+
+	params := u.Query()
+	params.Set("left", strconv.Itoa(left))
+	if event != "" {
+		params.Set("event", event)
+	}
+	u.RawQuery = params.Encode()
 
+	return announce(ctx, c, u.String())
+}
+
+func announce(ctx context.Context, c *http.Client, url string) (*bencodeTrackerResp, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, &TrackerStatusError{StatusCode: resp.StatusCode}
+	}
+
 	trackerResp := bencodeTrackerResp{}
 	err = bencode.Unmarshal(resp.Body, &trackerResp)
-
 	if err != nil {
-		return nil, err
+		return nil, &TrackerDecodeError{Err: err}
+	}
+
+	if trackerResp.FailureReason != "" {
+		return nil, &TrackerFailureError{Reason: trackerResp.FailureReason}
+	}
+
+	return &trackerResp, nil
+}
+
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *TrackerFailureError, *TrackerDecodeError:
+		return false
+	case *TrackerStatusError:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+func filterPeers(found []peers.Peer, filter *ipfilter.Filter) []peers.Peer {
+	allowed := found[:0]
+
+	for _, peer := range found {
+		if !filter.Blocked(peer.IP) {
+			allowed = append(allowed, peer)
+		}
+	}
+
+	if n := len(found) - len(allowed); n > 0 {
+		log.Printf("IP filter removed %d of %d tracker peers\n", n, len(found))
 	}
 
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+	return allowed
 }
@@ -1,13 +1,19 @@
 package torrentfile
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prabal199251/Torrent-Client/ipfilter"
 	"github.com/prabal199251/Torrent-Client/peers"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBuildTrackerURL(t *testing.T) {
@@ -60,7 +66,165 @@ func TestRequestPeers(t *testing.T) {
 		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
 	}
-	p, err := tf.requestPeers(peerID, port)
+	p, err := tf.requestPeers(context.Background(), peerID, port)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, p)
 }
+
+func TestFilterPeers(t *testing.T) {
+	ranges, err := ipfilter.Parse(strings.NewReader("192.0.2.0/24\n"))
+	require.Nil(t, err)
+
+	found := []peers.Peer{
+		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+	}
+
+	allowed := filterPeers(found, ipfilter.New(ranges))
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6889}}, allowed)
+
+	assert.Len(t, filterPeers(allowed, nil), 1)
+}
+
+func newTestTorrentFile(announce string) TorrentFile {
+	return TorrentFile{
+		Announce:    announce,
+		InfoHash:    [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		PieceLength: 262144,
+		Length:      351272960,
+		Name:        "debian-10.2.0-amd64-netinst.iso",
+	}
+}
+
+func TestRequestPeersTrackerResponses(t *testing.T) {
+	trackerBackoff = time.Millisecond
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	tests := map[string]struct {
+		responses []func(w http.ResponseWriter)
+		output    []peers.Peer
+		failure   string
+		status    int
+		malformed bool
+		calls     int
+	}{
+		"failure reason": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.Write([]byte("d14:failure reason17:torrent not founde")) },
+			},
+			failure: "torrent not found",
+			calls:   1,
+		},
+		"warning message is not fatal": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) {
+					w.Write([]byte("d15:warning message4:slow8:completei3e10:incompletei7e8:intervali900e5:peers6:" +
+						string([]byte{127, 0, 0, 1, 0x1A, 0xE1}) + "e"))
+				},
+			},
+			output: []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+			calls:  1,
+		},
+		"malformed response is not retried": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.Write([]byte("<html>not bencode</html>")) },
+			},
+			malformed: true,
+			calls:     1,
+		},
+		"client error is not retried": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) },
+			},
+			status: http.StatusNotFound,
+			calls:  1,
+		},
+		"server error is retried": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) },
+				func(w http.ResponseWriter) {
+					w.Write([]byte("d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE9}) + "e"))
+				},
+			},
+			output: []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6889}},
+			calls:  3,
+		},
+		"gives up after max attempts": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) },
+			},
+			status: http.StatusInternalServerError,
+			calls:  trackerMaxAttempts,
+		},
+	}
+
+	for name, test := range tests {
+		calls := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i := calls
+			if i >= len(test.responses) {
+				i = len(test.responses) - 1
+			}
+			calls++
+			test.responses[i](w)
+		}))
+
+		tf := newTestTorrentFile(ts.URL)
+		p, err := tf.requestPeers(context.Background(), peerID, 6882)
+		ts.Close()
+
+		assert.Equal(t, test.calls, calls, name)
+
+		switch {
+		case test.failure != "":
+			var failure *TrackerFailureError
+			require.True(t, errors.As(err, &failure), name)
+			assert.Equal(t, test.failure, failure.Reason, name)
+		case test.malformed:
+			var malformed *TrackerDecodeError
+			assert.True(t, errors.As(err, &malformed), name)
+		case test.status != 0:
+			var status *TrackerStatusError
+			require.True(t, errors.As(err, &status), name)
+			assert.Equal(t, test.status, status.StatusCode, name)
+		default:
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, p, name)
+		}
+	}
+}
+
+func TestRequestPeersCancelled(t *testing.T) {
+	defer func(d time.Duration) { trackerBackoff = d }(trackerBackoff)
+	trackerBackoff = time.Minute
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	tf := newTestTorrentFile(ts.URL)
+	start := time.Now()
+	_, err := tf.requestPeers(ctx, [20]byte{}, 6882)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestAnnounceStopped(t *testing.T) {
+	var event string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event = r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	tf := newTestTorrentFile(ts.URL)
+	err := tf.announceStopped([20]byte{}, 6882)
+	require.Nil(t, err)
+	assert.Equal(t, "stopped", event)
+}
@@ -0,0 +1,292 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// VerifyResult is what checking data against a torrent found
+type VerifyResult struct {
+	Pieces int
+
+	// Bad holds the indexes of missing or corrupt pieces, in order
+	Bad []int
+
+	Files []FileResult
+}
+
+// OK reports whether every piece and file checked out
+func (r *VerifyResult) OK() bool {
+	if len(r.Bad) > 0 {
+		return false
+	}
+	for _, f := range r.Files {
+		if !f.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// Percent is the share of pieces that checked out
+func (r *VerifyResult) Percent() float64 {
+	if r.Pieces == 0 {
+		return 100
+	}
+	return float64(r.Pieces-len(r.Bad)) / float64(r.Pieces) * 100
+}
+
+// FileResult is how one file of the torrent checked out
+type FileResult struct {
+	File
+
+	// Size is the size of the file on disk, or -1 if it does not exist
+	Size int64
+
+	// BadPieces counts the bad pieces holding data of this file
+	BadPieces int
+}
+
+func (f FileResult) OK() bool {
+	return f.Size == f.Length && f.BadPieces == 0
+}
+
+// Status describes the file in a word: ok, missing, incomplete, oversized
+// or corrupt
+func (f FileResult) Status() string {
+	switch {
+	case f.Size < 0:
+		return "missing"
+	case f.Size < f.Length:
+		return "incomplete"
+	case f.Size > f.Length:
+		return "oversized"
+	case f.BadPieces > 0:
+		return "corrupt"
+	}
+	return "ok"
+}
+
+// dataFile is a file of the torrent as laid out in its data
+type dataFile struct {
+	File
+	offset int64
+	// file is nil for padding and missing files
+	file *os.File
+	size int64
+}
+
+// Verify hashes the data at path against the torrent, on as many CPUs as
+// are available. path is the file of a single-file torrent, or the
+// directory named after a multi-file torrent.
+func (t *TorrentFile) Verify(path string) (*VerifyResult, error) {
+	return t.verify(path, runtime.GOMAXPROCS(0))
+}
+
+func (t *TorrentFile) verify(path string, workers int) (*VerifyResult, error) {
+	if t.PieceLength <= 0 || len(t.PieceHashes) != (t.Length+t.PieceLength-1)/t.PieceLength {
+		return nil, fmt.Errorf("torrent has %d pieces of %d bytes for %d bytes of data", len(t.PieceHashes), t.PieceLength, t.Length)
+	}
+
+	files, err := t.openData(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, f := range files {
+			if f.file != nil {
+				f.file.Close()
+			}
+		}
+	}()
+
+	bad := make([]bool, len(t.PieceHashes))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var readErr error
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, t.PieceLength)
+			for index := range indexes {
+				ok, err := t.checkPiece(files, index, buf)
+				if err != nil {
+					mu.Lock()
+					if readErr == nil {
+						readErr = err
+					}
+					mu.Unlock()
+				}
+				bad[index] = !ok
+			}
+		}()
+	}
+
+	for index := range t.PieceHashes {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	result := &VerifyResult{Pieces: len(t.PieceHashes)}
+	var offsets []int64
+
+	for _, f := range files {
+		if !f.Padding {
+			result.Files = append(result.Files, FileResult{File: f.File, Size: f.size})
+			offsets = append(offsets, f.offset)
+		}
+	}
+
+	for index, isBad := range bad {
+		if !isBad {
+			continue
+		}
+		result.Bad = append(result.Bad, index)
+
+		begin, end := t.pieceBounds(index)
+		for i, f := range result.Files {
+			if offsets[i] < end && offsets[i]+f.Length > begin {
+				result.Files[i].BadPieces++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// openData opens every file of the torrent under path. Files that do not
+// exist are left closed, to be reported rather than failing the check.
+func (t *TorrentFile) openData(path string) ([]*dataFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := t.Files
+	if layout == nil {
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory, but the torrent is a single file", path)
+		}
+		layout = []File{{Path: []string{t.Name}, Length: int64(t.Length)}}
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory, but the torrent has several files", path)
+	}
+
+	var files []*dataFile
+	var offset int64
+
+	for _, f := range layout {
+		df := &dataFile{File: f, offset: offset, size: -1}
+		files = append(files, df)
+		offset += f.Length
+
+		if f.Padding {
+			df.size = f.Length
+			continue
+		}
+
+		name := path
+		if t.Files != nil {
+			for _, part := range f.Path[1:] {
+				if part == "" || part == "." || part == ".." || filepath.Base(part) != part {
+					return nil, fmt.Errorf("torrent has unsafe file path %q", f.Path)
+				}
+			}
+			name = filepath.Join(append([]string{path}, f.Path[1:]...)...)
+		}
+
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		df.file = file
+		df.size = stat.Size()
+	}
+
+	return files, nil
+}
+
+func (t *TorrentFile) pieceBounds(index int) (begin, end int64) {
+	begin = int64(index) * int64(t.PieceLength)
+	end = begin + int64(t.PieceLength)
+	if end > int64(t.Length) {
+		end = int64(t.Length)
+	}
+	return begin, end
+}
+
+// checkPiece reads a piece, which may span several files, and compares its
+// hash. A piece reaching into a missing or short file is bad.
+func (t *TorrentFile) checkPiece(files []*dataFile, index int, buf []byte) (bool, error) {
+	begin, end := t.pieceBounds(index)
+	buf = buf[:end-begin]
+	piece := buf
+
+	i := sort.Search(len(files), func(i int) bool { return files[i].offset+files[i].Length > begin })
+
+	for ; len(buf) > 0 && i < len(files); i++ {
+		f := files[i]
+		start := begin - f.offset
+
+		n := f.Length - start
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+
+		chunk := buf[:n]
+
+		switch {
+		case f.Padding:
+			clear(chunk)
+		case f.file == nil || f.size < start+n:
+			return false, nil
+		default:
+			n, err := f.file.ReadAt(chunk, start)
+			if err != nil && err != io.EOF {
+				return false, fmt.Errorf("reading piece %d: %w", index, err)
+			}
+			// The file shrank since we looked at it
+			if n < len(chunk) {
+				return false, nil
+			}
+		}
+
+		buf = buf[n:]
+		begin += n
+	}
+
+	if len(buf) > 0 {
+		return false, nil
+	}
+
+	sum := sha1.Sum(piece)
+	return bytes.Equal(sum[:], t.PieceHashes[index][:]), nil
+}
@@ -0,0 +1,134 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	path, data := writeRandomFile(t, 4*MinPieceLength+10)
+
+	tf, err := Create(path, "", MinPieceLength)
+	require.Nil(t, err)
+
+	// Corrupt piece 1 and cut the file off in the middle of piece 3
+	data[MinPieceLength+5] ^= 0xff
+	require.Nil(t, os.WriteFile(path, data[:3*MinPieceLength+100], 0644))
+
+	for _, workers := range []int{1, 4} {
+		result, err := tf.verify(path, workers)
+		require.Nil(t, err)
+
+		assert.Equal(t, 5, result.Pieces)
+		assert.Equal(t, []int{1, 3, 4}, result.Bad)
+		assert.InDelta(t, 40.0, result.Percent(), 0.001)
+		assert.False(t, result.OK())
+		require.Len(t, result.Files, 1)
+		assert.Equal(t, "incomplete", result.Files[0].Status())
+		assert.Equal(t, 3, result.Files[0].BadPieces)
+	}
+
+	_, err = tf.Verify(path + ".missing")
+	assert.NotNil(t, err)
+
+	_, err = tf.Verify(t.TempDir())
+	assert.NotNil(t, err)
+}
+
+// multiFileTorrent lays out files one after another with a padding file
+// after the first, as BEP 47 clients do, and hashes the result
+func multiFileTorrent(t *testing.T, dir string) (*TorrentFile, map[string][]byte) {
+	contents := map[string][]byte{
+		"a.bin":     make([]byte, 20000),
+		"sub/b.bin": make([]byte, 30000),
+		"sub/c.bin": make([]byte, 100),
+	}
+	for _, data := range contents {
+		rand.Read(data)
+	}
+
+	tf := &TorrentFile{
+		Name:        "set",
+		PieceLength: MinPieceLength,
+		Files: []File{
+			{Path: []string{"set", "a.bin"}, Length: 20000},
+			{Path: []string{"set", ".pad", "12768"}, Length: 2*MinPieceLength - 20000, Padding: true},
+			{Path: []string{"set", "sub", "b.bin"}, Length: 30000},
+			{Path: []string{"set", "sub", "c.bin"}, Length: 100},
+		},
+	}
+
+	var all []byte
+	for _, f := range tf.Files {
+		if f.Padding {
+			all = append(all, make([]byte, f.Length)...)
+			continue
+		}
+		all = append(all, contents[filepath.Join(f.Path[1:]...)]...)
+	}
+	tf.Length = len(all)
+
+	for begin := 0; begin < len(all); begin += tf.PieceLength {
+		end := begin + tf.PieceLength
+		if end > len(all) {
+			end = len(all)
+		}
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum(all[begin:end]))
+	}
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	for name, data := range contents {
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+
+	return tf, contents
+}
+
+func TestVerifyMultiFile(t *testing.T) {
+	dir := t.TempDir()
+	tf, contents := multiFileTorrent(t, dir)
+
+	result, err := tf.Verify(dir)
+	require.Nil(t, err)
+	assert.True(t, result.OK())
+	assert.Equal(t, 4, result.Pieces)
+	assert.Len(t, result.Files, 3)
+
+	// Corrupt b.bin in its second piece and remove c.bin, which shares
+	// b.bin's last piece
+	contents["sub/b.bin"][20000] ^= 0xff
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "sub/b.bin"), contents["sub/b.bin"], 0644))
+	require.Nil(t, os.Remove(filepath.Join(dir, "sub/c.bin")))
+
+	result, err = tf.Verify(dir)
+	require.Nil(t, err)
+
+	assert.Equal(t, []int{3}, result.Bad)
+	assert.Equal(t, "ok", result.Files[0].Status())
+	assert.Equal(t, "corrupt", result.Files[1].Status())
+	assert.Equal(t, 1, result.Files[1].BadPieces)
+	assert.Equal(t, "missing", result.Files[2].Status())
+	assert.Equal(t, int64(-1), result.Files[2].Size)
+
+	_, err = tf.Verify(filepath.Join(dir, "a.bin"))
+	assert.NotNil(t, err)
+}
+
+func TestVerifyUnsafePath(t *testing.T) {
+	tf := &TorrentFile{
+		Name:        "set",
+		PieceLength: MinPieceLength,
+		Length:      10,
+		PieceHashes: make([][20]byte, 1),
+		Files:       []File{{Path: []string{"set", "..", "escape"}, Length: 10}},
+	}
+
+	_, err := tf.Verify(t.TempDir())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,253 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+type Server struct {
+	Store    *Store
+	Interval time.Duration
+}
+
+type bencodePeer struct {
+	ID   string `bencode:"peer id"`
+	IP   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+}
+
+type bencodeAnnounceResp struct {
+	Interval   int    `bencode:"interval"`
+	Complete   int    `bencode:"complete"`
+	Incomplete int    `bencode:"incomplete"`
+	Peers      string `bencode:"peers"`
+	Peers6     string `bencode:"peers6,omitempty"`
+}
+
+type bencodeAnnounceRespFull struct {
+	Interval   int           `bencode:"interval"`
+	Complete   int           `bencode:"complete"`
+	Incomplete int           `bencode:"incomplete"`
+	Peers      []bencodePeer `bencode:"peers"`
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+	Downloaded int `bencode:"downloaded"`
+}
+
+type bencodeScrapeResp struct {
+	Files map[string]bencodeScrapeFile `bencode:"files"`
+}
+
+type bencodeFailure struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+func NewServer(store *Store, interval time.Duration) *Server {
+	return &Server{Store: store, Interval: interval}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", s.handleAnnounce)
+	mux.HandleFunc("/scrape", s.handleScrape)
+	return mux
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	go func() {
+		for range time.Tick(s.Interval) {
+			s.Store.Sweep()
+		}
+	}()
+
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, err := parseAnnounce(r)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	res, err := s.Store.Announce(*req)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	interval := int(s.Interval / time.Second)
+
+	if r.URL.Query().Get("compact") == "0" {
+		full := bencodeAnnounceRespFull{
+			Interval:   interval,
+			Complete:   res.Complete,
+			Incomplete: res.Incomplete,
+			Peers:      []bencodePeer{},
+		}
+		for _, p := range res.Peers {
+			full.Peers = append(full.Peers, bencodePeer{
+				ID:   string(p.ID[:]),
+				IP:   p.IP.String(),
+				Port: int(p.Port),
+			})
+		}
+		writeBencode(w, full)
+		return
+	}
+
+	var peers, peers6 bytes.Buffer
+	for _, p := range res.Peers {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, p.Port)
+
+		if ip4 := p.IP.To4(); ip4 != nil {
+			peers.Write(ip4)
+			peers.Write(port)
+		} else {
+			peers6.Write(p.IP.To16())
+			peers6.Write(port)
+		}
+	}
+
+	writeBencode(w, bencodeAnnounceResp{
+		Interval:   interval,
+		Complete:   res.Complete,
+		Incomplete: res.Incomplete,
+		Peers:      peers.String(),
+		Peers6:     peers6.String(),
+	})
+}
+
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, v := range r.URL.Query()["info_hash"] {
+		infoHash, err := parseHash(v)
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	res := bencodeScrapeResp{Files: make(map[string]bencodeScrapeFile)}
+	for infoHash, st := range s.Store.Scrape(infoHashes) {
+		res.Files[string(infoHash[:])] = bencodeScrapeFile{
+			Complete:   st.Complete,
+			Incomplete: st.Incomplete,
+			Downloaded: st.Downloaded,
+		}
+	}
+
+	writeBencode(w, res)
+}
+
+func parseAnnounce(r *http.Request) (*AnnounceRequest, error) {
+	q := r.URL.Query()
+
+	infoHash, err := parseHash(q.Get("info_hash"))
+	if err != nil {
+		return nil, err
+	}
+
+	peerID, err := parseHash(q.Get("peer_id"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer_id")
+	}
+
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port")
+	}
+
+	// Without left we cannot tell a seed from a leecher
+	if q.Get("left") == "" {
+		return nil, fmt.Errorf("missing left")
+	}
+	left, err := parseOptionalInt(q, "left")
+	if err != nil {
+		return nil, err
+	}
+
+	numWant, err := parseOptionalInt(q, "numwant")
+	if err != nil {
+		return nil, err
+	}
+
+	req := AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   peerID,
+		IP:       remoteIP(r),
+		Port:     uint16(port),
+		Left:     left,
+		NumWant:  int(numWant),
+	}
+
+	if ip := net.ParseIP(q.Get("ip")); ip != nil {
+		req.IP = ip
+	}
+
+	switch q.Get("event") {
+	case "":
+	case "started":
+		req.Event = EventStarted
+	case "completed":
+		req.Event = EventCompleted
+	case "stopped":
+		req.Event = EventStopped
+	default:
+		return nil, fmt.Errorf("invalid event %q", q.Get("event"))
+	}
+
+	return &req, nil
+}
+
+func parseHash(s string) ([20]byte, error) {
+	var h [20]byte
+	if len(s) != len(h) {
+		return h, fmt.Errorf("invalid info_hash")
+	}
+	copy(h[:], s)
+	return h, nil
+}
+
+func parseOptionalInt(q url.Values, key string) (int64, error) {
+	v := q.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s", key)
+	}
+	return n, nil
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func writeFailure(w http.ResponseWriter, err error) {
+	writeBencode(w, bencodeFailure{FailureReason: err.Error()})
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "text/plain")
+	bencode.Marshal(w, v)
+}
@@ -0,0 +1,90 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func announceURL(base string, params map[string]string) string {
+	q := url.Values{}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	return base + "/announce?" + q.Encode()
+}
+
+func get(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Nil(t, bencode.Unmarshal(resp.Body, v))
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	ts := httptest.NewServer(NewServer(NewStore(time.Minute), 30*time.Second).Handler())
+	defer ts.Close()
+
+	infoHash := string(make([]byte, 20))
+
+	var first bencodeAnnounceResp
+	get(t, announceURL(ts.URL, map[string]string{
+		"info_hash": infoHash, "peer_id": "AAAAAAAAAAAAAAAAAAAA", "port": "6881", "left": "10", "event": "started", "ip": "192.0.2.1",
+	}), &first)
+	assert.Equal(t, 30, first.Interval)
+	assert.Equal(t, "", first.Peers)
+
+	get(t, announceURL(ts.URL, map[string]string{
+		"info_hash": infoHash, "peer_id": "CCCCCCCCCCCCCCCCCCCC", "port": "6883", "left": "10", "ip": "2001:db8::1",
+	}), &first)
+
+	var compact bencodeAnnounceResp
+	get(t, announceURL(ts.URL, map[string]string{
+		"info_hash": infoHash, "peer_id": "BBBBBBBBBBBBBBBBBBBB", "port": "6882", "left": "0", "compact": "1",
+	}), &compact)
+	assert.Equal(t, string([]byte{192, 0, 2, 1, 0x1A, 0xE1}), compact.Peers)
+	assert.Equal(t, string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE3}), compact.Peers6)
+	assert.Equal(t, 1, compact.Complete)
+	assert.Equal(t, 2, compact.Incomplete)
+
+	var full bencodeAnnounceRespFull
+	get(t, announceURL(ts.URL, map[string]string{
+		"info_hash": infoHash, "peer_id": "BBBBBBBBBBBBBBBBBBBB", "port": "6882", "left": "0", "compact": "0", "numwant": "1",
+	}), &full)
+	require.Len(t, full.Peers, 1)
+
+	var failure bencodeFailure
+	get(t, announceURL(ts.URL, map[string]string{"info_hash": "short", "peer_id": "BBBBBBBBBBBBBBBBBBBB", "port": "6882"}), &failure)
+	assert.Equal(t, "invalid info_hash", failure.FailureReason)
+
+	failure = bencodeFailure{}
+	get(t, announceURL(ts.URL, map[string]string{"info_hash": infoHash, "peer_id": "DDDDDDDDDDDDDDDDDDDD", "port": "6884"}), &failure)
+	assert.Equal(t, "missing left", failure.FailureReason)
+}
+
+func TestHTTPScrape(t *testing.T) {
+	store := NewStore(time.Minute)
+	ts := httptest.NewServer(NewServer(store, 30*time.Second).Handler())
+	defer ts.Close()
+
+	infoHash := [20]byte{0xaa}
+	_, err := store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{1}, Port: 6881, Left: 0, Event: EventCompleted})
+	require.Nil(t, err)
+
+	resp, err := http.Get(ts.URL + "/scrape?" + url.Values{"info_hash": []string{string(infoHash[:])}}.Encode())
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	res, err := bencode.Decode(resp.Body)
+	require.Nil(t, err)
+
+	files := res.(map[string]interface{})["files"].(map[string]interface{})
+	expected := map[string]interface{}{"complete": int64(1), "incomplete": int64(0), "downloaded": int64(1)}
+	assert.Equal(t, expected, files[string(infoHash[:])])
+}
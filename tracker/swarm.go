@@ -0,0 +1,235 @@
+package tracker
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultNumWant = 50
+const MaxNumWant = 200
+
+type Event int
+
+// Values match the UDP tracker protocol (BEP 15)
+const (
+	EventNone      Event = 0
+	EventCompleted Event = 1
+	EventStarted   Event = 2
+	EventStopped   Event = 3
+)
+
+type Peer struct {
+	ID       [20]byte
+	IP       net.IP
+	Port     uint16
+	Left     int64
+	LastSeen time.Time
+}
+
+type AnnounceRequest struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	IP       net.IP
+	Port     uint16
+	Left     int64
+	Event    Event
+	NumWant  int
+}
+
+type AnnounceResponse struct {
+	Peers      []Peer
+	Complete   int
+	Incomplete int
+}
+
+type ScrapeStats struct {
+	Complete   int
+	Incomplete int
+	Downloaded int
+}
+
+type swarm struct {
+	peers      map[[20]byte]*Peer
+	downloaded int
+}
+
+type Store struct {
+	PeerTTL time.Duration
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	allowlist map[[20]byte]bool
+	now       func() time.Time
+}
+
+func NewStore(peerTTL time.Duration) *Store {
+	return &Store{
+		PeerTTL: peerTTL,
+		swarms:  make(map[[20]byte]*swarm),
+		now:     time.Now,
+	}
+}
+
+// Allow restricts the store to the given infohashes, added to any allowed
+// before. Calling it with none makes the store accept no infohash until
+// some are allowed. Without any call every infohash is accepted.
+func (s *Store) Allow(infoHashes ...[20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.allowlist == nil {
+		s.allowlist = make(map[[20]byte]bool)
+	}
+	for _, h := range infoHashes {
+		s.allowlist[h] = true
+	}
+}
+
+func (s *Store) allowed(infoHash [20]byte) bool {
+	return s.allowlist == nil || s.allowlist[infoHash]
+}
+
+func (s *Store) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.allowed(req.InfoHash) {
+		return nil, fmt.Errorf("unregistered torrent")
+	}
+
+	if req.Port == 0 {
+		return nil, fmt.Errorf("invalid port")
+	}
+
+	now := s.now()
+
+	sw, ok := s.swarms[req.InfoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[[20]byte]*Peer)}
+		s.swarms[req.InfoHash] = sw
+	}
+	s.expire(sw, now)
+
+	switch req.Event {
+	case EventStopped:
+		delete(sw.peers, req.PeerID)
+	case EventCompleted:
+		sw.downloaded++
+		fallthrough
+	default:
+		sw.peers[req.PeerID] = &Peer{
+			ID:       req.PeerID,
+			IP:       req.IP,
+			Port:     req.Port,
+			Left:     req.Left,
+			LastSeen: now,
+		}
+	}
+
+	numWant := req.NumWant
+	if numWant <= 0 {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+
+	res := AnnounceResponse{}
+	for id, p := range sw.peers {
+		if p.Left == 0 {
+			res.Complete++
+		} else {
+			res.Incomplete++
+		}
+
+		if id == req.PeerID || req.Event == EventStopped {
+			continue
+		}
+
+		// Seeders have no use for other seeders
+		if req.Left == 0 && p.Left == 0 {
+			continue
+		}
+
+		res.Peers = append(res.Peers, *p)
+	}
+
+	rand.Shuffle(len(res.Peers), func(i, j int) {
+		res.Peers[i], res.Peers[j] = res.Peers[j], res.Peers[i]
+	})
+	if len(res.Peers) > numWant {
+		res.Peers = res.Peers[:numWant]
+	}
+
+	return &res, nil
+}
+
+// Scrape returns stats for the requested infohashes, or every known swarm
+// when none are given. Unknown and disallowed infohashes are omitted.
+func (s *Store) Scrape(infoHashes [][20]byte) map[[20]byte]ScrapeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	stats := make(map[[20]byte]ScrapeStats)
+	for _, infoHash := range infoHashes {
+		if !s.allowed(infoHash) {
+			continue
+		}
+
+		sw, ok := s.swarms[infoHash]
+		if !ok {
+			continue
+		}
+		s.expire(sw, now)
+
+		st := ScrapeStats{Downloaded: sw.downloaded}
+		for _, p := range sw.peers {
+			if p.Left == 0 {
+				st.Complete++
+			} else {
+				st.Incomplete++
+			}
+		}
+		stats[infoHash] = st
+	}
+
+	return stats
+}
+
+// Sweep expires stale peers in every swarm and forgets swarms that have
+// neither peers nor completed downloads.
+func (s *Store) Sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for infoHash, sw := range s.swarms {
+		s.expire(sw, now)
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+func (s *Store) expire(sw *swarm, now time.Time) {
+	if s.PeerTTL <= 0 {
+		return
+	}
+
+	for id, p := range sw.peers {
+		if now.Sub(p.LastSeen) > s.PeerTTL {
+			delete(sw.peers, id)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounce(t *testing.T) {
+	store := NewStore(time.Minute)
+	infoHash := [20]byte{1}
+
+	res, err := store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{1}, IP: net.IP{10, 0, 0, 1}, Port: 6881, Left: 0, Event: EventStarted})
+	require.Nil(t, err)
+	assert.Empty(t, res.Peers)
+	assert.Equal(t, 1, res.Complete)
+
+	res, err = store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{2}, IP: net.IP{10, 0, 0, 2}, Port: 6882, Left: 100, Event: EventStarted})
+	require.Nil(t, err)
+	require.Len(t, res.Peers, 1)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, res.Peers[0].IP)
+	assert.Equal(t, 1, res.Complete)
+	assert.Equal(t, 1, res.Incomplete)
+
+	_, err = store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{2}, IP: net.IP{10, 0, 0, 2}, Port: 6882, Event: EventCompleted})
+	require.Nil(t, err)
+
+	_, err = store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{1}, Port: 6881, Event: EventStopped})
+	require.Nil(t, err)
+
+	stats := store.Scrape([][20]byte{infoHash})
+	assert.Equal(t, ScrapeStats{Complete: 1, Incomplete: 0, Downloaded: 1}, stats[infoHash])
+}
+
+func TestScrapeUnknown(t *testing.T) {
+	store := NewStore(time.Minute)
+
+	_, err := store.Announce(AnnounceRequest{InfoHash: [20]byte{1}, PeerID: [20]byte{1}, Port: 6881, Left: 1})
+	require.Nil(t, err)
+
+	stats := store.Scrape([][20]byte{{1}, {2}})
+	assert.Equal(t, ScrapeStats{Incomplete: 1}, stats[[20]byte{1}])
+	assert.NotContains(t, stats, [20]byte{2})
+}
+
+func TestAnnounceNumWant(t *testing.T) {
+	store := NewStore(time.Minute)
+	infoHash := [20]byte{1}
+
+	for i := 0; i < 10; i++ {
+		_, err := store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{byte(i)}, IP: net.IP{10, 0, 0, byte(i)}, Port: 6881, Left: 1})
+		require.Nil(t, err)
+	}
+
+	res, err := store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{99}, IP: net.IP{10, 0, 0, 99}, Port: 6881, Left: 1, NumWant: 3})
+	require.Nil(t, err)
+	assert.Len(t, res.Peers, 3)
+}
+
+func TestPeerExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := NewStore(time.Minute)
+	store.now = func() time.Time { return now }
+	infoHash := [20]byte{1}
+
+	_, err := store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{1}, IP: net.IP{10, 0, 0, 1}, Port: 6881, Left: 1})
+	require.Nil(t, err)
+
+	now = now.Add(2 * time.Minute)
+
+	res, err := store.Announce(AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{2}, IP: net.IP{10, 0, 0, 2}, Port: 6881, Left: 1})
+	require.Nil(t, err)
+	assert.Empty(t, res.Peers)
+
+	now = now.Add(2 * time.Minute)
+	store.Sweep()
+	assert.Empty(t, store.swarms)
+}
+
+func TestAllowlist(t *testing.T) {
+	store := NewStore(time.Minute)
+	store.Allow([20]byte{1})
+
+	_, err := store.Announce(AnnounceRequest{InfoHash: [20]byte{1}, PeerID: [20]byte{1}, Port: 6881})
+	assert.Nil(t, err)
+
+	_, err = store.Announce(AnnounceRequest{InfoHash: [20]byte{2}, PeerID: [20]byte{1}, Port: 6881})
+	assert.NotNil(t, err)
+
+	stats := store.Scrape([][20]byte{{1}, {2}})
+	assert.Contains(t, stats, [20]byte{1})
+	assert.NotContains(t, stats, [20]byte{2})
+}
+
+func TestAllowNone(t *testing.T) {
+	store := NewStore(time.Minute)
+	store.Allow()
+
+	_, err := store.Announce(AnnounceRequest{InfoHash: [20]byte{1}, PeerID: [20]byte{1}, Port: 6881})
+	assert.NotNil(t, err)
+
+	store.Allow([20]byte{1}, [20]byte{2})
+
+	_, err = store.Announce(AnnounceRequest{InfoHash: [20]byte{2}, PeerID: [20]byte{1}, Port: 6881})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,244 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const udpProtocolID = 0x41727101980
+
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// Connection IDs are valid for two minutes (BEP 15); keeping the previous
+// secret around covers IDs issued just before a rotation.
+const udpSecretLifetime = 2 * time.Minute
+
+const maxScrapeHashes = 74
+
+type UDPServer struct {
+	Store    *Store
+	Interval time.Duration
+
+	mu         sync.Mutex
+	secret     [32]byte
+	prevSecret [32]byte
+	rotated    time.Time
+	now        func() time.Time
+}
+
+func NewUDPServer(store *Store, interval time.Duration) *UDPServer {
+	s := &UDPServer{Store: store, Interval: interval, now: time.Now}
+	s.rotate()
+	return s
+}
+
+func (s *UDPServer) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+func (s *UDPServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		res := s.handle(buf[:n], addr)
+		if res != nil {
+			conn.WriteTo(res, addr)
+		}
+	}
+}
+
+func (s *UDPServer) rotate() {
+	s.prevSecret = s.secret
+	rand.Read(s.secret[:])
+	s.rotated = s.now()
+}
+
+func (s *UDPServer) maybeRotate() {
+	elapsed := s.now().Sub(s.rotated)
+	if elapsed > udpSecretLifetime {
+		s.rotate()
+	}
+	if elapsed > 2*udpSecretLifetime {
+		s.rotate()
+	}
+}
+
+func (s *UDPServer) connectionID(secret [32]byte, addr net.Addr) uint64 {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(addrIP(addr).String()))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (s *UDPServer) newConnectionID(addr net.Addr) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maybeRotate()
+	return s.connectionID(s.secret, addr)
+}
+
+func (s *UDPServer) validConnectionID(id uint64, addr net.Addr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maybeRotate()
+	return id == s.connectionID(s.secret, addr) || id == s.connectionID(s.prevSecret, addr)
+}
+
+func (s *UDPServer) handle(packet []byte, addr net.Addr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	txID := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+
+		res := make([]byte, 16)
+		binary.BigEndian.PutUint32(res[0:4], udpActionConnect)
+		binary.BigEndian.PutUint32(res[4:8], txID)
+		binary.BigEndian.PutUint64(res[8:16], s.newConnectionID(addr))
+		return res
+	}
+
+	if !s.validConnectionID(connID, addr) {
+		return udpError(txID, "invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		return s.handleAnnounce(packet, addr, txID)
+	case udpActionScrape:
+		return s.handleScrape(packet, txID)
+	default:
+		return udpError(txID, "unknown action")
+	}
+}
+
+func (s *UDPServer) handleAnnounce(packet []byte, addr net.Addr, txID uint32) []byte {
+	if len(packet) < 98 {
+		return udpError(txID, "announce packet too short")
+	}
+
+	req := AnnounceRequest{
+		IP:      addrIP(addr),
+		Left:    int64(binary.BigEndian.Uint64(packet[64:72])),
+		Event:   Event(binary.BigEndian.Uint32(packet[80:84])),
+		NumWant: int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+		Port:    binary.BigEndian.Uint16(packet[96:98]),
+	}
+	copy(req.InfoHash[:], packet[16:36])
+	copy(req.PeerID[:], packet[36:56])
+
+	// An explicit IP is only honoured for IPv4 announces
+	if ip := net.IP(packet[84:88]); !ip.Equal(net.IPv4zero) && req.IP.To4() != nil {
+		req.IP = net.IPv4(ip[0], ip[1], ip[2], ip[3])
+	}
+
+	res, err := s.Store.Announce(req)
+	if err != nil {
+		return udpError(txID, err.Error())
+	}
+
+	// Peers are returned in the address family of the request
+	ipv4 := req.IP.To4() != nil
+
+	buf := make([]byte, 20, 20+len(res.Peers)*18)
+	binary.BigEndian.PutUint32(buf[0:4], udpActionAnnounce)
+	binary.BigEndian.PutUint32(buf[4:8], txID)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(s.Interval/time.Second))
+	binary.BigEndian.PutUint32(buf[12:16], uint32(res.Incomplete))
+	binary.BigEndian.PutUint32(buf[16:20], uint32(res.Complete))
+
+	port := make([]byte, 2)
+	for _, p := range res.Peers {
+		binary.BigEndian.PutUint16(port, p.Port)
+
+		if ip4 := p.IP.To4(); ip4 != nil && ipv4 {
+			buf = append(buf, ip4...)
+			buf = append(buf, port...)
+		} else if ip4 == nil && !ipv4 {
+			buf = append(buf, p.IP.To16()...)
+			buf = append(buf, port...)
+		}
+	}
+
+	return buf
+}
+
+func (s *UDPServer) handleScrape(packet []byte, txID uint32) []byte {
+	n := (len(packet) - 16) / 20
+	if n > maxScrapeHashes {
+		n = maxScrapeHashes
+	}
+
+	infoHashes := make([][20]byte, n)
+	for i := range infoHashes {
+		copy(infoHashes[i][:], packet[16+i*20:16+(i+1)*20])
+	}
+
+	stats := s.Store.Scrape(infoHashes)
+
+	buf := make([]byte, 8+n*12)
+	binary.BigEndian.PutUint32(buf[0:4], udpActionScrape)
+	binary.BigEndian.PutUint32(buf[4:8], txID)
+
+	for i, infoHash := range infoHashes {
+		st := stats[infoHash]
+		offset := 8 + i*12
+		binary.BigEndian.PutUint32(buf[offset:offset+4], uint32(st.Complete))
+		binary.BigEndian.PutUint32(buf[offset+4:offset+8], uint32(st.Downloaded))
+		binary.BigEndian.PutUint32(buf[offset+8:offset+12], uint32(st.Incomplete))
+	}
+
+	return buf
+}
+
+func udpError(txID uint32, msg string) []byte {
+	buf := make([]byte, 8+len(msg))
+	binary.BigEndian.PutUint32(buf[0:4], udpActionError)
+	binary.BigEndian.PutUint32(buf[4:8], txID)
+	copy(buf[8:], msg)
+	return buf
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,114 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func udpConnect(t *testing.T, s *UDPServer, addr net.Addr) uint64 {
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], 42)
+
+	res := s.handle(req, addr)
+	require.Len(t, res, 16)
+	assert.Equal(t, uint32(udpActionConnect), binary.BigEndian.Uint32(res[0:4]))
+	assert.Equal(t, uint32(42), binary.BigEndian.Uint32(res[4:8]))
+
+	return binary.BigEndian.Uint64(res[8:16])
+}
+
+func udpAnnounce(connID uint64, infoHash, peerID [20]byte, left uint64, event Event, port uint16) []byte {
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:16], 7)
+	copy(req[16:36], infoHash[:])
+	copy(req[36:56], peerID[:])
+	binary.BigEndian.PutUint64(req[64:72], left)
+	binary.BigEndian.PutUint32(req[80:84], uint32(event))
+	binary.BigEndian.PutUint32(req[92:96], 0xffffffff)
+	binary.BigEndian.PutUint16(req[96:98], port)
+	return req
+}
+
+func TestUDPAnnounceAndScrape(t *testing.T) {
+	s := NewUDPServer(NewStore(time.Minute), 30*time.Second)
+	infoHash := [20]byte{0xaa}
+
+	seeder := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 1000}
+	res := s.handle(udpAnnounce(udpConnect(t, s, seeder), infoHash, [20]byte{1}, 0, EventStarted, 6881), seeder)
+	require.Len(t, res, 20)
+
+	leecher := &net.UDPAddr{IP: net.IP{192, 0, 2, 2}, Port: 1000}
+	res = s.handle(udpAnnounce(udpConnect(t, s, leecher), infoHash, [20]byte{2}, 100, EventStarted, 6882), leecher)
+	require.Len(t, res, 26)
+	assert.Equal(t, uint32(udpActionAnnounce), binary.BigEndian.Uint32(res[0:4]))
+	assert.Equal(t, uint32(30), binary.BigEndian.Uint32(res[8:12]))
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(res[12:16]))
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(res[16:20]))
+	assert.Equal(t, []byte{192, 0, 2, 1, 0x1A, 0xE1}, res[20:26])
+
+	req := make([]byte, 36)
+	binary.BigEndian.PutUint64(req[0:8], udpConnect(t, s, leecher))
+	binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+	copy(req[16:36], infoHash[:])
+
+	res = s.handle(req, leecher)
+	require.Len(t, res, 20)
+	assert.Equal(t, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}, res[8:20])
+}
+
+func TestUDPConnectionID(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewUDPServer(NewStore(time.Minute), 30*time.Second)
+	s.now = func() time.Time { return now }
+	s.rotated = now
+
+	addr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 1000}
+	other := &net.UDPAddr{IP: net.IP{192, 0, 2, 2}, Port: 1000}
+	connID := udpConnect(t, s, addr)
+
+	assert.True(t, s.validConnectionID(connID, addr))
+	assert.False(t, s.validConnectionID(connID, other))
+
+	now = now.Add(udpSecretLifetime + time.Second)
+	assert.True(t, s.validConnectionID(connID, addr))
+
+	now = now.Add(udpSecretLifetime + time.Second)
+	assert.False(t, s.validConnectionID(connID, addr))
+
+	res := s.handle(udpAnnounce(connID, [20]byte{1}, [20]byte{1}, 0, EventNone, 6881), addr)
+	assert.Equal(t, uint32(udpActionError), binary.BigEndian.Uint32(res[0:4]))
+}
+
+func TestUDPServe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	go NewUDPServer(NewStore(time.Minute), time.Minute).Serve(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer client.Close()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[12:16], 9)
+	_, err = client.Write(req)
+	require.Nil(t, err)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	res := make([]byte, 64)
+	n, err := client.Read(res)
+	require.Nil(t, err)
+	assert.Equal(t, 16, n)
+	assert.Equal(t, uint32(9), binary.BigEndian.Uint32(res[4:8]))
+}
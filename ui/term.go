@@ -0,0 +1,12 @@
+package ui
+
+import "os"
+
+// isTerminal reports whether f is a character device, as a terminal is
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
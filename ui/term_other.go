@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package ui
+
+import "os"
+
+func terminalWidth(f *os.File) int {
+	return 0
+}
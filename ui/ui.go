@@ -0,0 +1,258 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/p2p"
+)
+
+// How often the display is redrawn on a terminal, and how often a status
+// line is printed otherwise
+const (
+	TerminalInterval = 500 * time.Millisecond
+	LineInterval     = 10 * time.Second
+)
+
+// maxPeerRows bounds the peer table; the fastest peers are shown
+const maxPeerRows = 10
+
+const defaultWidth = 80
+
+// Display renders download progress. On a terminal it redraws a full
+// status block in place; elsewhere it prints one status line at a time.
+type Display struct {
+	out   io.Writer
+	tty   bool
+	width int
+	name  string
+
+	// lines is the height of the last frame, which the next one overwrites
+	lines int
+}
+
+// New writes to out, drawing in place if out is a terminal
+func New(out *os.File, name string) *Display {
+	tty := isTerminal(out)
+
+	width := defaultWidth
+	if tty {
+		if w := terminalWidth(out); w > 0 {
+			width = w
+		}
+	}
+
+	return NewWriter(out, name, tty, width)
+}
+
+func NewWriter(out io.Writer, name string, tty bool, width int) *Display {
+	return &Display{out: out, tty: tty, width: width, name: name}
+}
+
+// Terminal reports whether the display draws in place
+func (d *Display) Terminal() bool {
+	return d.tty
+}
+
+// Run renders h's stats at regular intervals until the download ends or
+// ctx is cancelled, then renders a final frame
+func (d *Display) Run(ctx context.Context, h *p2p.Handle) {
+	interval := LineInterval
+	if d.tty {
+		interval = TerminalInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.Render(h.Stats())
+			return
+		case <-h.Done():
+			d.Render(h.Stats())
+			return
+		case <-ticker.C:
+			d.Render(h.Stats())
+		}
+	}
+}
+
+func (d *Display) Render(s p2p.Stats) {
+	if !d.tty {
+		fmt.Fprintln(d.out, StatusLine(d.name, s))
+		return
+	}
+
+	frame := Frame(d.name, s, d.width)
+
+	var b strings.Builder
+	if d.lines > 0 {
+		// Back to the top of the previous frame, and clear it
+		fmt.Fprintf(&b, "\x1b[%dA\r\x1b[J", d.lines)
+	}
+	b.WriteString(frame)
+
+	d.lines = strings.Count(frame, "\n")
+	io.WriteString(d.out, b.String())
+}
+
+// StatusLine summarises s on one line
+func StatusLine(name string, s p2p.Stats) string {
+	return fmt.Sprintf("%s: %s %5.1f%% (%d/%d pieces), %s down, %s up, ETA %s, %d peers (%d seeds)",
+		name, s.State, percent(s), s.PiecesDone, s.PiecesTotal,
+		FormatRate(s.DownloadRate), FormatRate(s.UploadRate), FormatETA(s), s.Peers, s.Seeds)
+}
+
+// Frame renders the full terminal display: a summary, the piece map and
+// the peer table, each line at most width columns
+func Frame(name string, s p2p.Stats, width int) string {
+	var b strings.Builder
+
+	line := func(format string, args ...interface{}) {
+		b.WriteString(truncate(fmt.Sprintf(format, args...), width))
+		b.WriteByte('\n')
+	}
+
+	line("%s  %s", name, s.State)
+	line("%5.1f%%  %s / %s  %d/%d pieces",
+		percent(s), FormatBytes(s.BytesDone), FormatBytes(s.BytesTotal), s.PiecesDone, s.PiecesTotal)
+	line("down %s  up %s  ETA %s  peers %d  seeds %d",
+		FormatRate(s.DownloadRate), FormatRate(s.UploadRate), FormatETA(s), s.Peers, s.Seeds)
+	line("[%s]", PieceMap(s, width-2))
+	line("")
+	line("%-24s %-16s %11s %11s %5s  %s", "PEER", "CLIENT", "DOWN", "UP", "HAS", "FLAGS")
+
+	for i, p := range s.PeerStats {
+		if i == maxPeerRows {
+			line("... and %d more", len(s.PeerStats)-maxPeerRows)
+			break
+		}
+
+		line("%-24s %-16s %11s %11s %4.0f%%  %s",
+			truncate(p.Peer.String(), 24), truncate(p.Client, 16), FormatRate(p.DownloadRate), FormatRate(p.UploadRate),
+			p.Progress*100, Flags(p))
+	}
+
+	return b.String()
+}
+
+// Flags abbreviates a peer's state: S seed, C choking us, I interested in
+// us, F fast extension
+func Flags(p p2p.PeerStats) string {
+	var b strings.Builder
+
+	flag := func(set bool, c byte) {
+		if set {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+
+	flag(p.Progress == 1, 'S')
+	flag(p.Choked, 'C')
+	flag(p.Interested, 'I')
+	flag(p.Fast, 'F')
+
+	return b.String()
+}
+
+// PieceMap draws the pieces in width cells, each standing for a run of
+// pieces: full when all of them are done, shaded when some are
+func PieceMap(s p2p.Stats, width int) string {
+	if width <= 0 || s.PiecesTotal == 0 {
+		return ""
+	}
+	if width > s.PiecesTotal {
+		width = s.PiecesTotal
+	}
+
+	var b strings.Builder
+
+	for cell := 0; cell < width; cell++ {
+		begin := cell * s.PiecesTotal / width
+		end := (cell + 1) * s.PiecesTotal / width
+
+		done := 0
+		for i := begin; i < end; i++ {
+			if s.Pieces.HasPiece(i) {
+				done++
+			}
+		}
+
+		switch {
+		case done == end-begin:
+			b.WriteRune('█')
+		case done > 0:
+			b.WriteRune('▒')
+		default:
+			b.WriteRune('·')
+		}
+	}
+
+	return b.String()
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func FormatRate(rate float64) string {
+	return FormatBytes(int64(rate)) + "/s"
+}
+
+// FormatETA shows the time left, or "-" when it cannot be estimated
+func FormatETA(s p2p.Stats) string {
+	if s.State == p2p.StateCompleted {
+		return "done"
+	}
+	if s.ETA <= 0 {
+		return "-"
+	}
+
+	eta := s.ETA.Round(time.Second)
+	h := int(eta / time.Hour)
+	m := int(eta % time.Hour / time.Minute)
+	sec := int(eta % time.Minute / time.Second)
+
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh%02dm", h, m)
+	case m > 0:
+		return fmt.Sprintf("%dm%02ds", m, sec)
+	}
+	return fmt.Sprintf("%ds", sec)
+}
+
+func percent(s p2p.Stats) float64 {
+	if s.PiecesTotal == 0 {
+		return 0
+	}
+	return float64(s.PiecesDone) / float64(s.PiecesTotal) * 100
+}
+
+// truncate shortens s to at most width runes
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if width <= 0 || len(r) <= width {
+		return s
+	}
+	return string(r[:width])
+}
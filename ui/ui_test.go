@@ -0,0 +1,129 @@
+package ui
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prabal199251/Torrent-Client/bitfield"
+	"github.com/prabal199251/Torrent-Client/p2p"
+	"github.com/prabal199251/Torrent-Client/peers"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStats() p2p.Stats {
+	return p2p.Stats{
+		State:        p2p.StateDownloading,
+		PiecesDone:   5,
+		PiecesTotal:  10,
+		Pieces:       bitfield.Bitfield{0b11111000, 0},
+		BytesDone:    5 << 20,
+		BytesTotal:   10 << 20,
+		DownloadRate: 1 << 20,
+		Peers:        2,
+		Seeds:        1,
+		ETA:          5 * time.Second,
+		PeerStats: []p2p.PeerStats{
+			{
+				Peer:         peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+				Client:       "Transmission 4.0",
+				DownloadRate: 1 << 20,
+				Progress:     1,
+				Fast:         true,
+			},
+			{
+				Peer:     peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881},
+				Progress: 0.5,
+				Choked:   true,
+			},
+		},
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                 "0 B",
+		1023:              "1023 B",
+		1024:              "1.0 KiB",
+		1536:              "1.5 KiB",
+		10 << 20:          "10.0 MiB",
+		3 << 30:           "3.0 GiB",
+		5<<40 + 512<<30:   "5.5 TiB",
+		1<<50 + 1<<49 - 1: "1.5 PiB",
+	}
+
+	for input, output := range tests {
+		assert.Equal(t, output, FormatBytes(input), input)
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	tests := map[string]struct {
+		input  p2p.Stats
+		output string
+	}{
+		"unknown":   {p2p.Stats{}, "-"},
+		"seconds":   {p2p.Stats{ETA: 42 * time.Second}, "42s"},
+		"minutes":   {p2p.Stats{ETA: 3*time.Minute + 4*time.Second}, "3m04s"},
+		"hours":     {p2p.Stats{ETA: 2*time.Hour + 5*time.Minute}, "2h05m"},
+		"completed": {p2p.Stats{State: p2p.StateCompleted}, "done"},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, FormatETA(test.input), name)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	stats := testStats()
+
+	assert.Equal(t, "S--F", Flags(stats.PeerStats[0]))
+	assert.Equal(t, "-C--", Flags(stats.PeerStats[1]))
+}
+
+func TestPieceMap(t *testing.T) {
+	stats := testStats()
+
+	assert.Equal(t, "█████·····", PieceMap(stats, 10))
+	assert.Equal(t, "█████·····", PieceMap(stats, 80))
+	assert.Equal(t, "██▒··", PieceMap(stats, 5))
+	assert.Equal(t, "", PieceMap(p2p.Stats{}, 10))
+}
+
+func TestFrame(t *testing.T) {
+	frame := Frame("debian.iso", testStats(), 80)
+	lines := strings.Split(strings.TrimSuffix(frame, "\n"), "\n")
+
+	assert.Equal(t, "debian.iso  downloading", lines[0])
+	assert.Equal(t, " 50.0%  5.0 MiB / 10.0 MiB  5/10 pieces", lines[1])
+	assert.Equal(t, "down 1.0 MiB/s  up 0 B/s  ETA 5s  peers 2  seeds 1", lines[2])
+	assert.Equal(t, "[█████·····]", lines[3])
+	assert.Contains(t, lines[6], "10.0.0.1:6881")
+	assert.Contains(t, lines[6], "Transmission 4.0")
+	assert.Contains(t, lines[7], "-C--")
+
+	for _, line := range lines {
+		assert.LessOrEqual(t, len([]rune(line)), 80)
+	}
+}
+
+func TestRender(t *testing.T) {
+	var buf bytes.Buffer
+	d := NewWriter(&buf, "debian.iso", false, 80)
+
+	d.Render(testStats())
+	assert.Equal(t, "debian.iso: downloading  50.0% (5/10 pieces), 1.0 MiB/s down, 0 B/s up, ETA 5s, 2 peers (1 seeds)\n", buf.String())
+
+	buf.Reset()
+	d = NewWriter(&buf, "debian.iso", true, 80)
+
+	d.Render(testStats())
+	assert.NotContains(t, buf.String(), "\x1b[")
+
+	// Later frames overwrite the previous one
+	buf.Reset()
+	d.Render(testStats())
+	assert.True(t, strings.HasPrefix(buf.String(), "\x1b[8A\r\x1b[J"))
+}